@@ -765,13 +765,34 @@ func (kp *KeyPath) HasDoubleGlob() bool {
 		return false
 	}
 	for _, el := range kp.Path {
-		if el.UnquotedString != nil && el.ScalarString() == "**" {
-			return true
+		if el.UnquotedString != nil {
+			if _, ok := ParseDoubleGlob(el.UnquotedString.Pattern); ok {
+				return true
+			}
 		}
 	}
 	return false
 }
 
+// ParseDoubleGlob reports whether pattern, as in UnquotedString.Pattern, is the double glob
+// **, optionally followed by a qualifier restricting it to fields without or with children:
+// **(leaf) or **(container). qualifier is returned without the parentheses and lowercased.
+func ParseDoubleGlob(pattern []string) (qualifier string, ok bool) {
+	if len(pattern) < 3 || pattern[0] != "*" || pattern[1] != "" || pattern[2] != "*" {
+		return "", false
+	}
+	switch {
+	case len(pattern) == 3:
+		return "", true
+	case len(pattern) == 4:
+		switch q := strings.ToLower(pattern[3]); q {
+		case "(leaf)", "(container)":
+			return strings.Trim(q, "()"), true
+		}
+	}
+	return "", false
+}
+
 func (kp *KeyPath) HasGlob() bool {
 	if kp == nil {
 		return false
@@ -802,6 +823,9 @@ type EdgeIndex struct {
 	// [n] or [*]
 	Int  *int `json:"int"`
 	Glob bool `json:"glob"`
+
+	// [m..n] sets Int to m and IntEnd to n. Both ends are inclusive.
+	IntEnd *int `json:"int_end,omitempty"`
 }
 
 type Substitution struct {
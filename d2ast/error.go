@@ -8,8 +8,16 @@ package d2ast
 type Error struct {
 	Range   Range  `json:"range"`
 	Message string `json:"errmsg"`
+
+	// Err optionally identifies the kind of error for errors.Is and errors.As. It isn't
+	// part of Message.
+	Err error `json:"-"`
 }
 
 func (e Error) Error() string {
 	return e.Message
 }
+
+func (e Error) Unwrap() error {
+	return e.Err
+}
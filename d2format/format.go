@@ -453,6 +453,10 @@ func (p *printer) edgeIndex(ei *d2ast.EdgeIndex) {
 		p.sb.WriteByte('*')
 	} else {
 		p.sb.WriteString(strconv.Itoa(*ei.Int))
+		if ei.IntEnd != nil {
+			p.sb.WriteString("..")
+			p.sb.WriteString(strconv.Itoa(*ei.IntEnd))
+		}
 	}
 	p.sb.WriteByte(']')
 }
@@ -579,6 +579,12 @@ hi # Fraud is the homage that force pays to reason.
 			name: "edge_index_glob",
 			in:   `(x -> y)[*]`,
 			exp: `(x -> y)[*]
+`,
+		},
+		{
+			name: "edge_index_range",
+			in:   `(x -> y)[1 .. 3]`,
+			exp: `(x -> y)[1..3]
 `,
 		},
 		{
@@ -0,0 +1,138 @@
+package d2ir
+
+import (
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// NewMap returns an empty root map for building IR without parsing. See Map.Field and
+// Map.Edge.
+//
+// Nodes created by the builder have a single synthesized reference whose AST is not part
+// of any parsed file so that Reference based methods like LastRef keep working.
+func NewMap() *Map {
+	m := &Map{}
+	m.initRoot()
+	return m
+}
+
+// Field returns the field name in m, creating it if it doesn't exist. name is a single
+// key, not a path. Reserved keywords are lowercased as when compiling.
+func (m *Map) Field(name string) *Field {
+	if _, ok := d2graph.ReservedKeywords[strings.ToLower(name)]; ok {
+		name = strings.ToLower(name)
+	}
+	if f := m.GetField(name); f != nil {
+		return f
+	}
+
+	kp := d2ast.MakeKeyPath([]string{name})
+	f := &Field{
+		parent: m,
+		Name:   name,
+		References: []*FieldReference{{
+			String:  kp.Path[0].Unbox(),
+			KeyPath: kp,
+			Context: &RefContext{
+				Key: &d2ast.Key{
+					Key: kp,
+				},
+				ScopeMap: m,
+			},
+		}},
+	}
+	m.Fields = append(m.Fields, f)
+	return f
+}
+
+// Edge creates the edge src -> dst and returns it. As when compiling, missing endpoints are
+// created, the edge is placed in the map of the longest common prefix of src and dst and
+// it's indexed after any existing parallel edges.
+//
+// src and dst must not pass through fields holding arrays.
+func (m *Map) Edge(src, dst []string) *Edge {
+	for len(src) > 1 && len(dst) > 1 && strings.EqualFold(src[0], dst[0]) {
+		m = m.Field(src[0]).EnsureMap()
+		src = src[1:]
+		dst = dst[1:]
+	}
+	m.ensurePath(src)
+	m.ensurePath(dst)
+
+	eid := &EdgeID{
+		SrcPath:  append([]string(nil), src...),
+		DstPath:  append([]string(nil), dst...),
+		DstArrow: true,
+	}
+	k := &d2ast.Key{
+		Edges: []*d2ast.Edge{eid.astEdge()},
+	}
+	e := &Edge{
+		parent: m,
+		ID:     eid,
+		References: []*EdgeReference{{
+			Context: &RefContext{
+				Edge:     k.Edges[0],
+				Key:      k,
+				ScopeMap: m,
+			},
+		}},
+	}
+	m.appendEdge(e)
+	return e
+}
+
+func (m *Map) ensurePath(ida []string) {
+	f := m.Field(ida[0])
+	for _, name := range ida[1:] {
+		f = f.EnsureMap().Field(name)
+	}
+}
+
+// EnsureMap returns the map of f, creating it if f has no composite. It returns nil if f
+// holds an array.
+func (f *Field) EnsureMap() *Map {
+	if _, ok := f.Composite.(*Array); ok {
+		return nil
+	}
+	if f.Map() == nil {
+		f.Composite = &Map{
+			parent: f,
+		}
+	}
+	return f.Map()
+}
+
+// EnsureMap returns the map of e, creating it if e has none.
+func (e *Edge) EnsureMap() *Map {
+	if e.Map_ == nil {
+		e.Map_ = &Map{
+			parent: e,
+		}
+	}
+	return e.Map_
+}
+
+// SetPrimary sets the primary value of f. A nil value clears it.
+func (f *Field) SetPrimary(value d2ast.Scalar) {
+	f.Primary_ = nil
+	if value != nil {
+		f.Primary_ = &Scalar{
+			parent: f,
+			Value:  value,
+		}
+	}
+}
+
+// SetPrimary sets the primary value of e. A nil value clears it.
+func (e *Edge) SetPrimary(value d2ast.Scalar) {
+	e.Primary_ = nil
+	if value != nil {
+		e.Primary_ = &Scalar{
+			parent: e,
+			Value:  value,
+		}
+	}
+}
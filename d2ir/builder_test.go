@@ -0,0 +1,111 @@
+package d2ir_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func TestBuilder(t *testing.T) {
+	t.Parallel()
+
+	exp := mustCompile(t, `x: hello
+a.Style.fill: red
+a -> b: hi
+a -> b
+c.d -> c.e: {
+  style.stroke: blue
+}
+`)
+
+	m := d2ir.NewMap()
+	m.Field("x").SetPrimary(d2ast.FlatUnquotedString("hello"))
+	m.Field("a").EnsureMap().Field("Style").EnsureMap().Field("fill").SetPrimary(d2ast.FlatUnquotedString("red"))
+	m.Edge([]string{"a"}, []string{"b"}).SetPrimary(d2ast.FlatUnquotedString("hi"))
+	e := m.Edge([]string{"a"}, []string{"b"})
+	e2 := m.Edge([]string{"c", "d"}, []string{"c", "e"})
+	e2.EnsureMap().Field("style").EnsureMap().Field("stroke").SetPrimary(d2ast.FlatUnquotedString("blue"))
+
+	assert.True(t, m.Equal(exp))
+	assert.String(t, exp.String(), m.String())
+	assert.String(t, `(a -> b)[1]`, e.ID.String())
+	assert.String(t, `(d -> e)[0]`, e2.ID.String())
+	assert.True(t, m.GetField("a", "style") == m.Field("a").Map().Field("STYLE"))
+	assert.String(t, `d -> e`, d2format.Format(e2.LastRef().AST()))
+
+	m2 := mustCompile(t, m.String())
+	assert.True(t, m2.Equal(m))
+}
+
+func TestBuilderConcurrentEdges(t *testing.T) {
+	t.Parallel()
+
+	const n = 8
+	m := d2ir.NewMap()
+	shared := m.Field("shared").EnsureMap()
+	shared.Field("a")
+	shared.Field("b")
+	subtrees := make([]*d2ir.Map, n)
+	for i := range subtrees {
+		subtrees[i] = m.Field(fmt.Sprintf("s%d", i)).EnsureMap()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(sub *d2ir.Map) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				sub.Edge([]string{"x"}, []string{"y"})
+				shared.Edge([]string{"a"}, []string{"b"})
+			}
+		}(subtrees[i])
+	}
+	wg.Wait()
+
+	assertContiguous := func(ea []*d2ir.Edge, count int) {
+		t.Helper()
+		assert.Equal(t, count, len(ea))
+		seen := make(map[int]bool)
+		for _, e := range ea {
+			seen[*e.ID.Index] = true
+		}
+		for i := 0; i < count; i++ {
+			assert.True(t, seen[i])
+		}
+	}
+	assertContiguous(shared.Edges, n*n)
+	for _, sub := range subtrees {
+		assertContiguous(sub.Edges, n)
+		for i, e := range sub.Edges {
+			assert.Equal(t, i, *e.ID.Index)
+		}
+	}
+}
+
+func TestGetFieldExact(t *testing.T) {
+	t.Parallel()
+
+	m := d2ir.NewMap()
+	upper := m.Field("Node")
+	upper.EnsureMap().Field("Child")
+	assert.True(t, m.Field("node") == upper)
+
+	// Force a second field differing only by case.
+	lower := d2ir.NewMap().Field("node")
+	m.Fields = append(m.Fields, lower)
+
+	assert.True(t, m.GetField("node") == upper)
+	assert.True(t, m.GetFieldExact("Node") == upper)
+	assert.True(t, m.GetFieldExact("node") == lower)
+	assert.True(t, m.GetFieldExact("NODE") == nil)
+	assert.True(t, m.GetFieldExact("Node", "Child") != nil)
+	assert.True(t, m.GetFieldExact("Node", "child") == nil)
+	assert.True(t, upper.Map().GetFieldExact("_", "node") == lower)
+}
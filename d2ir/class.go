@@ -0,0 +1,295 @@
+package d2ir
+
+import (
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+)
+
+// ApplyClass inlines the fields of the class name onto f and removes name from f's class
+// keyword. Fields that f already sets explicitly are not overwritten.
+func (f *Field) ApplyClass(name string) error {
+	classMap := ParentMap(f).GetClassMap(name)
+	if classMap == nil {
+		return fmt.Errorf("class %q not found", name)
+	}
+	if _, ok := f.Composite.(*Array); ok {
+		return fmt.Errorf("cannot apply class %q to array", name)
+	}
+	if f.Map() == nil {
+		f.Composite = &Map{
+			parent: f,
+		}
+	}
+
+	inlineClassMap(f.Map(), classMap)
+	f.Map().removeClass(name)
+	return nil
+}
+
+// RenameClass renames the class oldName to newName in the board m and the boards within it,
+// each of which holds its own copy of the classes it inherits, and rewrites the class
+// keyword of every field and edge using it. It errors if oldName isn't found or newName is
+// already a class.
+func (m *Map) RenameClass(oldName, newName string) error {
+	var boards []*Map
+	m.boardMaps(&boards)
+
+	var classes []*Field
+	for _, b := range boards {
+		if !strings.EqualFold(oldName, newName) && b.classField(newName) != nil {
+			return fmt.Errorf("class %q already exists", newName)
+		}
+		if cf := b.classField(oldName); cf != nil {
+			classes = append(classes, cf)
+		}
+	}
+	if len(classes) == 0 {
+		return fmt.Errorf("class %q not found", oldName)
+	}
+
+	for _, cf := range classes {
+		cf.Name = newName
+	}
+	m.renameClassUsages(oldName, newName)
+	return nil
+}
+
+// boardMaps appends m and the maps of the boards within it at any depth to boards.
+func (m *Map) boardMaps(boards *[]*Map) {
+	*boards = append(*boards, m)
+	for _, f := range m.Fields {
+		if findBoardKeyword(f.Name) == -1 || f.Map() == nil {
+			continue
+		}
+		for _, bf := range f.Map().Fields {
+			if bf.Map() != nil {
+				bf.Map().boardMaps(boards)
+			}
+		}
+	}
+}
+
+func (m *Map) classField(name string) *Field {
+	classes := m.GetField("classes")
+	if classes == nil || classes.Map() == nil {
+		return nil
+	}
+	return classes.Map().GetField(name)
+}
+
+func (m *Map) renameClassUsages(oldName, newName string) {
+	if m == nil {
+		return
+	}
+	if class := m.GetField("class"); class != nil {
+		renameClassValue(class.Primary_, oldName, newName)
+		if arr, ok := class.Composite.(*Array); ok {
+			for _, v := range arr.Values {
+				if s, ok := v.(*Scalar); ok {
+					renameClassValue(s, oldName, newName)
+				}
+			}
+		}
+	}
+	for _, f := range m.Fields {
+		if f.Name == "classes" {
+			continue
+		}
+		f.Map().renameClassUsages(oldName, newName)
+	}
+	for _, e := range m.Edges {
+		e.Map_.renameClassUsages(oldName, newName)
+	}
+}
+
+// renameClassValue sets s to newName if it's oldName, keeping its kind of quoting. The AST
+// s was compiled from isn't modified.
+func renameClassValue(s *Scalar, oldName, newName string) {
+	if s == nil {
+		return
+	}
+	str, ok := s.Value.(d2ast.String)
+	if !ok || !strings.EqualFold(str.ScalarString(), oldName) {
+		return
+	}
+	str = str.Copy()
+	str.SetString(newName)
+	s.Value = str
+}
+
+// AvailableClasses returns the class definitions usable from m: those of the board of m
+// followed by those of enclosing boards that aren't redefined closer to m. All kinds of
+// boards inherit the classes of their parent board, layers included.
+func (m *Map) AvailableClasses() []*Field {
+	var board Node = m
+	if NodeBoardKind(m) == "" {
+		board = ParentBoard(m)
+	}
+
+	var classes []*Field
+	seen := make(map[string]struct{})
+	var prev *Map
+	for ; board != nil; board = ParentBoard(board) {
+		bm := board.Map()
+		if bm == nil || bm == prev {
+			continue
+		}
+		prev = bm
+		cf := bm.GetField("classes")
+		if cf == nil || cf.Map() == nil {
+			continue
+		}
+		for _, f := range cf.Map().Fields {
+			name := strings.ToLower(f.Name)
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			classes = append(classes, f)
+		}
+	}
+	return classes
+}
+
+// FieldsWithClass returns the fields of m and its descendants in declaration order whose
+// class keyword is name or an array including it. Nested boards and the classes themselves
+// aren't searched.
+func (m *Map) FieldsWithClass(name string) []*Field {
+	var fa []*Field
+	m.fieldsWithClass(name, &fa)
+	return fa
+}
+
+func (m *Map) fieldsWithClass(name string, fa *[]*Field) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		if f.Name == "classes" || NodeBoardKind(f) != "" {
+			continue
+		}
+		if f.Map().hasClass(name) {
+			*fa = append(*fa, f)
+		}
+		f.Map().fieldsWithClass(name, fa)
+	}
+}
+
+// hasClass reports whether the class keyword of m is name or an array including it.
+func (m *Map) hasClass(name string) bool {
+	if m == nil {
+		return false
+	}
+	class := m.GetField("class")
+	if class == nil {
+		return false
+	}
+	if class.Primary_ != nil && strings.EqualFold(class.Primary_.Value.ScalarString(), name) {
+		return true
+	}
+	if arr, ok := class.Composite.(*Array); ok {
+		for _, v := range arr.Values {
+			if s, ok := v.(*Scalar); ok && strings.EqualFold(s.Value.ScalarString(), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bakeClasses applies the classes used by every field and edge in m and its descendants,
+// boards included. Classes are applied last to first so that later classes win.
+func (m *Map) bakeClasses() {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		if f.Name == "classes" {
+			continue
+		}
+		names := f.Map().classNames()
+		for i := len(names) - 1; i >= 0; i-- {
+			// Undefined classes are left in place.
+			_ = f.ApplyClass(names[i])
+		}
+		f.Map().bakeClasses()
+	}
+	for _, e := range m.Edges {
+		names := e.Map_.classNames()
+		for i := len(names) - 1; i >= 0; i-- {
+			classMap := m.GetClassMap(names[i])
+			if classMap == nil {
+				continue
+			}
+			inlineClassMap(e.Map_, classMap)
+			e.Map_.removeClass(names[i])
+		}
+	}
+}
+
+// classNames returns the names in the class keyword of m in order.
+func (m *Map) classNames() []string {
+	if m == nil {
+		return nil
+	}
+	class := m.GetField("class")
+	if class == nil {
+		return nil
+	}
+	if class.Primary_ != nil {
+		return []string{class.Primary_.Value.ScalarString()}
+	}
+	var names []string
+	if arr, ok := class.Composite.(*Array); ok {
+		for _, v := range arr.Values {
+			if s, ok := v.(*Scalar); ok {
+				names = append(names, s.Value.ScalarString())
+			}
+		}
+	}
+	return names
+}
+
+func inlineClassMap(dst, classMap *Map) {
+	for _, cf := range classMap.Fields {
+		if cf.Name == "class" {
+			continue
+		}
+		df := dst.GetField(cf.Name)
+		if df == nil {
+			dst.Fields = append(dst.Fields, cf.Copy(dst).(*Field))
+			continue
+		}
+		if df.Map() != nil && cf.Map() != nil {
+			inlineClassMap(df.Map(), cf.Map())
+		}
+	}
+}
+
+// removeClass removes name from the class keyword of m, deleting the keyword entirely once
+// no class remains.
+func (m *Map) removeClass(name string) {
+	class := m.GetField("class")
+	if class == nil {
+		return
+	}
+	if class.Primary_ != nil && strings.EqualFold(class.Primary_.Value.ScalarString(), name) {
+		m.DeleteField("class")
+		return
+	}
+	arr, ok := class.Composite.(*Array)
+	if !ok {
+		return
+	}
+	for i, v := range arr.Values {
+		if s, ok := v.(*Scalar); ok && strings.EqualFold(s.Value.ScalarString(), name) {
+			arr.Values = append(arr.Values[:i], arr.Values[i+1:]...)
+			break
+		}
+	}
+	if len(arr.Values) == 0 {
+		m.DeleteField("class")
+	}
+}
@@ -0,0 +1,248 @@
+package d2ir_test
+
+import (
+	"strings"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func TestApplyClass(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  big: {
+    label: BIG
+    style: {
+      fill: red
+      stroke: blue
+    }
+  }
+}
+x: {
+  class: big
+  style.fill: green
+}
+y.class: [big; other]
+`)
+	baked := mustCompile(t, `classes: {
+  big: {
+    label: BIG
+    style: {
+      fill: red
+      stroke: blue
+    }
+  }
+}
+x: {
+  style: {
+    fill: green
+    stroke: blue
+  }
+  label: BIG
+}
+y.class: [other]
+`)
+
+	x := m.GetField("x")
+	assert.Success(t, x.ApplyClass("big"))
+	assert.Equal(t, (*d2ir.Field)(nil), x.Map().GetField("class"))
+	assert.Equal(t, "green", x.Map().GetField("style", "fill").Primary().Value.ScalarString())
+	assert.Equal(t, "blue", x.Map().GetField("style", "stroke").Primary().Value.ScalarString())
+	assert.Equal(t, "BIG", x.Map().GetField("label").Primary().Value.ScalarString())
+
+	y := m.GetField("y")
+	assert.Success(t, y.ApplyClass("big"))
+	assert.Equal(t, 1, len(y.Map().GetField("class").Composite.(*d2ir.Array).Values))
+
+	assert.Equal(t, baked.GetField("x").String(), x.String())
+
+	err := x.ApplyClass("missing")
+	assert.ErrorString(t, err, `class "missing" not found`)
+}
+
+func TestBakeClasses(t *testing.T) {
+	t.Parallel()
+
+	classes := `classes: {
+  big: {
+    style: {
+      fill: red
+      stroke: blue
+    }
+  }
+  bold: {
+    style: {
+      bold: true
+      fill: orange
+    }
+  }
+}
+`
+	text := classes + `x: {
+  class: big
+  style.fill: green
+}
+y.class: [big; bold]
+a -> b: {class: big}
+q.class: missing
+layers: {
+  l: {
+    z.class: bold
+  }
+}
+`
+	m := mustCompileOpts(t, text, &d2ir.CompileOptions{BakeClasses: true})
+	baked := mustCompile(t, classes+`x: {
+  style: {
+    fill: green
+    stroke: blue
+  }
+}
+y: {
+  style: {
+    bold: true
+    fill: orange
+    stroke: blue
+  }
+}
+a
+b
+a -> b: {
+  style: {
+    fill: red
+    stroke: blue
+  }
+}
+q.class: missing
+layers: {
+  l: {
+    z: {
+      style: {
+        bold: true
+        fill: orange
+      }
+    }
+  }
+}
+`)
+	assert.Equal(t, true, m.Equal(baked))
+	assert.Equal(t, false, mustCompile(t, text).Equal(baked))
+}
+
+func TestFieldsWithClass(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  error: {
+    style.fill: red
+  }
+}
+a.class: error
+b: {
+  c.class: [warn; error]
+  d.class: warn
+}
+e
+a -> e: {class: error}
+layers: {
+  x: {
+    f.class: error
+  }
+}
+`)
+	var paths []string
+	for _, f := range m.FieldsWithClass("error") {
+		paths = append(paths, strings.Join(d2ir.BoardIDA(f), "."))
+	}
+	assert.JSON(t, []string{"a", "b.c"}, paths)
+	assert.Equal(t, 1, len(m.GetField("layers", "x").Map().FieldsWithClass("error")))
+	assert.Equal(t, 0, len(m.FieldsWithClass("missing")))
+}
+
+func TestAvailableClasses(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  error: {
+    style.fill: red
+  }
+  ok: {
+    style.fill: green
+  }
+}
+scenarios: {
+  s: {
+    classes: {
+      error.style.stroke: black
+      warn.style.fill: yellow
+    }
+    a: {
+      b.class: error
+    }
+  }
+}
+`)
+	names := func(fa []*d2ir.Field) (names []string) {
+		for _, f := range fa {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+	assert.JSON(t, []string{"error", "ok"}, names(m.AvailableClasses()))
+
+	s := m.GetField("scenarios", "s").Map()
+	a := s.GetField("a").Map()
+	assert.JSON(t, []string{"error", "ok", "warn"}, names(a.AvailableClasses()))
+	assert.True(t, a.AvailableClasses()[0] == s.GetField("classes", "error"))
+
+	s.DeleteField("classes", "ok")
+	classes := a.AvailableClasses()
+	assert.JSON(t, []string{"error", "warn", "ok"}, names(classes))
+	assert.True(t, classes[2] == m.GetField("classes", "ok"))
+}
+
+func TestRenameClass(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  error: {
+    style.fill: red
+  }
+  ok: {
+    style.fill: green
+  }
+}
+a.class: error
+b.class: [ok; "error"]
+a -> b: {class: error}
+scenarios: {
+  s: {
+    c.class: error
+  }
+}
+`)
+	assert.ErrorString(t, m.RenameClass("error", "ok"), `class "ok" already exists`)
+	assert.ErrorString(t, m.RenameClass("missing", "other"), `class "missing" not found`)
+
+	assert.Success(t, m.RenameClass("error", "failure"))
+	assert.String(t, mustCompile(t, `classes: {
+  failure: {
+    style.fill: red
+  }
+  ok: {
+    style.fill: green
+  }
+}
+a.class: failure
+b.class: [ok; "failure"]
+a -> b: {class: failure}
+scenarios: {
+  s: {
+    c.class: failure
+  }
+}
+`).String(), m.String())
+}
@@ -1,12 +1,14 @@
 package d2ir
 
 import (
+	"context"
 	"io/fs"
 	"strconv"
 	"strings"
 
 	"oss.terrastruct.com/d2/d2ast"
 	"oss.terrastruct.com/d2/d2format"
+	"oss.terrastruct.com/d2/d2graph"
 	"oss.terrastruct.com/d2/d2parser"
 	"oss.terrastruct.com/d2/d2themes"
 	"oss.terrastruct.com/d2/d2themes/d2themescatalog"
@@ -14,6 +16,7 @@ import (
 )
 
 type compiler struct {
+	ctx context.Context
 	err *d2parser.ParseError
 
 	fs fs.FS
@@ -22,33 +25,222 @@ type compiler struct {
 	// importCache enables reuse of files imported multiple times.
 	importCache map[string]*Map
 	utf16Pos    bool
+	comments    bool
+
+	interBoardEdges              bool
+	requireExistingEdgeEndpoints bool
+	disallowUnderscoreCreate     bool
+	bakeClasses                  bool
+	globTrace                    func(pattern, path string)
+
+	root      *Map
+	maxFields int
+	maxEdges  int
+	// fields and edges are the number of fields and edges created so far, copies included.
+	// See countField and countEdge.
+	fields        int
+	edges         int
+	limitExceeded bool
+
+	globEdgeThreshold int
+	strictGlobEdges   bool
+	warnf             func(d2ast.Error)
+
+	onProgress func(fieldsDone, edgesDone int)
+	// progressOps is the number of fields and edges compiled by keys so far, see progress.
+	progressOps int
 
 	globStack []bool
+
+	// reuse maps the AST of a board to a compiled board to copy instead. See Map.Recompile.
+	reuse map[*d2ast.Map]*Map
 }
 
 type CompileOptions struct {
 	UTF16Pos bool
 	// Pass nil to disable imports.
 	FS fs.FS
+	// CaptureComments records the comments directly above each key on its RefContext.
+	// See Field.LeadingComments.
+	CaptureComments bool
+	// AllowInterBoardEdges permits edges whose endpoints are boards or are in different
+	// boards, e.g. layers.x -> layers.y. Such an edge is recorded in the map nearest to both
+	// endpoints, here as x -> y in layers, with paths that cross board boundaries.
+	//
+	// Boards are laid out independently and d2compiler does not support these edges so
+	// they're meant for consumers of the IR that link boards together, e.g. for navigation.
+	// Map.Validate still reports them.
+	AllowInterBoardEdges bool
+	// RequireExistingEdgeEndpoints makes it an error for an edge to connect a field that
+	// wasn't declared before it rather than creating the field, so that a typo like
+	// a -> bb where b was meant fails to compile. Edge globs that match nothing still
+	// create no edges.
+	RequireExistingEdgeEndpoints bool
+	// DisallowUnderscoreCreate makes it an error for a key or edge end starting with _ to
+	// create a field rather than refer to an existing one, e.g. _.x where the parent scope
+	// has no x, so that keys only create fields within their own scope. Reserved keywords
+	// like _.x.style.fill may still be set.
+	DisallowUnderscoreCreate bool
+	// BakeClasses inlines the fields of every class a field or edge uses onto it once
+	// compiled, as Field.ApplyClass does, and removes its class keyword so that consumers
+	// don't need to resolve classes. Fields set explicitly take precedence over classes and
+	// later classes in a class array over earlier ones. Classes that aren't defined are left
+	// in the class keyword.
+	BakeClasses bool
+	// GlobTrace is called each time a glob selects a field or edge with the glob as written
+	// and the Path of the selected node. For a key like **.style.fill, the nodes are the
+	// style.fill fields set and for an edge glob, the edges created or matched.
+	GlobTrace func(pattern, path string)
+	// MaxFields and MaxEdges, if positive, limit the number of fields and edges created
+	// across all boards, including those copied by imports and into scenarios, steps and
+	// layers. Fields and edges removed later, e.g. by null, still count. Compiling stops with
+	// an error on the node that exceeded a limit as soon as it's created. They guard against
+	// sources that blow up, e.g. ** -> ** on many fields.
+	MaxFields int
+	MaxEdges  int
+	// GlobEdgeThreshold, if positive, is the most edges an edge glob like ** -> ** may
+	// create. It's checked before any are created against the number of fields matched by the
+	// source times those matched by the destination. Past it, a warning naming the glob and
+	// the projected count is passed to Warn or, with StrictGlobEdges, the key fails to compile.
+	GlobEdgeThreshold int
+	StrictGlobEdges   bool
+	// Warn receives warnings. They are positioned like errors but don't fail the compile.
+	Warn func(d2ast.Error)
+	// OnProgress, if set, is called with the number of fields and edges created so far as
+	// counted for MaxFields and MaxEdges. It's called every 1000 fields set and edges created
+	// by keys and once more when done with FieldCountRecursive and EdgeCountRecursive of the
+	// result.
+	OnProgress func(fieldsDone, edgesDone int)
 }
 
 func (c *compiler) errorf(n d2ast.Node, f string, v ...interface{}) {
 	c.err.Errors = append(c.err.Errors, d2parser.Errorf(n, f, v...).(d2ast.Error))
 }
 
+func (c *compiler) kindErrorf(kind error, n d2ast.Node, f string, v ...interface{}) {
+	c.err.Errors = append(c.err.Errors, kindErrorf(kind, n, f, v...).(d2ast.Error))
+}
+
+// warn passes err to CompileOptions.Warn if set.
+func (c *compiler) warn(err error) {
+	if c.warnf != nil {
+		c.warnf(err.(d2ast.Error))
+	}
+}
+
+// progressInterval is how many fields and edges are compiled between calls to
+// CompileOptions.OnProgress.
+const progressInterval = 1000
+
+// progress counts a field or edge compiled by a key and calls CompileOptions.OnProgress
+// every progressInterval of them.
+func (c *compiler) progress() {
+	if c.onProgress == nil {
+		return
+	}
+	c.progressOps++
+	if c.progressOps%progressInterval == 0 {
+		c.onProgress(c.fields, c.edges)
+	}
+}
+
+// stopped reports whether compiling was cancelled or exceeded a limit.
+func (c *compiler) stopped() bool {
+	return c.limitExceeded || c.ctx.Err() != nil
+}
+
+// countField counts a field about to be created by n and errors on n if it exceeds
+// CompileOptions.MaxFields.
+func (c *compiler) countField(n d2ast.Node) error {
+	c.fields++
+	if c.maxFields > 0 && c.fields > c.maxFields {
+		c.limitExceeded = true
+		return d2parser.Errorf(n, "field limit of %d exceeded", c.maxFields)
+	}
+	return nil
+}
+
+// countEdge is like countField for an edge and CompileOptions.MaxEdges.
+func (c *compiler) countEdge(n d2ast.Node) error {
+	c.edges++
+	if c.maxEdges > 0 && c.edges > c.maxEdges {
+		c.limitExceeded = true
+		return d2parser.Errorf(n, "edge limit of %d exceeded", c.maxEdges)
+	}
+	return nil
+}
+
+// countCopy counts the fields and edges within m, copied because of n, e.g. an import, and
+// reports an error on n if that exceeds a limit.
+func (c *compiler) countCopy(n d2ast.Node, m *Map) {
+	if c.limitExceeded {
+		return
+	}
+	c.fields += m.FieldCountRecursive()
+	c.edges += m.EdgeCountRecursive()
+	switch {
+	case c.maxFields > 0 && c.fields > c.maxFields:
+		c.errorf(n, "field limit of %d exceeded", c.maxFields)
+		c.limitExceeded = true
+	case c.maxEdges > 0 && c.edges > c.maxEdges:
+		c.errorf(n, "edge limit of %d exceeded", c.maxEdges)
+		c.limitExceeded = true
+	}
+}
+
+// Compile compiles ast into the IR without going through d2graph. Fields, edges, globs,
+// imports, vars, classes and boards are all resolved. The returned map is the root of the
+// tree. On failure every error encountered is returned together as a *d2parser.ParseError.
+//
+// opts may be nil to use the defaults.
 func Compile(ast *d2ast.Map, opts *CompileOptions) (*Map, error) {
+	return newCompiler(opts).compileRoot(ast)
+}
+
+// CompileContext is like Compile but stops early once ctx is done and returns ctx.Err().
+// ctx is checked before compiling each key, each field a glob key selects, each map a **
+// glob walks and each edge an edge glob creates so even a single expensive key like
+// ** -> ** is interrupted.
+func CompileContext(ctx context.Context, ast *d2ast.Map, opts *CompileOptions) (*Map, error) {
+	c := newCompiler(opts)
+	c.ctx = ctx
+	return c.compileRoot(ast)
+}
+
+func newCompiler(opts *CompileOptions) *compiler {
 	if opts == nil {
 		opts = &CompileOptions{}
 	}
-	c := &compiler{
+	return &compiler{
+		ctx: context.Background(),
 		err: &d2parser.ParseError{},
 		fs:  opts.FS,
 
 		importCache: make(map[string]*Map),
 		utf16Pos:    opts.UTF16Pos,
+		comments:    opts.CaptureComments,
+
+		interBoardEdges:              opts.AllowInterBoardEdges,
+		requireExistingEdgeEndpoints: opts.RequireExistingEdgeEndpoints,
+		disallowUnderscoreCreate:     opts.DisallowUnderscoreCreate,
+		bakeClasses:                  opts.BakeClasses,
+		globTrace:                    opts.GlobTrace,
+
+		maxFields: opts.MaxFields,
+		maxEdges:  opts.MaxEdges,
+
+		globEdgeThreshold: opts.GlobEdgeThreshold,
+		strictGlobEdges:   opts.StrictGlobEdges,
+		warnf:             opts.Warn,
+
+		onProgress: opts.OnProgress,
 	}
+}
+
+func (c *compiler) compileRoot(ast *d2ast.Map) (*Map, error) {
 	m := &Map{}
 	m.initRoot()
+	c.root = m
 	m.parent.(*Field).References[0].Context.Scope = ast
 	m.parent.(*Field).References[0].Context.ScopeAST = ast
 
@@ -57,12 +249,23 @@ func Compile(ast *d2ast.Map, opts *CompileOptions) (*Map, error) {
 	})
 	defer c.popImportStack()
 
+	m.compiledWith = c.boardOptions()
+
 	c.compileMap(m, ast, ast)
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
 	c.compileSubstitutions(m, nil)
 	c.overlayClasses(m)
+	if c.bakeClasses {
+		m.bakeClasses()
+	}
 	if !c.err.Empty() {
 		return nil, c.err
 	}
+	if c.onProgress != nil {
+		c.onProgress(m.FieldCountRecursive(), m.EdgeCountRecursive())
+	}
 	return m, nil
 }
 
@@ -88,6 +291,7 @@ func (c *compiler) overlayClasses(m *Map) {
 		}
 		l := lf.Map()
 		lClasses := l.GetField("classes")
+		c.countCopy(lf.References[0].Context.Key, classes.Map())
 
 		if lClasses == nil {
 			lClasses = classes.Copy(l).(*Field)
@@ -137,6 +341,53 @@ func (c *compiler) compileSubstitutions(m *Map, varsStack []*Map) {
 	}
 }
 
+// InlineVars replaces the substitutions of variables in the values of m and the maps within
+// it with the values of the variables, resolved as Compile does. Compile already inlines the
+// variables of what it compiles so this is for values set afterwards.
+//
+// Variables that can't be resolved are errors at the position of the value referencing
+// them. See DeleteVars to then remove the variables.
+func (m *Map) InlineVars() error {
+	var varsStack []*Map
+	for pm := ParentMap(m); pm != nil; pm = ParentMap(pm) {
+		if vars := pm.GetField("vars"); vars != nil && vars.Map() != nil {
+			varsStack = append(varsStack, vars.Map())
+		}
+	}
+
+	c := newCompiler(nil)
+	c.compileSubstitutions(m, varsStack)
+	if !c.err.Empty() {
+		return c.err
+	}
+	return nil
+}
+
+// DeleteVars deletes the variables of m and the maps within it. d2-config is kept as it
+// configures the diagram rather than being substituted.
+func (m *Map) DeleteVars() {
+	if m == nil {
+		return
+	}
+	fields := m.Fields[:0]
+	for _, f := range m.Fields {
+		if f.Name == "vars" && f.Map() != nil {
+			config := f.Map().GetField("d2-config")
+			if config == nil {
+				continue
+			}
+			f.Map().Fields = []*Field{config}
+		} else {
+			f.Map().DeleteVars()
+		}
+		fields = append(fields, f)
+	}
+	m.Fields = fields
+	for _, e := range m.Edges {
+		e.Map_.DeleteVars()
+	}
+}
+
 func (c *compiler) validateConfigs(configs *Field) {
 	if configs == nil || configs.Map() == nil {
 		return
@@ -237,6 +488,7 @@ func (c *compiler) resolveSubstitutions(varsStack []*Map, node Node) {
 						}
 					case *Field:
 						if resolvedField.Map() != nil {
+							c.countCopy(box.Substitution, resolvedField.Map())
 							OverlayMap(ParentMap(n), resolvedField.Map())
 						}
 						// Remove the placeholder field
@@ -341,6 +593,7 @@ func (c *compiler) overlay(base *Map, f *Field) {
 		return
 	}
 	base = base.CopyBase(f)
+	c.countCopy(f.References[0].Context.Key, base)
 	OverlayMap(base, f.Map())
 	f.Composite = base
 }
@@ -360,15 +613,30 @@ func (c *compiler) compileMap(dst *Map, ast, scopeAST *d2ast.Map) {
 			}
 		}
 	}
+	var comments []d2ast.Node
+	// Comments on the line the previous node ends on trail that node.
+	prevEndLine := -1
 	for _, n := range ast.Nodes {
 		switch {
+		case n.Comment != nil || n.BlockComment != nil:
+			if c.comments && n.Unbox().GetRange().Start.Line != prevEndLine {
+				comments = appendComment(comments, n.Unbox())
+			}
+			continue
 		case n.MapKey != nil:
-			c.compileKey(&RefContext{
+			if c.stopped() {
+				return
+			}
+			refctx := &RefContext{
 				Key:      n.MapKey,
 				Scope:    ast,
 				ScopeMap: dst,
 				ScopeAST: scopeAST,
-			})
+			}
+			if len(comments) > 0 && comments[len(comments)-1].GetRange().End.Line+1 == n.MapKey.Range.Start.Line {
+				refctx.Comments = comments
+			}
+			c.compileKey(refctx)
 		case n.Substitution != nil:
 			// placeholder field to be resolved at the end
 			f := &Field{
@@ -389,6 +657,7 @@ func (c *compiler) compileMap(dst *Map, ast, scopeAST *d2ast.Map) {
 				c.errorf(n.Import, "cannot spread import non map into map")
 				continue
 			}
+			c.countCopy(n.Import, impn.Map())
 			OverlayMap(dst, impn.Map())
 
 			if impnf, ok := impn.(*Field); ok {
@@ -400,7 +669,18 @@ func (c *compiler) compileMap(dst *Map, ast, scopeAST *d2ast.Map) {
 				}
 			}
 		}
+		comments = nil
+		prevEndLine = n.Unbox().GetRange().End.Line
+	}
+}
+
+// appendComment appends comment to comments unless a blank line separates them in which
+// case comment starts a new run.
+func appendComment(comments []d2ast.Node, comment d2ast.Node) []d2ast.Node {
+	if len(comments) > 0 && comments[len(comments)-1].GetRange().End.Line+1 != comment.GetRange().Start.Line {
+		comments = nil
 	}
+	return append(comments, comment)
 }
 
 func (c *compiler) compileKey(refctx *RefContext) {
@@ -416,17 +696,65 @@ func (c *compiler) compileField(dst *Map, kp *d2ast.KeyPath, refctx *RefContext)
 		return
 	}
 
-	fa, err := dst.EnsureField(kp, refctx, true)
+	if !c.checkUnderscoreCreate(dst, kp, refctx) {
+		return
+	}
+	fa, err := dst.ensureFieldPath(kp, refctx, true, c)
 	if err != nil {
 		c.err.Errors = append(c.err.Errors, err.(d2ast.Error))
 		return
 	}
+	if c.globTrace != nil && kp.HasGlob() {
+		for _, f := range fa {
+			c.globTrace(d2format.Format(kp), Path(f))
+		}
+	}
 
 	for _, f := range fa {
+		if c.stopped() {
+			return
+		}
 		c._compileField(f, refctx)
+		c.progress()
 	}
 }
 
+// checkUnderscoreCreate reports whether kp may be ensured from m under
+// DisallowUnderscoreCreate and errors on its leading underscore if not. Invalid underscores
+// are left to EnsureField to report.
+func (c *compiler) checkUnderscoreCreate(m *Map, kp *d2ast.KeyPath, refctx *RefContext) bool {
+	if !c.disallowUnderscoreCreate || len(kp.Path) == 0 || kp.Path[0].Unbox().ScalarString() != "_" || kp.HasGlob() {
+		return true
+	}
+	if refctx.Key != nil && refctx.Key.Value.Null != nil {
+		return true
+	}
+	ida := kp.IDA()
+	_, target, err := m.ResolveUnderscores(ida)
+	if err != nil {
+		return true
+	}
+	i := 0
+	for ida[i] == "_" {
+		i++
+	}
+	for _, name := range ida[i:] {
+		if _, ok := d2graph.ReservedKeywords[strings.ToLower(name)]; ok {
+			break
+		}
+		var f *Field
+		if target != nil {
+			f = target.GetField(name)
+		}
+		if f == nil {
+			c.errorf(kp.Path[0].Unbox(), `cannot create %s through "_"`, d2format.Format(kp))
+			return false
+		}
+		target = f.Map()
+	}
+	return true
+}
+
 func (c *compiler) ampersandFilter(refctx *RefContext) bool {
 	if !refctx.Key.Ampersand {
 		return true
@@ -506,6 +834,11 @@ func (c *compiler) _compileField(f *Field, refctx *RefContext) {
 		c.compileArray(a, refctx.Key.Value.Array, refctx.ScopeAST)
 		f.Composite = a
 	} else if refctx.Key.Value.Map != nil {
+		if board, ok := c.reuse[refctx.Key.Value.Map]; ok {
+			f.Composite = board.Copy(f).(*Map)
+			c.countCopy(refctx.Key, f.Map())
+			return
+		}
 		if f.Map() == nil {
 			f.Composite = &Map{
 				parent: f,
@@ -513,20 +846,8 @@ func (c *compiler) _compileField(f *Field, refctx *RefContext) {
 		}
 		scopeAST := refctx.Key.Value.Map
 		switch NodeBoardKind(f) {
-		case BoardScenario:
-			c.overlay(ParentBoard(f).Map(), f)
-		case BoardStep:
-			stepsMap := ParentMap(f)
-			for i := range stepsMap.Fields {
-				if stepsMap.Fields[i] == f {
-					if i == 0 {
-						c.overlay(ParentBoard(f).Map(), f)
-					} else {
-						c.overlay(stepsMap.Fields[i-1].Map(), f)
-					}
-					break
-				}
-			}
+		case BoardScenario, BoardStep:
+			c.overlay(boardBase(f), f)
 		case BoardLayer:
 		default:
 			// If new board type, use that as the new scope AST, otherwise, carry on
@@ -551,27 +872,17 @@ func (c *compiler) _compileField(f *Field, refctx *RefContext) {
 			}
 			if n.Composite != nil {
 				f.Composite = n.Composite.Copy(f).(Composite)
+				c.countCopy(refctx.Key.Value.Import, f.Map())
 			}
 		case *Map:
 			f.Composite = &Map{
 				parent: f,
 			}
 			switch NodeBoardKind(f) {
-			case BoardScenario:
-				c.overlay(ParentBoard(f).Map(), f)
-			case BoardStep:
-				stepsMap := ParentMap(f)
-				for i := range stepsMap.Fields {
-					if stepsMap.Fields[i] == f {
-						if i == 0 {
-							c.overlay(ParentBoard(f).Map(), f)
-						} else {
-							c.overlay(stepsMap.Fields[i-1].Map(), f)
-						}
-						break
-					}
-				}
+			case BoardScenario, BoardStep:
+				c.overlay(boardBase(f), f)
 			}
+			c.countCopy(refctx.Key.Value.Import, n)
 			OverlayMap(f.Map(), n)
 			c.updateLinks(f.Map())
 			switch NodeBoardKind(f) {
@@ -669,7 +980,7 @@ func (c *compiler) compileLink(refctx *RefContext) {
 		if len(scopeIDA) < 2 {
 			// IR compiler only validates bad underscore usage
 			// The compiler will validate if the target board actually exists
-			c.errorf(refctx.Key.Key, "invalid underscore usage")
+			c.kindErrorf(ErrInvalidUnderscore, refctx.Key.Key, "invalid underscore usage")
 			return
 		}
 		// pop 2 off path per one underscore
@@ -692,14 +1003,22 @@ func (c *compiler) compileEdges(refctx *RefContext) {
 		return
 	}
 
-	fa, err := refctx.ScopeMap.EnsureField(refctx.Key.Key, refctx, true)
+	if !c.checkUnderscoreCreate(refctx.ScopeMap, refctx.Key.Key, refctx) {
+		return
+	}
+	fa, err := refctx.ScopeMap.ensureFieldPath(refctx.Key.Key, refctx, true, c)
 	if err != nil {
 		c.err.Errors = append(c.err.Errors, err.(d2ast.Error))
 		return
 	}
+	if c.globTrace != nil && refctx.Key.Key.HasGlob() {
+		for _, f := range fa {
+			c.globTrace(d2format.Format(refctx.Key.Key), Path(f))
+		}
+	}
 	for _, f := range fa {
 		if _, ok := f.Composite.(*Array); ok {
-			c.errorf(refctx.Key.Key, "cannot index into array")
+			c.kindErrorf(ErrIndexIntoArray, refctx.Key.Key, "cannot index into array")
 			return
 		}
 		if f.Map() == nil {
@@ -727,7 +1046,7 @@ func (c *compiler) _compileEdges(refctx *RefContext) {
 		var ea []*Edge
 		if eid.Index != nil || eid.Glob {
 			ea = refctx.ScopeMap.GetEdges(eid, refctx)
-			if len(ea) == 0 {
+			if len(ea) == 0 || !coversIndexRange(eid, ea) {
 				c.errorf(refctx.Edge, "indexed edge does not exist")
 				continue
 			}
@@ -739,13 +1058,25 @@ func (c *compiler) _compileEdges(refctx *RefContext) {
 				refctx.ScopeMap.appendFieldReferences(0, refctx.Edge.Dst, refctx)
 			}
 		} else {
-			var err error
-			ea, err = refctx.ScopeMap.CreateEdge(eid, refctx)
+			if !c.checkUnderscoreCreate(refctx.ScopeMap, refctx.Edge.Src, refctx) ||
+				!c.checkUnderscoreCreate(refctx.ScopeMap, refctx.Edge.Dst, refctx) {
+				continue
+			}
+			err := refctx.ScopeMap.createEdge(eid, refctx, c, &ea)
 			if err != nil {
 				c.err.Errors = append(c.err.Errors, err.(d2ast.Error))
 				continue
 			}
 		}
+		if c.globTrace != nil && (eid.Glob || refctx.Edge.Src.HasGlob() || refctx.Edge.Dst.HasGlob()) {
+			pattern := d2format.Format(&d2ast.Key{
+				Edges:     []*d2ast.Edge{refctx.Edge},
+				EdgeIndex: refctx.Key.EdgeIndex,
+			})
+			for _, e := range ea {
+				c.globTrace(pattern, Path(e))
+			}
+		}
 
 		for _, e := range ea {
 			if refctx.Key.EdgeKey != nil {
@@ -785,6 +1116,27 @@ func (c *compiler) _compileEdges(refctx *RefContext) {
 	}
 }
 
+// coversIndexRange reports whether every index in eid's index range is matched by an edge
+// in ea. It's always true when eid has no range.
+func coversIndexRange(eid *EdgeID, ea []*Edge) bool {
+	if eid.IndexEnd == nil {
+		return true
+	}
+	for i := *eid.Index; i <= *eid.IndexEnd; i++ {
+		found := false
+		for _, e := range ea {
+			if e.ID.Index != nil && *e.ID.Index == i {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *compiler) compileArray(dst *Array, a *d2ast.Array, scopeAST *d2ast.Map) {
 	for _, an := range a.Nodes {
 		var irv Value
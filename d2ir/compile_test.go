@@ -1,6 +1,7 @@
 package d2ir_test
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"path/filepath"
@@ -681,3 +682,91 @@ layers: {
 	}
 	runa(t, tca)
 }
+
+func TestErrorKinds(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		text string
+		kind error
+		err  string
+	}{
+		{
+			name: "underscore",
+			text: `_.x`,
+			kind: d2ir.ErrInvalidUnderscore,
+			err:  `TestErrorKinds/underscore.d2:1:1: invalid underscore: no parent`,
+		},
+		{
+			name: "edge-underscore",
+			text: `_.x -> y`,
+			kind: d2ir.ErrInvalidUnderscore,
+			err:  `TestErrorKinds/edge-underscore.d2:1:1: invalid underscore`,
+		},
+		{
+			name: "array",
+			text: `x: [1]
+x.y
+`,
+			kind: d2ir.ErrIndexIntoArray,
+			err:  `TestErrorKinds/array.d2:2:1: cannot index into array`,
+		},
+		{
+			name: "reserved",
+			text: `x.style -> y`,
+			kind: d2ir.ErrReservedInEdge,
+			err:  `TestErrorKinds/reserved.d2:1:3: reserved keywords are prohibited in edges`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := compile(t, tc.text)
+			assert.ErrorString(t, err, tc.err)
+			assert.True(t, errors.Is(err, tc.kind))
+
+			var nerr *d2ir.NodeError
+			assert.True(t, errors.As(err, &nerr))
+			assert.True(t, nerr.Node != nil)
+		})
+	}
+}
+
+func TestInlineVars(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `vars: {
+  v: hello
+  w: world
+}
+a: placeholder
+b.label: placeholder
+x: {
+  c: placeholder
+}
+`)
+	setValue := func(f *d2ir.Field, value string) {
+		k, err := d2parser.ParseMapKey("_: " + value)
+		assert.Success(t, err)
+		f.Primary().Value = k.Value.ScalarBox().Unbox()
+	}
+	setValue(m.GetField("a"), "${v}")
+	setValue(m.GetField("b", "label"), `"say ${v} ${w}"`)
+	setValue(m.GetField("x", "c"), "${w}")
+
+	assert.Success(t, m.InlineVars())
+	assert.Equal(t, "hello", m.GetField("a").Primary().Value.ScalarString())
+	assert.Equal(t, "say hello world", m.GetField("b", "label").Primary().Value.ScalarString())
+	assert.Equal(t, "world", m.GetField("x", "c").Primary().Value.ScalarString())
+
+	setValue(m.GetField("x", "c"), "${nope}")
+	assert.ErrorString(t, m.GetField("x").Map().InlineVars(), `TestInlineVars.d2:8:3: could not resolve variable "nope"`)
+
+	m.DeleteVars()
+	assert.Equal(t, (*d2ir.Field)(nil), m.GetField("vars"))
+	assert.Equal(t, "hello", m.GetField("a").Primary().Value.ScalarString())
+}
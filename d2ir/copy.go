@@ -0,0 +1,271 @@
+package d2ir
+
+import (
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// Subset returns a new root map with copies of the fields in m for which keep returns true,
+// along with everything beneath them. The ancestors of kept fields are copied without their
+// other children to keep paths valid. Edges are kept when both their endpoints are and are
+// reindexed.
+func (m *Map) Subset(keep func(*Field) bool) *Map {
+	m2 := &Map{}
+	m2.initRoot()
+	m.subset(m2, keep)
+	return m2
+}
+
+func (m *Map) subset(dst *Map, keep func(*Field) bool) {
+	for _, f := range m.Fields {
+		if keep(f) {
+			dst.Fields = append(dst.Fields, f.Copy(dst).(*Field))
+			continue
+		}
+		if f.Map() == nil {
+			continue
+		}
+
+		f2 := &Field{
+			parent:     dst,
+			Name:       f.Name,
+			References: append([]*FieldReference(nil), f.References...),
+		}
+		if f.Primary_ != nil {
+			f2.Primary_ = f.Primary_.Copy(f2).(*Scalar)
+		}
+		m2 := &Map{
+			parent: f2,
+		}
+		f.Map().subset(m2, keep)
+		if len(m2.Fields) == 0 {
+			continue
+		}
+		f2.Composite = m2
+		dst.Fields = append(dst.Fields, f2)
+	}
+
+	for _, e := range m.Edges {
+		if dst.GetField(e.ID.SrcPath...) == nil || dst.GetField(e.ID.DstPath...) == nil {
+			continue
+		}
+		dst.Edges = append(dst.Edges, e.Copy(dst).(*Edge))
+	}
+	dst.reindexEdges()
+}
+
+// TruncatedPrimary is the primary value CopyDepth gives fields whose content was cut off.
+const TruncatedPrimary = "..."
+
+// CopyDepth is like Copy but only copies maxDepth levels of fields, the fields of m being
+// the first level. The fields at the last level that held fields or edges are given an
+// empty map and TruncatedPrimary as their primary in place of their own. Edges within
+// truncated fields are dropped while the endpoints of kept edges that lead past the last
+// level are truncated to it, e.g. a.b.c -> d becomes a.b -> d for a maxDepth of 2, and the
+// edges are reindexed.
+func (m *Map) CopyDepth(newParent Node, maxDepth int) *Map {
+	m2 := &Map{
+		parent: newParent,
+	}
+	m.copyDepth(m2, maxDepth)
+	if m2.parent == nil {
+		m2.initRoot()
+	}
+	return m2
+}
+
+// copyDepth copies depth levels of fields of m into dst.
+func (m *Map) copyDepth(dst *Map, depth int) {
+	if depth < 1 {
+		return
+	}
+	for _, f := range m.Fields {
+		f2 := &Field{
+			parent:     dst,
+			Name:       f.Name,
+			References: append([]*FieldReference(nil), f.References...),
+		}
+		if f.Primary_ != nil {
+			f2.Primary_ = f.Primary_.Copy(f2).(*Scalar)
+		}
+		switch c := f.Composite.(type) {
+		case *Map:
+			m2 := &Map{
+				parent: f2,
+			}
+			if depth > 1 {
+				c.copyDepth(m2, depth-1)
+			} else if len(c.Fields) > 0 || len(c.Edges) > 0 {
+				f2.Primary_ = &Scalar{
+					parent: f2,
+					Value:  d2ast.FlatUnquotedString(TruncatedPrimary),
+				}
+			}
+			f2.Composite = m2
+		case nil:
+		default:
+			f2.Composite = c.Copy(f2).(Composite)
+		}
+		dst.Fields = append(dst.Fields, f2)
+	}
+
+	for _, e := range m.Edges {
+		e2 := e.Copy(dst).(*Edge)
+		if len(e.ID.SrcPath) > depth || len(e.ID.DstPath) > depth {
+			e2.ID = e.ID.Copy()
+			if len(e2.ID.SrcPath) > depth {
+				e2.ID.SrcPath = e2.ID.SrcPath[:depth]
+			}
+			if len(e2.ID.DstPath) > depth {
+				e2.ID.DstPath = e2.ID.DstPath[:depth]
+			}
+		}
+		dst.Edges = append(dst.Edges, e2)
+	}
+	dst.reindexEdges()
+}
+
+// Flatten returns a new root map with the nested fields of m moved to the root. Each field is
+// named by its path formatted as a key, e.g. a.b.c, which keeps names unique even when they
+// contain dots as a field named "a.b" is named "a.b" with the quotes. Reserved keywords like
+// style stay in the map of their flattened field and edges are rewritten to connect the
+// flattened fields. Boards stay boards with their own content flattened.
+func (m *Map) Flatten() *Map {
+	m2 := &Map{}
+	m2.initRoot()
+	m.flatten(m2, nil)
+	return m2
+}
+
+// flatten adds the fields and edges of m to the board dst. ida is the path of m within its
+// board.
+func (m *Map) flatten(dst *Map, ida []string) {
+	for _, e := range m.Edges {
+		e2 := e.Copy(dst).(*Edge)
+		e2.ID = e.ID.Copy()
+		e2.ID.SrcPath = []string{flatName(append(ida[:len(ida):len(ida)], e.ID.SrcPath...))}
+		e2.ID.DstPath = []string{flatName(append(ida[:len(ida):len(ida)], e.ID.DstPath...))}
+		dst.appendEdge(e2)
+	}
+
+	for _, f := range m.Fields {
+		if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+			if len(ida) > 0 {
+				// Copied into the map of the flattened parent.
+				continue
+			}
+			if _, ok := d2graph.BoardKeywords[f.Name]; ok && f.Map() != nil {
+				dst.Fields = append(dst.Fields, f.flattenBoards(dst))
+			} else {
+				dst.Fields = append(dst.Fields, f.Copy(dst).(*Field))
+			}
+			continue
+		}
+
+		fida := append(ida[:len(ida):len(ida)], f.Name)
+		f2 := &Field{
+			parent:     dst,
+			Name:       flatName(fida),
+			References: append([]*FieldReference(nil), f.References...),
+		}
+		if f.Primary_ != nil {
+			f2.Primary_ = f.Primary_.Copy(f2).(*Scalar)
+		}
+		if f.Map() != nil {
+			m2 := &Map{
+				parent: f2,
+			}
+			for _, kf := range f.Map().Fields {
+				if _, ok := d2graph.ReservedKeywords[kf.Name]; ok {
+					m2.Fields = append(m2.Fields, kf.Copy(m2).(*Field))
+				}
+			}
+			if len(m2.Fields) > 0 {
+				f2.Composite = m2
+			}
+		} else if f.Composite != nil {
+			f2.Composite = f.Composite.Copy(f2).(Composite)
+		}
+		dst.Fields = append(dst.Fields, f2)
+
+		if f.Map() != nil {
+			f.Map().flatten(dst, fida)
+		}
+	}
+}
+
+// flattenBoards returns a copy of the board keyword holder f with each of its boards
+// flattened.
+func (f *Field) flattenBoards(newParent *Map) *Field {
+	f2 := &Field{
+		parent:     newParent,
+		Name:       f.Name,
+		References: append([]*FieldReference(nil), f.References...),
+	}
+	boards := &Map{
+		parent: f2,
+	}
+	f2.Composite = boards
+	for _, bf := range f.Map().Fields {
+		if bf.Map() == nil {
+			boards.Fields = append(boards.Fields, bf.Copy(boards).(*Field))
+			continue
+		}
+		bf2 := &Field{
+			parent:     boards,
+			Name:       bf.Name,
+			References: append([]*FieldReference(nil), bf.References...),
+		}
+		bm := &Map{
+			parent: bf2,
+		}
+		bf2.Composite = bm
+		bf.Map().flatten(bm, nil)
+		boards.Fields = append(boards.Fields, bf2)
+	}
+	return f2
+}
+
+func flatName(ida []string) string {
+	return d2format.Format(d2ast.MakeKeyPath(ida))
+}
+
+// MaterializeScenario returns a new root map with the full content of the scenario or step
+// at path: the content of the board it inherits from with the board's own fields and edges
+// overlaid. Steps include every step before them. Boards nested within the scenario or step
+// are not included.
+func (m *Map) MaterializeScenario(path []string) (*Map, error) {
+	f := m.GetField(path...)
+	if f == nil {
+		return nil, fmt.Errorf("field %q not found", strings.Join(path, "."))
+	}
+	switch NodeBoardKind(f) {
+	case BoardScenario, BoardStep:
+	default:
+		return nil, fmt.Errorf("%q is not a scenario or step", strings.Join(path, "."))
+	}
+	if f.Map() == nil {
+		return nil, fmt.Errorf("%q is not a map", strings.Join(path, "."))
+	}
+
+	m2 := materializeBoard(f)
+	m2.initRoot()
+	return m2, nil
+}
+
+func materializeBoard(f *Field) *Map {
+	base := boardBase(f)
+	var m2 *Map
+	switch bf := ParentField(base); NodeBoardKind(bf) {
+	case BoardScenario, BoardStep:
+		m2 = materializeBoard(bf)
+	default:
+		m2 = base.CopyBase(nil)
+	}
+	OverlayMap(m2, f.Map().CopyBase(nil))
+	return m2
+}
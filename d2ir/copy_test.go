@@ -0,0 +1,224 @@
+package d2ir_test
+
+import (
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func TestSubset(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `services: {
+  api -> db
+  api -> cache
+  cache: {
+    style.fill: red
+  }
+}
+infra: {
+  lb
+  services
+}
+x -> y
+x -> y: kept
+y: label {
+  z
+}
+infra.services -> services.api
+`)
+	m2 := m.Subset(func(f *d2ir.Field) bool {
+		switch d2ir.BoardIDA(f)[0] {
+		case "services":
+			return true
+		case "infra":
+			return f.Name == "services"
+		case "y":
+			return f.Name == "z"
+		}
+		return f.Name == "x"
+	})
+	assert.String(t, `services: {
+  api
+  db
+  cache: {
+    style: {
+      fill: red
+    }
+  }
+  api -> db
+  api -> cache
+}
+infra: {
+  services
+}
+x
+y: label {
+  z
+}
+x -> y
+x -> y
+(x -> y)[1]: kept
+infra.services -> services.api
+`, m2.String())
+	assert.True(t, m2.Root())
+}
+
+func TestMaterializeScenario(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+scenarios: {
+  s: {
+    a.style.fill: red
+    c
+    scenarios: {
+      nested: {
+        d
+      }
+    }
+  }
+}
+steps: {
+  1: {
+    x
+  }
+  2: {
+    y
+    a -> b
+  }
+}
+layers: {
+  l: {
+    z
+  }
+}
+e
+`)
+	s, err := m.MaterializeScenario([]string{"scenarios", "s"})
+	assert.Success(t, err)
+	assert.True(t, s.Root())
+	assert.String(t, `a.style.fill: red
+b
+e
+c
+a -> b
+`, s.FormatCompact())
+
+	nested, err := m.MaterializeScenario([]string{"scenarios", "s", "scenarios", "nested"})
+	assert.Success(t, err)
+	assert.String(t, `a.style.fill: red
+b
+e
+c
+d
+a -> b
+`, nested.FormatCompact())
+
+	step, err := m.MaterializeScenario([]string{"steps", "2"})
+	assert.Success(t, err)
+	assert.String(t, `a
+b
+e
+x
+y
+a -> b
+a -> b
+`, step.FormatCompact())
+	assert.Equal(t, 2, len(step.Edges))
+
+	_, err = m.MaterializeScenario([]string{"layers", "l"})
+	assert.ErrorString(t, err, `"layers.l" is not a scenario or step`)
+	_, err = m.MaterializeScenario([]string{"scenarios", "nope"})
+	assert.ErrorString(t, err, `field "scenarios.nope" not found`)
+}
+
+func TestFlatten(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b: {
+    c: hi
+  }
+  d
+  b.c -> d
+  style.fill: red
+}
+"a.b"
+x -> a.b.c
+layers: {
+  l: {
+    p.q -> r
+  }
+}
+`)
+	flat := m.Flatten()
+	assert.String(t, `a: {
+  style: {
+    fill: red
+  }
+}
+"a.b"
+"a.b.c": hi
+"a.d"
+'"a.b"'
+x
+x -> "a.b.c"
+"a.b.c" -> "a.d"
+layers: {
+  l: {
+    p
+    "p.q"
+    r
+    "p.q" -> r
+  }
+}
+`, flat.String())
+	assert.String(t, "hi", flat.GetField("a.b.c").Primary().String())
+	assert.JSON(t, []string{"a.b.c"}, flat.Edges[1].ID.SrcPath)
+	assert.True(t, mustCompile(t, flat.String()).Equal(flat))
+	assert.Equal(t, 3, len(m.GetField("a").Map().Fields))
+}
+
+func TestCopyDepth(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: A {
+  b: {
+    c: {
+      d
+      d -> e
+    }
+  }
+  x
+  b.c -> x
+}
+a.b.c.d -> y
+a.b.c.e -> y
+f: [1; 2]
+`)
+	m2 := m.CopyDepth(nil, 2)
+	assert.String(t, `a: A {
+  b: ...
+  x
+  b -> x
+}
+y
+f: [1; 2]
+a.b -> y
+a.b -> y
+`, m2.String())
+	assert.Equal(t, 1, *m2.Edges[1].ID.Index)
+	assert.True(t, m2.GetField("a", "b").Map() != nil)
+	assert.Equal(t, d2ir.TruncatedPrimary, m2.GetField("a", "b").Primary().Value.ScalarString())
+	assert.True(t, m2.Root())
+
+	// The original is untouched.
+	assert.True(t, m.GetField("a", "b", "c", "d") != nil)
+	assert.Equal(t, 4, len(m.Edges[0].ID.SrcPath))
+	assert.Equal(t, 0, *m.Edges[1].ID.Index)
+
+	assert.True(t, m.CopyDepth(nil, 4).Equal(m))
+}
@@ -3,9 +3,10 @@
 package d2ir
 
 import (
-	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"oss.terrastruct.com/util-go/go2"
 
@@ -101,10 +102,10 @@ func (n *Array) composite() {}
 func (n *Map) composite()   {}
 
 func (n *Scalar) String() string { return d2format.Format(n.AST()) }
-func (n *Field) String() string  { return d2format.Format(n.AST()) }
+func (n *Field) String() string  { return d2format.Format(n.ast(astOpts{indexEdges: true})) }
 func (n *Edge) String() string   { return d2format.Format(n.AST()) }
 func (n *Array) String() string  { return d2format.Format(n.AST()) }
-func (n *Map) String() string    { return d2format.Format(n.AST()) }
+func (n *Map) String() string    { return d2format.Format(n.ast(astOpts{indexEdges: true})) }
 
 func (n *Scalar) LastRef() Reference { return parentRef(n) }
 func (n *Map) LastRef() Reference    { return parentRef(n) }
@@ -150,10 +151,52 @@ func (s *Scalar) Equal(n2 Node) bool {
 	return s.Value.Type() == s2.Value.Type() && s.Value.ScalarString() == s2.Value.ScalarString()
 }
 
+// Int returns the value of s if it's a number that is an integer within range of int64.
+func (s *Scalar) Int() (int64, bool) {
+	n, ok := s.Value.(*d2ast.Number)
+	if !ok || !n.Value.IsInt() || !n.Value.Num().IsInt64() {
+		return 0, false
+	}
+	return n.Value.Num().Int64(), true
+}
+
+// Float returns the value of s if it's a number. The result is the nearest float64 to
+// the exact value.
+func (s *Scalar) Float() (float64, bool) {
+	n, ok := s.Value.(*d2ast.Number)
+	if !ok {
+		return 0, false
+	}
+	f, _ := n.Value.Float64()
+	return f, true
+}
+
+// Bool returns the value of s if it's a boolean.
+func (s *Scalar) Bool() (bool, bool) {
+	b, ok := s.Value.(*d2ast.Boolean)
+	if !ok {
+		return false, false
+	}
+	return b.Value, true
+}
+
+// IsNull reports whether s is null.
+func (s *Scalar) IsNull() bool {
+	_, ok := s.Value.(*d2ast.Null)
+	return ok
+}
+
 type Map struct {
 	parent Node
 	Fields []*Field `json:"fields"`
 	Edges  []*Edge  `json:"edges"`
+
+	// edgesMu serializes appendEdge on this map. See appendEdge.
+	edgesMu sync.Mutex
+
+	// compiledWith is set on a compiled root map to the options it was compiled with. See
+	// Map.Recompile.
+	compiledWith *boardOptions
 }
 
 func (m *Map) initRoot() {
@@ -168,10 +211,16 @@ func (m *Map) initRoot() {
 }
 
 func (m *Map) Copy(newParent Node) Node {
-	tmp := *m
-	m = &tmp
+	m2 := &Map{
+		parent: newParent,
+		Fields: m.Fields,
+		Edges:  m.Edges,
+	}
+	if newParent == nil {
+		m2.compiledWith = m.compiledWith
+	}
+	m = m2
 
-	m.parent = newParent
 	pfields := m.Fields
 	m.Fields = make([]*Field, 0, len(pfields))
 	for _, f := range pfields {
@@ -210,6 +259,25 @@ func (m *Map) CopyBase(newParent Node) *Map {
 	return m2
 }
 
+// CopyKeepRefs is like Copy but also keeps the reference to the root AST when copying a root
+// map with a nil newParent, which Copy replaces with an empty one, so that positions can
+// still be looked up in the copy, e.g. with NodeAtPosition.
+//
+// As with Copy, the fields and edges of the copy share their *FieldReference and
+// *EdgeReference with m and so their RefContext and AST. Those aren't copied: a mutation of
+// the AST or of a RefContext through either tree is seen by both and each RefContext's
+// ScopeMap is still the map of m. Only the IR itself is independent.
+func (m *Map) CopyKeepRefs(newParent Node) *Map {
+	m2 := m.Copy(newParent).(*Map)
+	if newParent == nil && m.Root() {
+		m2.parent = &Field{
+			Name:       m.parent.(*Field).Name,
+			References: append([]*FieldReference(nil), m.parent.(*Field).References...),
+		}
+	}
+	return m2
+}
+
 // Root reports whether the Map is the root of the D2 tree.
 func (m *Map) Root() bool {
 	// m.parent exists even on the root map as we store the root AST in
@@ -266,6 +334,81 @@ func NodeBoardKind(n Node) BoardKind {
 	}
 }
 
+type FieldKind string
+
+const (
+	FieldLeaf            FieldKind = "leaf"
+	FieldContainer       FieldKind = "container"
+	FieldBoard           FieldKind = "board"
+	FieldKeywordHolder   FieldKind = "keyword holder"
+	FieldReservedKeyword FieldKind = "reserved keyword"
+	FieldClassDef        FieldKind = "class definition"
+	FieldVar             FieldKind = "var"
+)
+
+// Kind classifies f. When f qualifies for multiple kinds, the first that applies in the
+// following order is returned:
+//
+//  1. FieldBoard if f is the root of a board. See NodeBoardKind for which kind of board.
+//  2. FieldVar if f is declared within vars.
+//  3. FieldClassDef if f is a class in classes.
+//  4. FieldKeywordHolder if f is a reserved keyword with a map like style, vars or layers.
+//  5. FieldReservedKeyword if f is any other reserved keyword.
+//  6. FieldContainer if f has children that are not reserved keywords.
+//  7. FieldLeaf otherwise.
+func (f *Field) Kind() FieldKind {
+	if NodeBoardKind(f) != "" {
+		return FieldBoard
+	}
+	if IsVar(ParentMap(f)) {
+		return FieldVar
+	}
+	if pf := ParentField(f); pf != nil && pf.Name == "classes" && NodeBoardKind(ParentMap(pf)) != "" {
+		return FieldClassDef
+	}
+	if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+		if f.Map() != nil {
+			return FieldKeywordHolder
+		}
+		return FieldReservedKeyword
+	}
+	if f.Map().IsContainer() {
+		return FieldContainer
+	}
+	return FieldLeaf
+}
+
+// CountByKind returns the number of fields of each Kind in m and its descendants, boards
+// and edge maps included, along with the number of edges as counted by EdgeCountRecursive.
+func (m *Map) CountByKind() (fields map[FieldKind]int, edges int) {
+	fields = make(map[FieldKind]int)
+	edges = m.countByKind(fields)
+	return fields, edges
+}
+
+func (m *Map) countByKind(fields map[FieldKind]int) (edges int) {
+	if m == nil {
+		return 0
+	}
+	for _, f := range m.Fields {
+		fields[f.Kind()]++
+		edges += f.Map().countByKind(fields)
+	}
+	for _, e := range m.Edges {
+		edges += 1 + e.Map_.countByKind(fields)
+	}
+	return edges
+}
+
+// IsPattern reports whether f was created by a glob key rather than a literal one, e.g.
+// style and fill under a for *.style.fill: red where a is literal. Globs never create the
+// fields they match so a field named a* was created by a literal key like a\* or "a*". It's
+// recorded by the reference f was created with, see FieldReference.FromGlob, so fields
+// without references, e.g. those made with the builder API, are literal.
+func (f *Field) IsPattern() bool {
+	return len(f.References) > 0 && f.References[0].FromGlob
+}
+
 type Field struct {
 	// *Map.
 	parent Node
@@ -295,6 +438,34 @@ func (f *Field) Copy(newParent Node) Node {
 	return f
 }
 
+// SetName renames f to name without touching anything else, e.g. the edges or references
+// naming f. It errors instead if a sibling of f already has the name, compared ignoring case
+// as lookups do, or if f would become or stop being a reserved keyword.
+func (f *Field) SetName(name string) error {
+	if name == "" || name == "_" {
+		return fmt.Errorf("invalid field name %q", name)
+	}
+	if !strings.EqualFold(f.Name, name) {
+		_, wasReserved := d2graph.ReservedKeywords[strings.ToLower(f.Name)]
+		_, isReserved := d2graph.ReservedKeywords[strings.ToLower(name)]
+		if wasReserved {
+			return fmt.Errorf("cannot rename reserved keyword %q", f.Name)
+		}
+		if isReserved {
+			return fmt.Errorf("cannot rename %q to reserved keyword %q", f.Name, name)
+		}
+	}
+	if pm := ParentMap(f); pm != nil {
+		for _, f2 := range pm.Fields {
+			if f2 != f && strings.EqualFold(f2.Name, name) {
+				return fmt.Errorf("cannot rename %q to %q: a sibling is already named %q", f.Name, name, f2.Name)
+			}
+		}
+	}
+	f.Name = name
+	return nil
+}
+
 func (f *Field) lastPrimaryRef() *FieldReference {
 	for i := len(f.References) - 1; i >= 0; i-- {
 		if f.References[i].Primary() {
@@ -312,6 +483,121 @@ func (f *Field) LastPrimaryKey() *d2ast.Key {
 	return fr.Context.Key
 }
 
+// EditSetValue returns the source edit that sets the primary value of the field at path,
+// relative to m, to value: the range to replace and the text to replace it with.
+//
+// If a key set the value of the field, the range is that of the value it set last. Values
+// set through globs are skipped as editing them would change other fields too. Otherwise
+// the range is the empty one at the end of the file m was compiled from and the text
+// declares the field there on its own line, e.g. a.b: value.
+func (m *Map) EditSetValue(path []string, value string) (d2ast.Range, string, error) {
+	if len(path) == 0 {
+		return d2ast.Range{}, "", fmt.Errorf("empty path")
+	}
+	valueText := d2format.Format(d2ast.RawString(value, false))
+
+	f := m.GetField(path...)
+	if f != nil {
+		if _, ok := f.Composite.(*Array); ok {
+			return d2ast.Range{}, "", fmt.Errorf("cannot set value of array %s", d2format.Format(d2ast.MakeKeyPath(path)))
+		}
+		for i := len(f.References) - 1; i >= 0; i-- {
+			fr := f.References[i]
+			if !fr.Primary() || fr.FromGlob {
+				continue
+			}
+			k := fr.Context.Key
+			if k.Primary.Unbox() != nil {
+				return k.Primary.Unbox().GetRange(), valueText, nil
+			}
+			if sv := k.Value.ScalarBox().Unbox(); sv != nil {
+				return sv.GetRange(), valueText, nil
+			}
+		}
+	}
+
+	root := RootMap(m)
+	rootAST := root.parent.(*Field).References[0].Context.ScopeAST
+	if rootAST == nil {
+		return d2ast.Range{}, "", fmt.Errorf("map was not compiled from source")
+	}
+	ida := append(IDA(m)[1:], path...)
+	end := rootAST.Range.End
+	r := d2ast.Range{
+		Path:  rootAST.Range.Path,
+		Start: end,
+		End:   end,
+	}
+	text := fmt.Sprintf("%s: %s\n", d2format.Format(d2ast.MakeKeyPath(ida)), valueText)
+	if end.Column > 0 {
+		// The file doesn't end in a newline so start a new line to not append to the last key.
+		text = "\n" + text
+	}
+	return r, text, nil
+}
+
+// FirstRef returns the first reference to f in compile order, i.e. where f was first
+// declared, or nil if f has none. References are appended as they're compiled so imports
+// and globs are in the order they're written in.
+func (f *Field) FirstRef() Reference {
+	if len(f.References) == 0 {
+		return nil
+	}
+	return f.References[0]
+}
+
+// DeclaredRange returns the source range of the name of f in its first reference. See
+// FirstRef.
+func (f *Field) DeclaredRange() d2ast.Range {
+	if len(f.References) == 0 {
+		return d2ast.Range{}
+	}
+	return f.References[0].String.GetRange()
+}
+
+// Range returns the source range of the key that declares f, value included, e.g. all of
+// a: { ... } rather than only the a token. Where f is declared as an edge endpoint only its
+// name is spanned. References through globs are skipped. It returns false if no reference
+// has a source range.
+func (f *Field) Range() (d2ast.Range, bool) {
+	for _, ref := range f.References {
+		if ref.FromGlob || ref.String == nil || ref.Context.Key == nil {
+			continue
+		}
+		r := ref.Context.Key.Range
+		if ref.InEdge() && ref.KeyPath != ref.Context.Key.Key {
+			r = ref.String.GetRange()
+		}
+		if hasRange(r) {
+			return r, true
+		}
+	}
+	return d2ast.Range{}, false
+}
+
+// Range returns the source range of the key that declares e, value included. In a chain
+// like a -> b -> c only the edge itself is spanned. References through globs are skipped.
+// It returns false if no reference has a source range.
+func (e *Edge) Range() (d2ast.Range, bool) {
+	for _, ref := range e.References {
+		k := ref.Context.Key
+		if k == nil || ref.Context.Edge == nil {
+			continue
+		}
+		if ref.Context.Edge.Src.HasGlob() || ref.Context.Edge.Dst.HasGlob() || (k.EdgeIndex != nil && k.EdgeIndex.Glob) {
+			continue
+		}
+		r := k.Range
+		if len(k.Edges) > 1 {
+			r = ref.Context.Edge.Range
+		}
+		if hasRange(r) {
+			return r, true
+		}
+	}
+	return d2ast.Range{}, false
+}
+
 func (f *Field) LastRef() Reference {
 	return f.References[len(f.References)-1]
 }
@@ -324,8 +610,14 @@ type EdgeID struct {
 	DstArrow bool     `json:"dst_arrow"`
 
 	// If nil, then any EdgeID with equal src/dst/arrows matches.
+	//
+	// Parallel edges in a map are indexed 0..n-1 in the order they were created. See
+	// Map.appendEdge.
 	Index *int `json:"index"`
 	Glob  bool `json:"glob"`
+
+	// If set, Index is the inclusive start of the range [Index..IndexEnd].
+	IndexEnd *int `json:"index_end,omitempty"`
 }
 
 func NewEdgeIDs(k *d2ast.Key) (eida []*EdgeID) {
@@ -338,6 +630,7 @@ func NewEdgeIDs(k *d2ast.Key) (eida []*EdgeID) {
 		}
 		if k.EdgeIndex != nil {
 			eid.Index = k.EdgeIndex.Int
+			eid.IndexEnd = k.EdgeIndex.IntEnd
 			eid.Glob = k.EdgeIndex.Glob
 		}
 		eida = append(eida, eid)
@@ -345,6 +638,78 @@ func NewEdgeIDs(k *d2ast.Key) (eida []*EdgeID) {
 	return eida
 }
 
+// ParseEdgeID parses an edge ID as written in a key and as returned by EdgeID.String, e.g.
+// (a.b -> "c.d")[2] or (a -> b)[*]. A common path before the edge as in x.(a -> b)[0] is
+// prepended to both ends.
+func ParseEdgeID(s string) (*EdgeID, error) {
+	k, err := d2parser.ParseMapKey(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse edge ID %q: %w", s, err)
+	}
+	if len(k.Edges) == 0 {
+		return nil, fmt.Errorf("edge ID %q is not an edge", s)
+	}
+	if len(k.Edges) > 1 {
+		return nil, fmt.Errorf("edge ID %q must be a single edge, not a chain of %d", s, len(k.Edges))
+	}
+	if k.EdgeKey != nil || k.Primary.Unbox() != nil || k.Value.Unbox() != nil {
+		return nil, fmt.Errorf("edge ID %q must not have a key or value after the edge", s)
+	}
+	eid := NewEdgeIDs(k)[0]
+	if k.Key != nil {
+		common := k.Key.IDA()
+		eid.SrcPath = append(append([]string(nil), common...), eid.SrcPath...)
+		eid.DstPath = append(append([]string(nil), common...), eid.DstPath...)
+	}
+	return eid, nil
+}
+
+// NewBidirectionalEdgeID returns the EdgeID of src <-> dst.
+func NewBidirectionalEdgeID(src, dst []string) *EdgeID {
+	return &EdgeID{
+		SrcPath:  src,
+		SrcArrow: true,
+		DstPath:  dst,
+		DstArrow: true,
+	}
+}
+
+// Bidirectional reports whether eid has arrows on both ends as in a <-> b.
+func (eid *EdgeID) Bidirectional() bool {
+	return eid.SrcArrow && eid.DstArrow
+}
+
+// String returns eid as it would be written in a key, e.g. (a <-> b)[0].
+func (eid *EdgeID) String() string {
+	k := &d2ast.Key{
+		Edges: []*d2ast.Edge{eid.astEdge()},
+	}
+	if eid.Glob {
+		k.EdgeIndex = &d2ast.EdgeIndex{
+			Glob: true,
+		}
+	} else if eid.Index != nil {
+		k.EdgeIndex = &d2ast.EdgeIndex{
+			Int:    eid.Index,
+			IntEnd: eid.IndexEnd,
+		}
+	}
+	return d2format.Format(k)
+}
+
+func (eid *EdgeID) astEdge() *d2ast.Edge {
+	astEdge := &d2ast.Edge{}
+	astEdge.Src = d2ast.MakeKeyPath(eid.SrcPath)
+	if eid.SrcArrow {
+		astEdge.SrcArrow = "<"
+	}
+	astEdge.Dst = d2ast.MakeKeyPath(eid.DstPath)
+	if eid.DstArrow {
+		astEdge.DstArrow = ">"
+	}
+	return astEdge
+}
+
 func (eid *EdgeID) Copy() *EdgeID {
 	tmp := *eid
 	eid = &tmp
@@ -356,7 +721,7 @@ func (eid *EdgeID) Copy() *EdgeID {
 
 func (eid *EdgeID) Match(eid2 *EdgeID) bool {
 	if eid.Index != nil && eid2.Index != nil {
-		if *eid.Index != *eid2.Index {
+		if !eid.matchIndex(eid2) {
 			return false
 		}
 	}
@@ -388,6 +753,104 @@ func (eid *EdgeID) Match(eid2 *EdgeID) bool {
 	return true
 }
 
+func (eid *EdgeID) matchIndex(eid2 *EdgeID) bool {
+	if eid.IndexEnd != nil {
+		return *eid.Index <= *eid2.Index && *eid2.Index <= *eid.IndexEnd
+	}
+	if eid2.IndexEnd != nil {
+		return eid2.matchIndex(eid)
+	}
+	return *eid.Index == *eid2.Index
+}
+
+// matchEndpoints is like Match but ignores the index.
+func (eid *EdgeID) matchEndpoints(eid2 *EdgeID) bool {
+	tmp := *eid
+	tmp.Index = nil
+	tmp.IndexEnd = nil
+	return tmp.Match(eid2)
+}
+
+// Normalize returns a copy of eid with SrcPath and DstPath in lexicographic order if eid is
+// undirected, i.e. it has no arrows or arrows on both ends. Directed EdgeIDs are returned
+// as an unchanged copy.
+func (eid *EdgeID) Normalize() *EdgeID {
+	eid = eid.Copy()
+	if eid.SrcArrow != eid.DstArrow {
+		return eid
+	}
+	if compareIDA(eid.DstPath, eid.SrcPath) < 0 {
+		eid.SrcPath, eid.DstPath = eid.DstPath, eid.SrcPath
+	}
+	return eid
+}
+
+// MatchUndirected is like Match but treats undirected EdgeIDs with their endpoints
+// swapped as equal. See Normalize.
+func (eid *EdgeID) MatchUndirected(eid2 *EdgeID) bool {
+	return eid.Normalize().Match(eid2.Normalize())
+}
+
+// compareIDA compares ida and ida2 element-wise ignoring case as Match does.
+func compareIDA(ida, ida2 []string) int {
+	for i := 0; i < len(ida) && i < len(ida2); i++ {
+		if c := strings.Compare(strings.ToLower(ida[i]), strings.ToLower(ida2[i])); c != 0 {
+			return c
+		}
+	}
+	return len(ida) - len(ida2)
+}
+
+// CompareEdgeIDs orders EdgeIDs by SrcPath, DstPath, SrcArrow, DstArrow and then Index,
+// without an arrow or index first. Paths are compared element-wise ignoring case as Match
+// does. It returns a negative number if a sorts before b, a positive one if after and 0 if
+// they're equal.
+func CompareEdgeIDs(a, b *EdgeID) int {
+	if c := compareIDA(a.SrcPath, b.SrcPath); c != 0 {
+		return c
+	}
+	if c := compareIDA(a.DstPath, b.DstPath); c != 0 {
+		return c
+	}
+	if c := compareBool(a.SrcArrow, b.SrcArrow); c != 0 {
+		return c
+	}
+	if c := compareBool(a.DstArrow, b.DstArrow); c != 0 {
+		return c
+	}
+	if c := compareIndex(a.Index, b.Index); c != 0 {
+		return c
+	}
+	if c := compareIndex(a.IndexEnd, b.IndexEnd); c != 0 {
+		return c
+	}
+	return compareBool(a.Glob, b.Glob)
+}
+
+func compareBool(b, b2 bool) int {
+	switch {
+	case b == b2:
+		return 0
+	case b:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func compareIndex(i, i2 *int) int {
+	switch {
+	case i == nil && i2 == nil:
+		return 0
+	case i == nil:
+		return -1
+	case i2 == nil:
+		return 1
+	default:
+		return *i - *i2
+	}
+}
+
 // resolve resolves both underscores and commons in eid.
 // It returns the new eid, containing map adjusted for underscores and common ida.
 func (eid *EdgeID) resolve(m *Map) (_ *EdgeID, _ *Map, common []string, _ error) {
@@ -408,7 +871,7 @@ func (eid *EdgeID) resolve(m *Map) (_ *EdgeID, _ *Map, common []string, _ error)
 		}
 		m = ParentMap(m)
 		if m == nil {
-			return nil, nil, nil, errors.New("invalid underscore")
+			return nil, nil, nil, ErrInvalidUnderscore
 		}
 	}
 
@@ -490,11 +953,78 @@ func (a *Array) Copy(newParent Node) Node {
 	return a
 }
 
+// Get returns the value at index i or nil if i is out of range.
+func (a *Array) Get(i int) Value {
+	if i < 0 || i >= len(a.Values) {
+		return nil
+	}
+	return a.Values[i]
+}
+
+// Set replaces the value at index i with v and sets v's parent to a.
+func (a *Array) Set(i int, v Value) error {
+	if i < 0 || i >= len(a.Values) {
+		return fmt.Errorf("index %d out of range for array of length %d", i, len(a.Values))
+	}
+	setValueParent(v, a)
+	a.Values[i] = v
+	return nil
+}
+
+// Append appends v to a and sets v's parent to a.
+func (a *Array) Append(v Value) {
+	setValueParent(v, a)
+	a.Values = append(a.Values, v)
+}
+
+// RemoveAt removes the value at index i.
+func (a *Array) RemoveAt(i int) error {
+	if i < 0 || i >= len(a.Values) {
+		return fmt.Errorf("index %d out of range for array of length %d", i, len(a.Values))
+	}
+	a.Values = append(a.Values[:i], a.Values[i+1:]...)
+	return nil
+}
+
+func setValueParent(v Value, parent Node) {
+	switch v := v.(type) {
+	case *Scalar:
+		v.parent = parent
+	case *Array:
+		v.parent = parent
+	case *Map:
+		v.parent = parent
+	}
+}
+
 type FieldReference struct {
 	String  d2ast.String   `json:"string"`
 	KeyPath *d2ast.KeyPath `json:"key_path"`
 
 	Context *RefContext `json:"context"`
+
+	// FromGlob is true if the field was matched or created by KeyPath through a glob in a
+	// segment before String, e.g. for the fill field of a.style.fill referenced by
+	// *.style.fill: red. Pattern is then KeyPath as written.
+	FromGlob bool   `json:"from_glob,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+}
+
+// newFieldReference returns the reference to the field at segment i of kp.
+func newFieldReference(i int, kp *d2ast.KeyPath, refctx *RefContext) *FieldReference {
+	fr := &FieldReference{
+		String:  kp.Path[i].Unbox(),
+		KeyPath: kp,
+		Context: refctx,
+	}
+	for _, sb := range kp.Path[:i] {
+		if us, ok := sb.Unbox().(*d2ast.UnquotedString); ok && us.Pattern != nil {
+			fr.FromGlob = true
+			fr.Pattern = d2format.Format(kp)
+			break
+		}
+	}
+	return fr
 }
 
 // Primary returns true if the Value in Context.Key.Value corresponds to the Field
@@ -553,6 +1083,10 @@ type RefContext struct {
 	Scope    *d2ast.Map  `json:"-"`
 	ScopeMap *Map        `json:"-"`
 	ScopeAST *d2ast.Map  `json:"-"`
+
+	// Comments holds the *d2ast.Comment and *d2ast.BlockComment nodes directly above Key.
+	// Only set with CompileOptions.CaptureComments.
+	Comments []d2ast.Node `json:"-"`
 }
 
 func (rc *RefContext) Copy() *RefContext {
@@ -569,6 +1103,53 @@ func (rc *RefContext) EdgeIndex() int {
 	return -1
 }
 
+// FieldCount returns the number of direct fields of m that are not reserved keywords.
+func (m *Map) FieldCount() int {
+	if m == nil {
+		return 0
+	}
+	n := 0
+	for _, f := range m.Fields {
+		if _, isReserved := d2graph.ReservedKeywords[f.Name]; !isReserved {
+			n++
+		}
+	}
+	return n
+}
+
+// EdgeCount returns the number of direct edges of m.
+func (m *Map) EdgeCount() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.Edges)
+}
+
+// ForEachField calls fn on each direct field of m in order until fn returns false. Fields
+// within nested maps are not visited.
+func (m *Map) ForEachField(fn func(*Field) bool) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		if !fn(f) {
+			return
+		}
+	}
+}
+
+// ForEachEdge calls fn on each direct edge of m in order until fn returns false.
+func (m *Map) ForEachEdge(fn func(*Edge) bool) {
+	if m == nil {
+		return
+	}
+	for _, e := range m.Edges {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
 func (m *Map) FieldCountRecursive() int {
 	if m == nil {
 		return 0
@@ -587,65 +1168,615 @@ func (m *Map) FieldCountRecursive() int {
 	return acc
 }
 
-func (m *Map) IsContainer() bool {
+// OwnFieldCount is like FieldCountRecursive but only counts the fields of the board m
+// itself: layers, scenarios and steps along with the boards within them aren't counted.
+func (m *Map) OwnFieldCount() int {
 	if m == nil {
-		return false
+		return 0
 	}
+	acc := 0
 	for _, f := range m.Fields {
-		_, isReserved := d2graph.ReservedKeywords[f.Name]
-		if !isReserved {
-			return true
+		if isBoardHolder(f) {
+			continue
 		}
+		acc++
+		acc += f.Map().OwnFieldCount()
 	}
-	return false
+	for _, e := range m.Edges {
+		acc += e.Map_.OwnFieldCount()
+	}
+	return acc
 }
 
-func (m *Map) EdgeCountRecursive() int {
+// OwnEdgeCount is like OwnFieldCount for edges.
+func (m *Map) OwnEdgeCount() int {
 	if m == nil {
 		return 0
 	}
 	acc := len(m.Edges)
 	for _, f := range m.Fields {
-		if f.Map() != nil {
-			acc += f.Map().EdgeCountRecursive()
-		}
-	}
-	for _, e := range m.Edges {
-		if e.Map_ != nil {
-			acc += e.Map_.EdgeCountRecursive()
+		if isBoardHolder(f) {
+			continue
 		}
+		acc += f.Map().OwnEdgeCount()
 	}
 	return acc
 }
 
-func (m *Map) GetClassMap(name string) *Map {
-	root := RootMap(m)
-	classes := root.Map().GetField("classes")
-	if classes != nil && classes.Map() != nil {
-		class := classes.Map().GetField(name)
-		if class != nil && class.Map() != nil {
-			return class.Map()
-		}
+// isBoardHolder reports whether f is a board keyword like layers holding boards.
+func isBoardHolder(f *Field) bool {
+	if f.Map() == nil {
+		return false
 	}
-	return nil
-}
-
-func (m *Map) GetField(ida ...string) *Field {
-	for len(ida) > 0 && ida[0] == "_" {
-		m = ParentMap(m)
-		if m == nil {
-			return nil
+	for _, f2 := range f.Map().Fields {
+		if NodeBoardKind(f2) != "" {
+			return true
 		}
 	}
-	return m.getField(ida)
+	return false
 }
 
-func (m *Map) getField(ida []string) *Field {
-	if len(ida) == 0 {
-		return nil
+// TrimEmptyBoards removes the boards within the board m and its nested boards that have no
+// content of their own and returns how many were removed. A scenario or step is empty if it
+// doesn't differ from the board it inherits from, see Diff, and a layer if it has nothing but
+// classes, which layers inherit. Boards left with non-empty boards within them are kept as are
+// board holders like scenarios until they're empty. m itself is never removed.
+func (m *Map) TrimEmptyBoards() int {
+	if m == nil {
+		return 0
 	}
-
-	s := ida[0]
+	var n int
+	for _, hf := range append([]*Field(nil), m.Fields...) {
+		if !isBoardHolder(hf) {
+			continue
+		}
+		for _, bf := range append([]*Field(nil), hf.Map().Fields...) {
+			if NodeBoardKind(bf) == "" || bf.Map() == nil {
+				continue
+			}
+			n += bf.Map().TrimEmptyBoards()
+			if isEmptyBoard(bf) {
+				hf.Map().DeleteField(bf.Name)
+				n++
+			}
+		}
+		if hf.Map().FieldCount() == 0 {
+			m.DeleteField(hf.Name)
+		}
+	}
+	return n
+}
+
+// isEmptyBoard reports whether the board f has no content of its own. See TrimEmptyBoards.
+func isEmptyBoard(f *Field) bool {
+	for _, f2 := range f.Map().Fields {
+		if isBoardHolder(f2) {
+			return false
+		}
+	}
+	switch NodeBoardKind(f) {
+	case BoardScenario, BoardStep:
+		return len(Diff(boardBase(f).CopyBase(nil), f.Map().CopyBase(nil))) == 0
+	}
+	if len(f.Map().Edges) > 0 {
+		return false
+	}
+	for _, f2 := range f.Map().Fields {
+		if f2.Name != "classes" {
+			return false
+		}
+	}
+	return true
+}
+
+// UsedReservedKeywords returns the number of fields named after each reserved keyword in
+// m, including keyword holders like style, vars and classes. Fields within edges and
+// boards are counted too, so content that a scenario or step inherits from its base board
+// is counted once per board.
+func (m *Map) UsedReservedKeywords() map[string]int {
+	counts := make(map[string]int)
+	m.usedReservedKeywords(counts)
+	return counts
+}
+
+func (m *Map) usedReservedKeywords(counts map[string]int) {
+	for _, f := range m.Fields {
+		if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+			counts[f.Name]++
+		}
+		if f.Map() != nil {
+			f.Map().usedReservedKeywords(counts)
+		}
+	}
+	for _, e := range m.Edges {
+		if e.Map_ != nil {
+			e.Map_.usedReservedKeywords(counts)
+		}
+	}
+}
+
+func (m *Map) IsContainer() bool {
+	return m.FieldCount() > 0
+}
+
+func (m *Map) EdgeCountRecursive() int {
+	if m == nil {
+		return 0
+	}
+	acc := len(m.Edges)
+	for _, f := range m.Fields {
+		if f.Map() != nil {
+			acc += f.Map().EdgeCountRecursive()
+		}
+	}
+	for _, e := range m.Edges {
+		if e.Map_ != nil {
+			acc += e.Map_.EdgeCountRecursive()
+		}
+	}
+	return acc
+}
+
+// DistinctEdgePairs returns the number of distinct connections in m and its descendants:
+// edges with the same endpoints and arrows, i.e. parallel edges, are counted once.
+func (m *Map) DistinctEdgePairs() int {
+	pairs := make(map[string]struct{})
+	m.distinctEdgePairs(pairs, false)
+	return len(pairs)
+}
+
+// DistinctUndirectedPairs is like DistinctEdgePairs but undirected edges are normalized
+// first, see EdgeID.Normalize, so that a -- b and b -- a are one connection.
+func (m *Map) DistinctUndirectedPairs() int {
+	pairs := make(map[string]struct{})
+	m.distinctEdgePairs(pairs, true)
+	return len(pairs)
+}
+
+func (m *Map) distinctEdgePairs(pairs map[string]struct{}, normalize bool) {
+	if m == nil {
+		return
+	}
+	if len(m.Edges) > 0 {
+		// Edge paths are relative to m.
+		prefix := flatName(IDA(m))
+		for _, e := range m.Edges {
+			eid := e.ID.Copy()
+			eid.Index = nil
+			eid.IndexEnd = nil
+			eid.Glob = false
+			if normalize {
+				eid = eid.Normalize()
+			}
+			pairs[prefix+" "+eid.String()] = struct{}{}
+		}
+	}
+	for _, f := range m.Fields {
+		f.Map().distinctEdgePairs(pairs, normalize)
+	}
+}
+
+// EdgeGroups returns the edges of m and its descendants grouped by endpoints and arrows,
+// i.e. each group is a set of parallel edges, ordered by index. Groups are keyed by the
+// edge ID without its index and with paths relative to m, e.g. x.a -> x.b. Nested boards
+// are not included as they're laid out separately.
+func (m *Map) EdgeGroups() map[string][]*Edge {
+	groups := make(map[string][]*Edge)
+	m.edgeGroups(nil, groups)
+	for _, ea := range groups {
+		sort.SliceStable(ea, func(i, j int) bool {
+			return compareIndex(ea[i].ID.Index, ea[j].ID.Index) < 0
+		})
+	}
+	return groups
+}
+
+func (m *Map) edgeGroups(prefix []string, groups map[string][]*Edge) {
+	if m == nil {
+		return
+	}
+	for _, e := range m.Edges {
+		eid := e.ID.Copy()
+		eid.SrcPath = append(append([]string(nil), prefix...), eid.SrcPath...)
+		eid.DstPath = append(append([]string(nil), prefix...), eid.DstPath...)
+		eid.Index = nil
+		eid.IndexEnd = nil
+		eid.Glob = false
+		k := eid.String()
+		groups[k] = append(groups[k], e)
+	}
+	for _, f := range m.Fields {
+		if NodeBoardKind(f) != "" {
+			continue
+		}
+		f.Map().edgeGroups(append(prefix[:len(prefix):len(prefix)], f.Name), groups)
+	}
+}
+
+// GrepOptions configures Grep.
+type GrepOptions struct {
+	// CaseInsensitive matches regardless of case.
+	CaseInsensitive bool
+	// Values also matches fields and edges on their primary value.
+	Values bool
+}
+
+// Grep returns the fields of m and its descendants whose name contains substr and the edges
+// with an endpoint that does, for interactive search. Unlike a glob, substr isn't anchored.
+// Results are in document order, by where each was first declared. Those created through
+// globs or without a source range come last. Use IDA on a result for its absolute path.
+func (m *Map) Grep(substr string, opts GrepOptions) []Node {
+	var acc []Node
+	if opts.CaseInsensitive {
+		substr = strings.ToLower(substr)
+	}
+	m.grep(&acc, substr, opts)
+	sort.SliceStable(acc, func(i, j int) bool {
+		p, ok := declaredPosition(acc[i])
+		if !ok {
+			return false
+		}
+		p2, ok := declaredPosition(acc[j])
+		return !ok || p.Before(p2)
+	})
+	return acc
+}
+
+func (m *Map) grep(acc *[]Node, substr string, opts GrepOptions) {
+	if m == nil {
+		return
+	}
+	contains := func(s string) bool {
+		if opts.CaseInsensitive {
+			s = strings.ToLower(s)
+		}
+		return strings.Contains(s, substr)
+	}
+	primaryContains := func(p *Scalar) bool {
+		return opts.Values && p != nil && contains(p.Value.ScalarString())
+	}
+
+	for _, f := range m.Fields {
+		if contains(f.Name) || primaryContains(f.Primary_) {
+			*acc = append(*acc, f)
+		}
+		f.Map().grep(acc, substr, opts)
+	}
+	for _, e := range m.Edges {
+		match := primaryContains(e.Primary_)
+		for _, s := range append(append([]string(nil), e.ID.SrcPath...), e.ID.DstPath...) {
+			match = match || contains(s)
+		}
+		if match {
+			*acc = append(*acc, e)
+		}
+		e.Map_.grep(acc, substr, opts)
+	}
+}
+
+// ReplaceScalar calls match with every string value of m and its descendants, primaries and
+// array elements alike, and replaces the value with the string match returns if it reports
+// true. The kind of quoting of a value is kept. It returns the number of values replaced.
+//
+// Values are replaced in place in the AST m was compiled from so that formatting it
+// reflects the replacements. A value shared by several fields, e.g. through a glob, is
+// passed to match and counted once.
+func (m *Map) ReplaceScalar(match func(s string) (string, bool)) int {
+	r := &scalarReplacer{
+		match: match,
+		seen:  make(map[d2ast.String]struct{}),
+	}
+	r.replaceMap(m)
+	return r.n
+}
+
+type scalarReplacer struct {
+	match func(s string) (string, bool)
+	seen  map[d2ast.String]struct{}
+	n     int
+}
+
+func (r *scalarReplacer) replaceMap(m *Map) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		r.replaceScalar(f.Primary_)
+		r.replaceValue(f.Composite)
+	}
+	for _, e := range m.Edges {
+		r.replaceScalar(e.Primary_)
+		r.replaceMap(e.Map_)
+	}
+}
+
+func (r *scalarReplacer) replaceValue(v Value) {
+	switch v := v.(type) {
+	case *Scalar:
+		r.replaceScalar(v)
+	case *Array:
+		for _, v2 := range v.Values {
+			r.replaceValue(v2)
+		}
+	case *Map:
+		r.replaceMap(v)
+	}
+}
+
+func (r *scalarReplacer) replaceScalar(s *Scalar) {
+	if s == nil {
+		return
+	}
+	str, ok := s.Value.(d2ast.String)
+	if !ok {
+		return
+	}
+	if _, ok := r.seen[str]; ok {
+		return
+	}
+	r.seen[str] = struct{}{}
+	s2, ok := r.match(str.ScalarString())
+	if !ok {
+		return
+	}
+	str.SetString(s2)
+	r.n++
+}
+
+// EdgeTuple is an edge of a Map.EdgeList.
+type EdgeTuple struct {
+	Src []string `json:"src"`
+	Dst []string `json:"dst"`
+	// Index is the index of the edge among the edges between the same endpoints.
+	Index int `json:"index"`
+	// Directed is true if the edge has a single arrowhead, in which case it points to Dst.
+	// Edges like a -- b and a <-> b are undirected.
+	Directed bool `json:"directed"`
+}
+
+// EdgeList returns the edges of m and its descendants, including those within boards, with
+// endpoint paths relative to m, e.g. a.b -> c in x is x.a.b -> x.c and the same edge in the
+// layer l is layers.l.x.a.b -> layers.l.x.c. Edges are listed map by map in order, the edges
+// of a map before those within its fields.
+func (m *Map) EdgeList() []EdgeTuple {
+	var acc []EdgeTuple
+	m.edgeList(&acc, nil)
+	return acc
+}
+
+func (m *Map) edgeList(acc *[]EdgeTuple, ida []string) {
+	if m == nil {
+		return
+	}
+	for _, e := range m.Edges {
+		t := EdgeTuple{
+			Src:      append(ida[:len(ida):len(ida)], e.ID.SrcPath...),
+			Dst:      append(ida[:len(ida):len(ida)], e.ID.DstPath...),
+			Directed: e.ID.SrcArrow != e.ID.DstArrow,
+		}
+		if e.ID.Index != nil {
+			t.Index = *e.ID.Index
+		}
+		if e.ID.SrcArrow && !e.ID.DstArrow {
+			t.Src, t.Dst = t.Dst, t.Src
+		}
+		*acc = append(*acc, t)
+	}
+	for _, f := range m.Fields {
+		f.Map().edgeList(acc, append(ida[:len(ida):len(ida)], f.Name))
+	}
+}
+
+// AdjacencyMatrix returns the nodes of the board m, its fields that aren't reserved
+// keywords, and the matrix of the number of edges between them in and within the nodes. An
+// edge is counted between the nodes containing its endpoints so an edge between two children
+// of a node is a self-loop of the node. A directed edge src -> dst increments [src][dst] and
+// an undirected one increments both [src][dst] and [dst][src]. Nested boards are skipped.
+func (m *Map) AdjacencyMatrix() ([]*Field, [][]int) {
+	return m.adjacencyMatrix(false)
+}
+
+// AdjacencyMatrixLeaves is like AdjacencyMatrix but with containers expanded to their
+// leaves at any depth. Edges to a container are left out.
+func (m *Map) AdjacencyMatrixLeaves() ([]*Field, [][]int) {
+	return m.adjacencyMatrix(true)
+}
+
+func (m *Map) adjacencyMatrix(leaves bool) ([]*Field, [][]int) {
+	var nodes []*Field
+	var addNodes func(m *Map)
+	addNodes = func(m *Map) {
+		for _, f := range m.Fields {
+			if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+				continue
+			}
+			if leaves && f.Map() != nil && len(f.Map().UserFields()) > 0 {
+				addNodes(f.Map())
+				continue
+			}
+			nodes = append(nodes, f)
+		}
+	}
+	addNodes(m)
+
+	index := make(map[*Field]int, len(nodes))
+	for i, f := range nodes {
+		index[f] = i
+	}
+	matrix := make([][]int, len(nodes))
+	for i := range matrix {
+		matrix[i] = make([]int, len(nodes))
+	}
+	lookup := func(ida []string) (int, bool) {
+		if !leaves {
+			ida = ida[:1]
+		}
+		i, ok := index[m.GetField(ida...)]
+		return i, ok
+	}
+
+	inBoard := func(ida []string) bool {
+		for _, s := range ida {
+			if _, ok := d2graph.BoardKeywords[s]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, et := range m.EdgeList() {
+		if inBoard(et.Src) {
+			continue
+		}
+		src, ok := lookup(et.Src)
+		if !ok {
+			continue
+		}
+		dst, ok := lookup(et.Dst)
+		if !ok {
+			continue
+		}
+		matrix[src][dst]++
+		if !et.Directed && src != dst {
+			matrix[dst][src]++
+		}
+	}
+	return nodes, matrix
+}
+
+// UserFields returns the direct fields of m that are not reserved keywords, i.e. the nodes
+// of the user's graph, as counted by FieldCount.
+func (m *Map) UserFields() []*Field {
+	if m == nil {
+		return nil
+	}
+	var fa []*Field
+	for _, f := range m.Fields {
+		if _, ok := d2graph.ReservedKeywords[f.Name]; !ok {
+			fa = append(fa, f)
+		}
+	}
+	return fa
+}
+
+// OrphanFields returns the leaves of the board m, fields that aren't reserved keywords nor
+// containers, that aren't an end of any edge. Nested boards are skipped.
+func (m *Map) OrphanFields() []*Field {
+	connected := make(map[*Field]struct{})
+	m.connectedFields(connected)
+
+	var fa []*Field
+	var addOrphans func(m *Map)
+	addOrphans = func(m *Map) {
+		for _, f := range m.UserFields() {
+			if f.Map().IsContainer() {
+				addOrphans(f.Map())
+				continue
+			}
+			if _, ok := connected[f]; !ok {
+				fa = append(fa, f)
+			}
+		}
+	}
+	addOrphans(m)
+	return fa
+}
+
+func (m *Map) connectedFields(connected map[*Field]struct{}) {
+	if m == nil {
+		return
+	}
+	for _, e := range m.Edges {
+		if f := m.GetField(e.ID.SrcPath...); f != nil {
+			connected[f] = struct{}{}
+		}
+		if f := m.GetField(e.ID.DstPath...); f != nil {
+			connected[f] = struct{}{}
+		}
+	}
+	for _, f := range m.UserFields() {
+		f.Map().connectedFields(connected)
+	}
+}
+
+func (m *Map) GetClassMap(name string) *Map {
+	root := RootMap(m)
+	classes := root.Map().GetField("classes")
+	if classes != nil && classes.Map() != nil {
+		class := classes.Map().GetField(name)
+		if class != nil && class.Map() != nil {
+			return class.Map()
+		}
+	}
+	return nil
+}
+
+func (m *Map) GetField(ida ...string) *Field {
+	for len(ida) > 0 && ida[0] == "_" {
+		m = ParentMap(m)
+		if m == nil {
+			return nil
+		}
+		ida = ida[1:]
+	}
+	return m.getField(ida, false)
+}
+
+// ResolveUnderscores resolves the leading underscores of path from m as EnsureField does
+// without creating or modifying anything. It returns the absolute path path refers to and
+// the map the rest of path is relative to, e.g. the parent of the field holding m for
+// _._.x. The errors wrap ErrInvalidUnderscore.
+func (m *Map) ResolveUnderscores(path []string) ([]string, *Map, error) {
+	i := 0
+	for i < len(path) && path[i] == "_" {
+		m = ParentMap(m)
+		if m == nil {
+			return nil, nil, fmt.Errorf("%w: no parent", ErrInvalidUnderscore)
+		}
+		i++
+	}
+	if i == len(path) {
+		return nil, nil, fmt.Errorf("%w: field key must contain more than underscores", ErrInvalidUnderscore)
+	}
+	for _, s := range path[i:] {
+		if s == "_" {
+			return nil, nil, fmt.Errorf(`%w: parent "_" can only be used in the beginning of paths, e.g. "_.x"`, ErrInvalidUnderscore)
+		}
+	}
+	return append(IDA(m)[1:], path[i:]...), m, nil
+}
+
+// GetFieldExact is like GetField but matches names case sensitively. Compiling folds the
+// case of names so that Node and node are the same field, so this only matters for maps
+// where fields differing only by case were forced to coexist, e.g. by appending to Fields.
+func (m *Map) GetFieldExact(ida ...string) *Field {
+	for len(ida) > 0 && ida[0] == "_" {
+		m = ParentMap(m)
+		if m == nil {
+			return nil
+		}
+		ida = ida[1:]
+	}
+	return m.getField(ida, true)
+}
+
+// GetUserField is like GetField but doesn't descend into or return reserved keywords like
+// style. A reserved keyword is one regardless of its case or quoting, e.g. "style" and
+// STYLE are both the style keyword.
+func (m *Map) GetUserField(ida ...string) *Field {
+	for _, s := range ida {
+		if _, ok := d2graph.ReservedKeywords[strings.ToLower(s)]; ok {
+			return nil
+		}
+	}
+	return m.GetField(ida...)
+}
+
+func (m *Map) getField(ida []string, exact bool) *Field {
+	if len(ida) == 0 {
+		return nil
+	}
+
+	s := ida[0]
 	rest := ida[1:]
 
 	if s == "_" {
@@ -653,14 +1784,14 @@ func (m *Map) getField(ida []string) *Field {
 	}
 
 	for _, f := range m.Fields {
-		if !strings.EqualFold(f.Name, s) {
+		if exact && f.Name != s || !exact && !strings.EqualFold(f.Name, s) {
 			continue
 		}
 		if len(rest) == 0 {
 			return f
 		}
 		if f.Map() != nil {
-			return f.Map().getField(rest)
+			return f.Map().getField(rest, exact)
 		}
 	}
 	return nil
@@ -668,28 +1799,38 @@ func (m *Map) getField(ida []string) *Field {
 
 // EnsureField is a bit of a misnomer. It's more of a Query/Ensure combination function at this point.
 func (m *Map) EnsureField(kp *d2ast.KeyPath, refctx *RefContext, create bool) ([]*Field, error) {
+	return m.ensureFieldPath(kp, refctx, create, nil)
+}
+
+// ensureFieldPath is EnsureField counting the fields it creates toward c's limits if c is
+// non-nil.
+func (m *Map) ensureFieldPath(kp *d2ast.KeyPath, refctx *RefContext, create bool, c *compiler) ([]*Field, error) {
 	i := 0
 	for kp.Path[i].Unbox().ScalarString() == "_" {
 		m = ParentMap(m)
 		if m == nil {
-			return nil, d2parser.Errorf(kp.Path[i].Unbox(), "invalid underscore: no parent")
+			return nil, kindErrorf(ErrInvalidUnderscore, kp.Path[i].Unbox(), "invalid underscore: no parent")
 		}
 		if i+1 == len(kp.Path) {
-			return nil, d2parser.Errorf(kp.Path[i].Unbox(), "field key must contain more than underscores")
+			return nil, kindErrorf(ErrInvalidUnderscore, kp.Path[i].Unbox(), "field key must contain more than underscores")
 		}
 		i++
 	}
 
 	var fa []*Field
-	err := m.ensureField(i, kp, refctx, create, &fa)
+	err := m.ensureField(i, kp, refctx, create, c, &fa)
 	return fa, err
 }
 
-func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create bool, fa *[]*Field) error {
+func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create bool, c *compiler, fa *[]*Field) error {
+	if c != nil && c.stopped() {
+		return nil
+	}
 	us, ok := kp.Path[i].Unbox().(*d2ast.UnquotedString)
 	if ok && us.Pattern != nil {
-		fa2, ok := m.doubleGlob(us.Pattern)
+		fa2, ok := m.doubleGlob(us.Pattern, c)
 		if ok {
+			// fa2 is a snapshot, see doubleGlob.
 			if i == len(kp.Path)-1 {
 				*fa = append(*fa, fa2...)
 			} else {
@@ -699,7 +1840,7 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 							parent: f,
 						}
 					}
-					err := f.Map().ensureField(i+1, kp, refctx, create, fa)
+					err := f.Map().ensureField(i+1, kp, refctx, create, c, fa)
 					if err != nil {
 						return err
 					}
@@ -717,7 +1858,7 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 							parent: f,
 						}
 					}
-					err := f.Map().ensureField(i+1, kp, refctx, create, fa)
+					err := f.Map().ensureField(i+1, kp, refctx, create, c, fa)
 					if err != nil {
 						return err
 					}
@@ -737,7 +1878,7 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 	}
 
 	if head == "_" {
-		return d2parser.Errorf(kp.Path[i].Unbox(), `parent "_" can only be used in the beginning of paths, e.g. "_.x"`)
+		return kindErrorf(ErrInvalidUnderscore, kp.Path[i].Unbox(), `parent "_" can only be used in the beginning of paths, e.g. "_.x"`)
 	}
 
 	if head == "classes" && NodeBoardKind(m) == "" {
@@ -755,11 +1896,7 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 
 		// Don't add references for fake common KeyPath from trimCommon in CreateEdge.
 		if refctx != nil {
-			f.References = append(f.References, &FieldReference{
-				String:  kp.Path[i].Unbox(),
-				KeyPath: kp,
-				Context: refctx,
-			})
+			f.References = append(f.References, newFieldReference(i, kp, refctx))
 		}
 
 		if i+1 == len(kp.Path) {
@@ -767,30 +1904,31 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 			return nil
 		}
 		if _, ok := f.Composite.(*Array); ok {
-			return d2parser.Errorf(kp.Path[i].Unbox(), "cannot index into array")
+			return kindErrorf(ErrIndexIntoArray, kp.Path[i].Unbox(), "cannot index into array")
 		}
 		if f.Map() == nil {
 			f.Composite = &Map{
 				parent: f,
 			}
 		}
-		return f.Map().ensureField(i+1, kp, refctx, create, fa)
+		return f.Map().ensureField(i+1, kp, refctx, create, c, fa)
 	}
 
 	if !create {
 		return nil
 	}
+	if c != nil {
+		if err := c.countField(kp.Path[i].Unbox()); err != nil {
+			return err
+		}
+	}
 	f := &Field{
 		parent: m,
 		Name:   head,
 	}
 	// Don't add references for fake common KeyPath from trimCommon in CreateEdge.
 	if refctx != nil {
-		f.References = append(f.References, &FieldReference{
-			String:  kp.Path[i].Unbox(),
-			KeyPath: kp,
-			Context: refctx,
-		})
+		f.References = append(f.References, newFieldReference(i, kp, refctx))
 	}
 	m.Fields = append(m.Fields, f)
 	if i+1 == len(kp.Path) {
@@ -800,69 +1938,297 @@ func (m *Map) ensureField(i int, kp *d2ast.KeyPath, refctx *RefContext, create b
 	f.Composite = &Map{
 		parent: f,
 	}
-	return f.Map().ensureField(i+1, kp, refctx, create, fa)
+	return f.Map().ensureField(i+1, kp, refctx, create, c, fa)
+}
+
+// DeleteEdge removes the first edge in m matching eid and returns it. The remaining parallel
+// edges are reindexed so an index refers to the same position as before the removal, e.g.
+// the former (a -> b)[1] is (a -> b)[0] after (a -> b)[0] is deleted.
+func (m *Map) DeleteEdge(eid *EdgeID) *Edge {
+	if eid == nil {
+		return nil
+	}
+
+	for i, e := range m.Edges {
+		if e.ID.Match(eid) {
+			m.Edges = append(m.Edges[:i], m.Edges[i+1:]...)
+			m.reindexEdges()
+			return e
+		}
+	}
+	return nil
+}
+
+// RemoveEdge removes e from the map holding it, m or a map nested within m, and reindexes the
+// remaining edges parallel to e so that e.g. (a -> b)[1] becomes (a -> b)[0] once
+// (a -> b)[0] is removed. It reports whether e was found.
+func (m *Map) RemoveEdge(e *Edge) bool {
+	pm := ParentMap(e)
+	within := false
+	for m2 := pm; m2 != nil; m2 = ParentMap(m2) {
+		if m2 == m {
+			within = true
+			break
+		}
+	}
+	if !within {
+		return false
+	}
+	for i, e2 := range pm.Edges {
+		if e2 == e {
+			pm.Edges = append(pm.Edges[:i], pm.Edges[i+1:]...)
+			pm.reindexEdges()
+			return true
+		}
+	}
+	return false
+}
+
+// reindexEdges renumbers the indexes of each group of parallel edges in m to 0..n-1 in
+// the order they appear in m.Edges.
+//
+// EdgeIDs are shared between copies of a map so an EdgeID is copied before its index is
+// changed.
+func (m *Map) reindexEdges() {
+	for i, e := range m.Edges {
+		index := 0
+		for _, e2 := range m.Edges[:i] {
+			if e2.ID.matchEndpoints(e.ID) {
+				index++
+			}
+		}
+		if e.ID.Index == nil || *e.ID.Index != index {
+			e.ID = e.ID.Copy()
+			e.ID.Index = &index
+		}
+	}
+}
+
+func (m *Map) DeleteField(ida ...string) *Field {
+	if len(ida) == 0 {
+		return nil
+	}
+
+	s := ida[0]
+	rest := ida[1:]
+
+	for i, f := range m.Fields {
+		if !strings.EqualFold(f.Name, s) {
+			continue
+		}
+		if len(rest) == 0 {
+			return m.deleteField(i)
+		}
+		if f.Map() != nil {
+			return f.Map().DeleteField(rest...)
+		}
+	}
+	return nil
+}
+
+// Nullify does to the field at path what compiling path: null in m does and returns the
+// removed field. The field is deleted with DeleteField, along with the edges declared with
+// it and the keyword holder left empty, except for a var which is kept with a null value so
+// that it still shadows vars of the same name in outer scopes. Unlike in source, the
+// ancestors of a missing field aren't created. It returns nil if nothing was removed.
+func (m *Map) Nullify(path []string) *Field {
+	f := m.GetField(path...)
+	if f == nil {
+		return nil
+	}
+	pm := ParentMap(f)
+	if IsVar(pm) {
+		f.Primary_ = &Scalar{
+			parent: f,
+			Value:  &d2ast.Null{},
+		}
+		return nil
+	}
+	return pm.DeleteField(f.Name)
+}
+
+// DeleteWhere removes every field of m and its descendants for which pred returns true
+// along with the edges declared with it, as DeleteField does, and returns how many fields
+// were removed. The fields within a removed field aren't passed to pred.
+func (m *Map) DeleteWhere(pred func(*Field) bool) int {
+	if m == nil {
+		return 0
+	}
+	n := 0
+	for i := 0; i < len(m.Fields); {
+		f := m.Fields[i]
+		if pred(f) {
+			m.deleteField(i)
+			n++
+			continue
+		}
+		n += f.Map().DeleteWhere(pred)
+		// f is gone if it was a keyword holder left empty.
+		if i < len(m.Fields) && m.Fields[i] == f {
+			i++
+		}
+	}
+	for _, e := range m.Edges {
+		n += e.Map_.DeleteWhere(pred)
+	}
+	return n
+}
+
+func (m *Map) deleteField(i int) *Field {
+	f := m.Fields[i]
+	for _, fr := range f.References {
+		for _, e := range m.Edges {
+			for _, er := range e.References {
+				if er.Context == fr.Context {
+					m.DeleteEdge(e.ID)
+					break
+				}
+			}
+		}
+	}
+	m.Fields = append(m.Fields[:i], m.Fields[i+1:]...)
+
+	// If a field was deleted from a keyword-holder keyword and that holder is empty,
+	// then that holder becomes meaningless and should be deleted too
+	parent := ParentField(f)
+	for keywordHolder := range d2graph.ReservedKeywordHolders {
+		if parent != nil && parent.Name == keywordHolder && len(parent.Map().Fields) == 0 {
+			keywordHolderParentMap := ParentMap(parent)
+			for i, f := range keywordHolderParentMap.Fields {
+				if f.Name == keywordHolder {
+					keywordHolderParentMap.Fields = append(keywordHolderParentMap.Fields[:i], keywordHolderParentMap.Fields[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return f
+}
+
+// Prune recursively removes reserved keyword fields like style and vars that are left
+// holding an empty map and no primary. User fields holding an empty map are kept as leaves
+// so that they remain in the diagram. Board roots are never pruned.
+func (m *Map) Prune() {
+	for i := 0; i < len(m.Fields); {
+		f := m.Fields[i]
+		if f.Map() != nil {
+			f.Map().Prune()
+		}
+		if f.Primary_ == nil && f.Map().empty() && NodeBoardKind(f) == "" {
+			if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+				m.Fields = append(m.Fields[:i], m.Fields[i+1:]...)
+				continue
+			}
+			f.Composite = nil
+		}
+		i++
+	}
+	for _, e := range m.Edges {
+		if e.Map_ != nil {
+			e.Map_.Prune()
+			if e.Map_.empty() {
+				e.Map_ = nil
+			}
+		}
+	}
 }
 
-func (m *Map) DeleteEdge(eid *EdgeID) *Edge {
-	if eid == nil {
+func (m *Map) empty() bool {
+	return m != nil && len(m.Fields) == 0 && len(m.Edges) == 0
+}
+
+// MatchEdges returns the edges of m and its descendants whose source matches srcPattern and
+// destination matches dstPattern, e.g. []string{"a*"} and []string{"*"} for a* -> *. Each
+// element of a pattern is a key path element, globs included, as it would be written in
+// a key. The ends are matched as by the glob edge keys of GetEdges, regardless of arrows,
+// and nothing is created. A pattern that doesn't parse matches nothing.
+func (m *Map) MatchEdges(srcPattern, dstPattern []string) []*Edge {
+	srcFA, ok := m.matchFields(srcPattern)
+	if !ok {
 		return nil
 	}
+	dstFA, ok := m.matchFields(dstPattern)
+	if !ok {
+		return nil
+	}
+	srcs := make(map[*Field]struct{}, len(srcFA))
+	for _, f := range srcFA {
+		srcs[f] = struct{}{}
+	}
+	dsts := make(map[*Field]struct{}, len(dstFA))
+	for _, f := range dstFA {
+		dsts[f] = struct{}{}
+	}
 
-	for i, e := range m.Edges {
-		if e.ID.Match(eid) {
-			m.Edges = append(m.Edges[:i], m.Edges[i+1:]...)
-			return e
+	var ea []*Edge
+	var matchEdges func(m *Map)
+	matchEdges = func(m *Map) {
+		for _, e := range m.Edges {
+			_, srcOK := srcs[m.GetField(e.ID.SrcPath...)]
+			_, dstOK := dsts[m.GetField(e.ID.DstPath...)]
+			if srcOK && dstOK {
+				ea = append(ea, e)
+			}
+		}
+		for _, f := range m.Fields {
+			if f.Map() != nil {
+				matchEdges(f.Map())
+			}
 		}
 	}
-	return nil
+	matchEdges(m)
+	return ea
 }
 
-func (m *Map) DeleteField(ida ...string) *Field {
-	if len(ida) == 0 {
-		return nil
+func (m *Map) matchFields(pattern []string) ([]*Field, bool) {
+	if len(pattern) == 0 {
+		return nil, false
 	}
-
-	s := ida[0]
-	rest := ida[1:]
-
-	for i, f := range m.Fields {
-		if !strings.EqualFold(f.Name, s) {
-			continue
+	kp := &d2ast.KeyPath{}
+	for _, s := range pattern {
+		kp2, err := d2parser.ParseKey(s)
+		if err != nil {
+			return nil, false
 		}
-		if len(rest) == 0 {
-			for _, fr := range f.References {
-				for _, e := range m.Edges {
-					for _, er := range e.References {
-						if er.Context == fr.Context {
-							m.DeleteEdge(e.ID)
-							break
-						}
-					}
-				}
-			}
-			m.Fields = append(m.Fields[:i], m.Fields[i+1:]...)
-
-			// If a field was deleted from a keyword-holder keyword and that holder is empty,
-			// then that holder becomes meaningless and should be deleted too
-			parent := ParentField(f)
-			for keywordHolder := range d2graph.ReservedKeywordHolders {
-				if parent != nil && parent.Name == keywordHolder && len(parent.Map().Fields) == 0 {
-					keywordHolderParentMap := ParentMap(parent)
-					for i, f := range keywordHolderParentMap.Fields {
-						if f.Name == keywordHolder {
-							keywordHolderParentMap.Fields = append(keywordHolderParentMap.Fields[:i], keywordHolderParentMap.Fields[i+1:]...)
-							break
-						}
-					}
+		kp.Path = append(kp.Path, kp2.Path...)
+	}
+	path := kp.Path
+	for path[0].Unbox().ScalarString() == "_" {
+		m = ParentMap(m)
+		if m == nil || len(path) == 1 {
+			return nil, false
+		}
+		path = path[1:]
+	}
+	var fa []*Field
+	m._matchFields(path, &fa)
+	return fa, true
+}
+
+// _matchFields appends the fields of m matching path to fa as EnsureField would find them
+// but only through existing maps so that nothing is modified.
+func (m *Map) _matchFields(path []*d2ast.StringBox, fa *[]*Field) {
+	var matches []*Field
+	us, ok := path[0].Unbox().(*d2ast.UnquotedString)
+	if ok && us.Pattern != nil {
+		matches, ok = m.doubleGlob(us.Pattern, nil)
+		if !ok {
+			for _, f := range m.Fields {
+				if matchPattern(f.Name, us.Pattern) {
+					matches = append(matches, f)
 				}
 			}
-			return f
 		}
-		if f.Map() != nil {
-			return f.Map().DeleteField(rest...)
+	} else if f := m.getField([]string{path[0].Unbox().ScalarString()}, false); f != nil {
+		matches = append(matches, f)
+	}
+	for _, f := range matches {
+		if len(path) == 1 {
+			*fa = append(*fa, f)
+		} else if f.Map() != nil {
+			f.Map()._matchFields(path[1:], fa)
 		}
 	}
-	return nil
 }
 
 func (m *Map) GetEdges(eid *EdgeID, refctx *RefContext) []*Edge {
@@ -920,7 +2286,7 @@ func (m *Map) getEdges(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 		}
 		for _, f := range fa {
 			if _, ok := f.Composite.(*Array); ok {
-				return d2parser.Errorf(refctx.Edge.Src, "cannot index into array")
+				return kindErrorf(ErrIndexIntoArray, refctx.Edge.Src, "cannot index into array")
 			}
 			if f.Map() == nil {
 				f.Composite = &Map{
@@ -959,18 +2325,21 @@ func (m *Map) getEdges(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 
 func (m *Map) CreateEdge(eid *EdgeID, refctx *RefContext) ([]*Edge, error) {
 	var ea []*Edge
-	return ea, m.createEdge(eid, refctx, &ea)
+	return ea, m.createEdge(eid, refctx, nil, &ea)
 }
 
-func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
+// createEdge is CreateEdge appending the edges it creates to ea. Their count is checked
+// against c's limits if c is non-nil.
+func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, c *compiler, ea *[]*Edge) error {
 	if ParentEdge(m) != nil {
 		return d2parser.Errorf(refctx.Edge, "cannot create edge inside edge")
 	}
 
 	eid, m, common, err := eid.resolve(m)
 	if err != nil {
-		return d2parser.Errorf(refctx.Edge, err.Error())
+		return kindErrorf(err, refctx.Edge, err.Error())
 	}
+	create := c == nil || !c.requireExistingEdgeEndpoints
 	if len(common) > 0 {
 		commonKP := d2ast.MakeKeyPath(common)
 		lastMatch := 0
@@ -983,20 +2352,23 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 				}
 			}
 		}
-		fa, err := m.EnsureField(commonKP, nil, true)
+		fa, err := m.ensureFieldPath(commonKP, nil, create, c)
 		if err != nil {
 			return err
 		}
+		if len(fa) == 0 && !create && !commonKP.HasGlob() {
+			return d2parser.Errorf(refctx.Edge.Src, "edge source %s does not exist", d2format.Format(refctx.Edge.Src))
+		}
 		for _, f := range fa {
 			if _, ok := f.Composite.(*Array); ok {
-				return d2parser.Errorf(refctx.Edge.Src, "cannot index into array")
+				return kindErrorf(ErrIndexIntoArray, refctx.Edge.Src, "cannot index into array")
 			}
 			if f.Map() == nil {
 				f.Composite = &Map{
 					parent: f,
 				}
 			}
-			err = f.Map().createEdge(eid, refctx, ea)
+			err = f.Map().createEdge(eid, refctx, c, ea)
 			if err != nil {
 				return err
 			}
@@ -1006,7 +2378,7 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 
 	ij := findProhibitedEdgeKeyword(eid.SrcPath...)
 	if ij != -1 {
-		return d2parser.Errorf(refctx.Edge.Src.Path[ij].Unbox(), "reserved keywords are prohibited in edges")
+		return kindErrorf(ErrReservedInEdge, refctx.Edge.Src.Path[ij].Unbox(), "reserved keywords are prohibited in edges")
 	}
 	ij = findBoardKeyword(eid.SrcPath...)
 	if ij == len(eid.SrcPath)-1 {
@@ -1015,24 +2387,45 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 
 	ij = findProhibitedEdgeKeyword(eid.DstPath...)
 	if ij != -1 {
-		return d2parser.Errorf(refctx.Edge.Dst.Path[ij].Unbox(), "reserved keywords are prohibited in edges")
+		return kindErrorf(ErrReservedInEdge, refctx.Edge.Dst.Path[ij].Unbox(), "reserved keywords are prohibited in edges")
 	}
 	ij = findBoardKeyword(eid.DstPath...)
 	if ij == len(eid.DstPath)-1 {
 		return d2parser.Errorf(refctx.Edge.Dst.Path[ij].Unbox(), "edge with board keyword alone doesn't make sense")
 	}
 
-	srcFA, err := refctx.ScopeMap.EnsureField(refctx.Edge.Src, refctx, true)
+	srcFA, err := refctx.ScopeMap.ensureFieldPath(refctx.Edge.Src, refctx, create, c)
 	if err != nil {
 		return err
 	}
-	dstFA, err := refctx.ScopeMap.EnsureField(refctx.Edge.Dst, refctx, true)
+	if len(srcFA) == 0 && !create && !refctx.Edge.Src.HasGlob() {
+		return d2parser.Errorf(refctx.Edge.Src, "edge source %s does not exist", d2format.Format(refctx.Edge.Src))
+	}
+	dstFA, err := refctx.ScopeMap.ensureFieldPath(refctx.Edge.Dst, refctx, create, c)
 	if err != nil {
 		return err
 	}
+	if len(dstFA) == 0 && !create && !refctx.Edge.Dst.HasGlob() {
+		return d2parser.Errorf(refctx.Edge.Dst, "edge destination %s does not exist", d2format.Format(refctx.Edge.Dst))
+	}
+
+	if c != nil && c.globEdgeThreshold > 0 && (refctx.Edge.Src.HasGlob() || refctx.Edge.Dst.HasGlob()) {
+		// Self edges and containers skipped by ** make this an upper bound.
+		projected := len(srcFA) * len(dstFA)
+		if projected > c.globEdgeThreshold {
+			err := d2parser.Errorf(refctx.Edge, "edge glob %s would create up to %d edges", d2format.Format(refctx.Edge), projected)
+			if c.strictGlobEdges {
+				return err
+			}
+			c.warn(err)
+		}
+	}
 
 	for _, src := range srcFA {
 		for _, dst := range dstFA {
+			if c != nil && c.stopped() {
+				return nil
+			}
 			if src == dst && (refctx.Edge.Src.HasGlob() || refctx.Edge.Dst.HasGlob()) {
 				// Globs do not make self edges.
 				continue
@@ -1043,7 +2436,7 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 				if src.Map().IsContainer() {
 					continue
 				}
-				if ParentBoard(src) != ParentBoard(dst) {
+				if !SameBoard(src, dst) {
 					continue
 				}
 			}
@@ -1052,7 +2445,7 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 				if dst.Map().IsContainer() {
 					continue
 				}
-				if ParentBoard(src) != ParentBoard(dst) {
+				if !SameBoard(src, dst) {
 					continue
 				}
 			}
@@ -1060,7 +2453,7 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 			eid2 := eid.Copy()
 			eid2.SrcPath = RelIDA(m, src)
 			eid2.DstPath = RelIDA(m, dst)
-			e, err := m.createEdge2(eid2, refctx, src, dst)
+			e, err := m.createEdge2(eid2, refctx, c, src, dst)
 			if err != nil {
 				return err
 			}
@@ -1070,23 +2463,24 @@ func (m *Map) createEdge(eid *EdgeID, refctx *RefContext, ea *[]*Edge) error {
 	return nil
 }
 
-func (m *Map) createEdge2(eid *EdgeID, refctx *RefContext, src, dst *Field) (*Edge, error) {
-	if NodeBoardKind(src) != "" {
-		return nil, d2parser.Errorf(refctx.Edge.Src, "cannot create edges between boards")
-	}
-	if NodeBoardKind(dst) != "" {
-		return nil, d2parser.Errorf(refctx.Edge.Dst, "cannot create edges between boards")
+func (m *Map) createEdge2(eid *EdgeID, refctx *RefContext, c *compiler, src, dst *Field) (*Edge, error) {
+	if c == nil || !c.interBoardEdges {
+		if NodeBoardKind(src) != "" {
+			return nil, d2parser.Errorf(refctx.Edge.Src, "cannot create edges between boards")
+		}
+		if NodeBoardKind(dst) != "" {
+			return nil, d2parser.Errorf(refctx.Edge.Dst, "cannot create edges between boards")
+		}
+		if !SameBoard(src, dst) {
+			return nil, d2parser.Errorf(refctx.Edge, "cannot create edges between boards")
+		}
 	}
-	if ParentBoard(src) != ParentBoard(dst) {
-		return nil, d2parser.Errorf(refctx.Edge, "cannot create edges between boards")
+	if c != nil {
+		if err := c.countEdge(refctx.Edge); err != nil {
+			return nil, err
+		}
 	}
 
-	eid.Index = nil
-	eid.Glob = true
-	ea := m.GetEdges(eid, nil)
-	index := len(ea)
-	eid.Index = &index
-	eid.Glob = false
 	e := &Edge{
 		parent: m,
 		ID:     eid,
@@ -1094,60 +2488,202 @@ func (m *Map) createEdge2(eid *EdgeID, refctx *RefContext, src, dst *Field) (*Ed
 			Context: refctx,
 		}},
 	}
-	m.Edges = append(m.Edges, e)
+	m.appendEdge(e)
+	if c != nil {
+		c.progress()
+	}
 
 	return e, nil
 }
 
+// appendEdge appends e to m, indexing it after the edges in m with the same endpoints and
+// arrows. An edge's index is thus the number of its parallel edges created before it which
+// when compiling is the order they appear in the source.
+//
+// m's lock is held so that edges added to m concurrently, e.g. by the builder API, are still
+// indexed 0..n-1. Edges are only ever appended to the map they're in so other maps, including
+// those of other compiles, aren't blocked.
+func (m *Map) appendEdge(e *Edge) {
+	m.edgesMu.Lock()
+	defer m.edgesMu.Unlock()
+
+	e.ID.Index = nil
+	e.ID.IndexEnd = nil
+	e.ID.Glob = true
+	index := len(m.GetEdges(e.ID, nil))
+	e.ID.Index = &index
+	e.ID.Glob = false
+	m.Edges = append(m.Edges, e)
+}
+
 func (s *Scalar) AST() d2ast.Node {
 	return s.Value
 }
 
 func (f *Field) AST() d2ast.Node {
+	return f.ast(astOpts{})
+}
+
+// astOpts controls how the IR is converted back into an AST.
+type astOpts struct {
+	// compact collapses fields whose only content is a single non-board child into a
+	// dotted key, e.g. a.b.c: x.
+	compact bool
+	// ordered orders the fields and edges of each map by where they're first declared.
+	ordered bool
+	// indexEdges keeps the index of parallel edges. As an indexed key cannot create an
+	// edge, each indexed edge is declared before its key so that the output compiles back
+	// to the same IR. AST leaves it unset as its consumers edit the returned AST as source.
+	indexEdges bool
+}
+
+func (f *Field) ast(opts astOpts) *d2ast.Key {
+	ida := []string{f.Name}
+	if opts.compact {
+		for f.collapsible() {
+			f = f.Map().Fields[0]
+			ida = append(ida, f.Name)
+		}
+	}
+
 	k := &d2ast.Key{
-		Key: &d2ast.KeyPath{
-			Path: []*d2ast.StringBox{
-				d2ast.MakeValueBox(d2ast.RawString(f.Name, true)).StringBox(),
-			},
-		},
+		Key: d2ast.MakeKeyPath(ida),
 	}
 
 	if f.Primary_ != nil {
 		k.Primary = d2ast.MakeValueBox(f.Primary_.AST().(d2ast.Value)).ScalarBox()
 	}
-	if f.Composite != nil {
+	if f.Map() != nil {
+		k.Value = d2ast.MakeValueBox(f.Map().ast(opts))
+	} else if f.Composite != nil {
 		k.Value = d2ast.MakeValueBox(f.Composite.AST().(d2ast.Value))
 	}
 
 	return k
 }
 
-func (e *Edge) AST() d2ast.Node {
-	astEdge := &d2ast.Edge{}
-
-	astEdge.Src = d2ast.MakeKeyPath(e.ID.SrcPath)
-	if e.ID.SrcArrow {
-		astEdge.SrcArrow = "<"
+func (f *Field) collapsible() bool {
+	if f.Primary_ != nil || f.Map() == nil || len(f.Map().Fields) != 1 || len(f.Map().Edges) != 0 {
+		return false
 	}
-	astEdge.Dst = d2ast.MakeKeyPath(e.ID.DstPath)
-	if e.ID.DstArrow {
-		astEdge.DstArrow = ">"
+	if _, ok := d2graph.BoardKeywords[f.Name]; ok {
+		return false
 	}
+	return NodeBoardKind(f) == ""
+}
+
+func (e *Edge) AST() d2ast.Node {
+	return e.ast(astOpts{indexEdges: true})
+}
 
+func (e *Edge) ast(opts astOpts) *d2ast.Key {
 	k := &d2ast.Key{
-		Edges: []*d2ast.Edge{astEdge},
+		Edges: []*d2ast.Edge{e.ID.astEdge()},
+	}
+	// The index is only needed to tell apart parallel edges.
+	if opts.indexEdges && e.ID.Index != nil && e.parallelCount() > 1 {
+		k.EdgeIndex = &d2ast.EdgeIndex{
+			Int: go2.Pointer(*e.ID.Index),
+		}
 	}
 
 	if e.Primary_ != nil {
 		k.Primary = d2ast.MakeValueBox(e.Primary_.AST().(d2ast.Value)).ScalarBox()
 	}
 	if e.Map_ != nil {
-		k.Value = d2ast.MakeValueBox(e.Map_.AST().(*d2ast.Map))
+		k.Value = d2ast.MakeValueBox(e.Map_.ast(opts))
 	}
 
 	return k
 }
 
+// Style returns the map of f's style field or nil if f has no style.
+func (f *Field) Style() *Map {
+	return styleMap(f)
+}
+
+// StyleValue returns the value of the style keyword key on f, e.g. fill or opacity, or nil
+// if it is unset or not a scalar.
+func (f *Field) StyleValue(key string) *Scalar {
+	return styleValue(f, key)
+}
+
+// Style returns the map of e's style field or nil if e has no style.
+func (e *Edge) Style() *Map {
+	return styleMap(e)
+}
+
+// StyleValue returns the value of the style keyword key on e, e.g. stroke or opacity, or
+// nil if it is unset or not a scalar.
+func (e *Edge) StyleValue(key string) *Scalar {
+	return styleValue(e, key)
+}
+
+func styleMap(n Node) *Map {
+	m := n.Map()
+	if m == nil {
+		return nil
+	}
+	return m.GetField("style").Map()
+}
+
+func styleValue(n Node, key string) *Scalar {
+	m := styleMap(n)
+	if m == nil {
+		return nil
+	}
+	f := m.GetField(key)
+	if f == nil {
+		return nil
+	}
+	return f.Primary()
+}
+
+// IsSelfLoop reports whether e connects a field to itself. Only explicit self loops like
+// a -> a exist as globs never create them.
+func (e *Edge) IsSelfLoop() bool {
+	return equalIDA(e.ID.SrcPath, e.ID.DstPath)
+}
+
+// SelfLoops returns every edge in m and its descendants that connects a field to itself.
+func (m *Map) SelfLoops() []*Edge {
+	var ea []*Edge
+	m.selfLoops(&ea)
+	return ea
+}
+
+func (m *Map) selfLoops(ea *[]*Edge) {
+	for _, f := range m.Fields {
+		if f.Map() != nil {
+			f.Map().selfLoops(ea)
+		}
+	}
+	for _, e := range m.Edges {
+		if e.IsSelfLoop() {
+			*ea = append(*ea, e)
+		}
+	}
+}
+
+// parallelCount returns the number of edges in e's map with the same endpoints and arrows
+// as e, including e.
+func (e *Edge) parallelCount() int {
+	m, ok := e.parent.(*Map)
+	if !ok {
+		return 1
+	}
+	eid := e.ID.Copy()
+	eid.Index = nil
+	eid.IndexEnd = nil
+	var n int
+	for _, e2 := range m.Edges {
+		if e2.ID.Match(eid) {
+			n++
+		}
+	}
+	return n
+}
+
 func (a *Array) AST() d2ast.Node {
 	if a == nil {
 		return nil
@@ -1163,21 +2699,101 @@ func (m *Map) AST() d2ast.Node {
 	if m == nil {
 		return nil
 	}
+	return m.ast(astOpts{})
+}
+
+// ASTOrdered is like AST but orders the fields and edges of each map by where they're first
+// declared in source, interleaving them as written rather than listing all fields before
+// all edges. Fields and edges created through globs or without a source range come last in
+// their usual order. Nodes declared in an imported file are ordered by their position in
+// that file.
+func (m *Map) ASTOrdered() d2ast.Node {
+	if m == nil {
+		return nil
+	}
+	return m.ast(astOpts{ordered: true})
+}
+
+func (m *Map) ast(opts astOpts) *d2ast.Map {
 	astMap := &d2ast.Map{}
 	if m.Root() {
 		astMap.Range = d2ast.MakeRange(",0:0:0-1:0:0")
 	} else {
 		astMap.Range = d2ast.MakeRange(",1:0:0-2:0:0")
 	}
+	type entry struct {
+		n     Node
+		nodes []d2ast.MapNodeBox
+	}
+	var entries []entry
 	for _, f := range m.Fields {
-		astMap.Nodes = append(astMap.Nodes, d2ast.MakeMapNodeBox(f.AST().(d2ast.MapNode)))
+		entries = append(entries, entry{f, []d2ast.MapNodeBox{d2ast.MakeMapNodeBox(f.ast(opts))}})
 	}
 	for _, e := range m.Edges {
-		astMap.Nodes = append(astMap.Nodes, d2ast.MakeMapNodeBox(e.AST().(d2ast.MapNode)))
+		en := entry{n: e}
+		k := e.ast(opts)
+		if k.EdgeIndex != nil {
+			// An indexed key cannot create an edge so declare it first.
+			en.nodes = append(en.nodes, d2ast.MakeMapNodeBox(&d2ast.Key{
+				Edges: k.Edges,
+			}))
+		}
+		if k.EdgeIndex == nil || k.Primary.Unbox() != nil || k.Value.Unbox() != nil {
+			en.nodes = append(en.nodes, d2ast.MakeMapNodeBox(k))
+		}
+		entries = append(entries, en)
+	}
+	if opts.ordered {
+		sort.SliceStable(entries, func(i, j int) bool {
+			p, ok := declaredPosition(entries[i].n)
+			if !ok {
+				return false
+			}
+			p2, ok := declaredPosition(entries[j].n)
+			return !ok || p.Before(p2)
+		})
+	}
+	for _, en := range entries {
+		astMap.Nodes = append(astMap.Nodes, en.nodes...)
 	}
 	return astMap
 }
 
+// declaredPosition returns the source position where the field or edge n was first
+// declared. It returns false if n was created through a glob or has no source range.
+func declaredPosition(n Node) (d2ast.Position, bool) {
+	switch n := n.(type) {
+	case *Field:
+		if len(n.References) == 0 || n.References[0].FromGlob || n.References[0].String == nil {
+			return d2ast.Position{}, false
+		}
+		r := n.References[0].String.GetRange()
+		return r.Start, hasRange(r)
+	case *Edge:
+		if len(n.References) == 0 || n.References[0].Context.Edge == nil {
+			return d2ast.Position{}, false
+		}
+		ae := n.References[0].Context.Edge
+		if ae.Src.HasGlob() || ae.Dst.HasGlob() {
+			return d2ast.Position{}, false
+		}
+		return ae.Range.Start, hasRange(ae.Range)
+	}
+	return d2ast.Position{}, false
+}
+
+// hasRange reports whether r is a source range rather than the zero range of a node
+// created programmatically.
+func hasRange(r d2ast.Range) bool {
+	return r.Path != "" || r.End != (d2ast.Position{})
+}
+
+// FormatCompact formats m as D2 source like String but collapses containers holding a
+// single field into dotted keys. Boards are never collapsed.
+func (m *Map) FormatCompact() string {
+	return d2format.Format(m.ast(astOpts{compact: true, indexEdges: true}))
+}
+
 func (m *Map) appendFieldReferences(i int, kp *d2ast.KeyPath, refctx *RefContext) {
 	sb := kp.Path[i]
 	f := m.GetField(sb.Unbox().ScalarString())
@@ -1185,11 +2801,7 @@ func (m *Map) appendFieldReferences(i int, kp *d2ast.KeyPath, refctx *RefContext
 		return
 	}
 
-	f.References = append(f.References, &FieldReference{
-		String:  sb.Unbox(),
-		KeyPath: kp,
-		Context: refctx,
-	})
+	f.References = append(f.References, newFieldReference(i, kp, refctx))
 	if i+1 == len(kp.Path) {
 		return
 	}
@@ -1256,6 +2868,113 @@ func ParentBoard(n Node) Node {
 	}
 }
 
+// SameBoard reports whether a and b are within the same board, i.e. have the same
+// ParentBoard. Only nodes in the same board may be connected by an edge.
+func SameBoard(a, b Node) bool {
+	return ParentBoard(a) == ParentBoard(b)
+}
+
+// CommonBoard returns the nearest board that contains both a and b, the ParentBoard of both
+// if they're in the same board, or nil if they aren't in the same tree.
+func CommonBoard(a, b Node) Node {
+	boards := make(map[Node]struct{})
+	for board := ParentBoard(a); board != nil; board = ParentBoard(board) {
+		boards[board] = struct{}{}
+	}
+	for board := ParentBoard(b); board != nil; board = ParentBoard(board) {
+		if _, ok := boards[board]; ok {
+			return board
+		}
+	}
+	return nil
+}
+
+// BoardOf is like ParentBoard but also returns the kind and name of the board, the name
+// being that of the board's field. The root board is a layer named "root".
+func BoardOf(n Node) (node Node, kind BoardKind, name string) {
+	for n = n.Parent(); n != nil; n = n.Parent() {
+		kind = NodeBoardKind(n)
+		if kind == "" {
+			continue
+		}
+		f, ok := n.(*Field)
+		if !ok {
+			f = ParentField(n)
+		}
+		return n, kind, f.Name
+	}
+	return nil, "", ""
+}
+
+// boardBase returns the map of the board that the scenario or step f inherits from. A
+// scenario inherits from its parent board and a step from the step before it or from its
+// parent board if it's the first step. It returns nil for any other field.
+func boardBase(f *Field) *Map {
+	switch NodeBoardKind(f) {
+	case BoardScenario:
+		return ParentBoard(f).Map()
+	case BoardStep:
+		if prev := f.PreviousStep(); prev != nil {
+			return prev.Map()
+		}
+		return ParentBoard(f).Map()
+	}
+	return nil
+}
+
+// Steps returns the steps of the board m in the order they build on each other, which is
+// the order they're first declared in.
+func (m *Map) Steps() []*Field {
+	f := m.GetField("steps")
+	if f == nil || f.Map() == nil {
+		return nil
+	}
+	return append([]*Field(nil), f.Map().Fields...)
+}
+
+// PreviousStep returns the step that the step f builds on or nil if f is the first step,
+// which builds on the board holding the steps, or isn't a step.
+func (f *Field) PreviousStep() *Field {
+	if NodeBoardKind(f) != BoardStep {
+		return nil
+	}
+	stepsMap := ParentMap(f)
+	for i := range stepsMap.Fields {
+		if stepsMap.Fields[i] == f && i > 0 {
+			return stepsMap.Fields[i-1]
+		}
+	}
+	return nil
+}
+
+// GetFieldInherited is like GetField but if the field isn't found and m is within a
+// scenario or step, it's looked up at the same path in the board m inherits from and so on.
+// Scenarios and steps are compiled with a copy of the base board as it was when they were
+// declared so this finds base fields declared after them. It stops at layers as layers do
+// not inherit.
+func (m *Map) GetFieldInherited(ida ...string) *Field {
+	if f := m.GetField(ida...); f != nil {
+		return f
+	}
+
+	var boardIDA []string
+	board := m
+	for NodeBoardKind(board) == "" {
+		f, ok := board.parent.(*Field)
+		if !ok {
+			// Edge maps have no path to look up in the base board.
+			return nil
+		}
+		boardIDA = append([]string{f.Name}, boardIDA...)
+		board = ParentMap(f)
+	}
+	base := boardBase(ParentField(board))
+	if base == nil {
+		return nil
+	}
+	return base.GetFieldInherited(append(boardIDA, ida...)...)
+}
+
 func ParentEdge(n Node) *Edge {
 	for {
 		n = n.Parent()
@@ -1268,6 +2987,14 @@ func ParentEdge(n Node) *Edge {
 	}
 }
 
+// InEdge returns the edge whose map f is within, e.g. the edge of fill in
+// (a -> b)[0].style.fill, as opposed to a field of a node like a.style.fill. It's the field
+// analog of FieldReference.InEdge.
+func (f *Field) InEdge() (*Edge, bool) {
+	e := ParentEdge(f)
+	return e, e != nil
+}
+
 func countUnderscores(p []string) int {
 	for i, el := range p {
 		if el != "_" {
@@ -1322,6 +3049,76 @@ func parentPrimaryKey(n Node) *d2ast.Key {
 	return nil
 }
 
+// Ancestors returns the fields containing f from its parent up to but excluding the root of
+// its board, so that their names are those of BoardIDA(f) before f's, innermost first. The
+// ancestors of a field within an edge are the fields containing the edge.
+func (f *Field) Ancestors() []*Field {
+	return ancestors(f)
+}
+
+// AncestorsReversed is like Ancestors but outermost first.
+func (f *Field) AncestorsReversed() []*Field {
+	return reverseFields(ancestors(f))
+}
+
+// WalkPath calls fn with every field and edge of m and its descendants in order, parents
+// before their children, along with their path relative to m: that of IDA for fields and
+// that of the map holding them for edges. Children of n are skipped if fn returns false.
+//
+// The path is maintained as the walk descends rather than computed per node so path is
+// reused between calls. Copy it to retain it.
+func (m *Map) WalkPath(fn func(path []string, n Node) bool) {
+	m.walkPath(make([]string, 0, 8), fn)
+}
+
+func (m *Map) walkPath(path []string, fn func(path []string, n Node) bool) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		fpath := append(path, f.Name)
+		if fn(fpath, f) {
+			f.Map().walkPath(fpath, fn)
+		}
+	}
+	for _, e := range m.Edges {
+		if fn(path, e) {
+			e.Map_.walkPath(path, fn)
+		}
+	}
+}
+
+// ScopePath returns the absolute path of the map holding e, the longest common path of its
+// ends, e.g. a.b for both a.b: { x -> y } and a.b.x -> a.b.y. Maps within arrays have no
+// path of their own so for those it's the path of the field holding the array.
+func (e *Edge) ScopePath() []string {
+	return IDA(ParentMap(e))[1:]
+}
+
+// Ancestors returns the fields containing e, innermost first. See Field.Ancestors.
+func (e *Edge) Ancestors() []*Field {
+	return ancestors(e)
+}
+
+// AncestorsReversed is like Ancestors but outermost first.
+func (e *Edge) AncestorsReversed() []*Field {
+	return reverseFields(ancestors(e))
+}
+
+func ancestors(n Node) (fa []*Field) {
+	for f := ParentField(n); f != nil && NodeBoardKind(f) == ""; f = ParentField(f) {
+		fa = append(fa, f)
+	}
+	return fa
+}
+
+func reverseFields(fa []*Field) []*Field {
+	for i := 0; i < len(fa)/2; i++ {
+		fa[i], fa[len(fa)-i-1] = fa[len(fa)-i-1], fa[i]
+	}
+	return fa
+}
+
 // BoardIDA returns the absolute path to n from the nearest board root.
 func BoardIDA(n Node) (ida []string) {
 	for {
@@ -1362,6 +3159,36 @@ func IDA(n Node) (ida []string) {
 	}
 }
 
+// Path returns the absolute path to n as it would be written in a key, e.g.
+// shared.(animate -> animal)[0].style.fill. Values within arrays are suffixed with their
+// index, e.g. x.class[1]. Maps and primary scalars have the path of their field or edge.
+// The path of the root is the empty string.
+func Path(n Node) string {
+	var segs []string
+	var index string
+	for ; n != nil; n = n.Parent() {
+		if a, ok := n.Parent().(*Array); ok {
+			for i, v := range a.Values {
+				if v == n {
+					index = fmt.Sprintf("[%d]", i)
+					break
+				}
+			}
+		}
+		switch n := n.(type) {
+		case *Field:
+			if !n.Root() {
+				segs = append(segs, d2format.Format(d2ast.MakeKeyPath([]string{n.Name}))+index)
+				index = ""
+			}
+		case *Edge:
+			segs = append(segs, n.ID.String())
+		}
+	}
+	reverseIDA(segs)
+	return strings.Join(segs, ".")
+}
+
 // RelIDA returns the path to n relative to p.
 func RelIDA(p, n Node) (ida []string) {
 	for {
@@ -1396,7 +3223,15 @@ func (f *Field) Equal(n2 Node) bool {
 	if f.Name != f2.Name {
 		return false
 	}
-	if !f.Primary_.Equal(f2.Primary_) {
+	if !scalarEqual(f.Primary_, f2.Primary_) {
+		return false
+	}
+	if f.Composite == nil || f2.Composite == nil {
+		return f.Composite == nil && f2.Composite == nil
+	}
+	_, isArray := f.Composite.(*Array)
+	_, isArray2 := f2.Composite.(*Array)
+	if isArray != isArray2 {
 		return false
 	}
 	if !f.Composite.Equal(f2.Composite) {
@@ -1411,15 +3246,25 @@ func (e *Edge) Equal(n2 Node) bool {
 	if !e.ID.Match(e2.ID) {
 		return false
 	}
-	if !e.Primary_.Equal(e2.Primary_) {
+	if !scalarEqual(e.Primary_, e2.Primary_) {
 		return false
 	}
+	if e.Map_ == nil || e2.Map_ == nil {
+		return e.Map_ == nil && e2.Map_ == nil
+	}
 	if !e.Map_.Equal(e2.Map_) {
 		return false
 	}
 	return true
 }
 
+func scalarEqual(s1, s2 *Scalar) bool {
+	if s1 == nil || s2 == nil {
+		return s1 == s2
+	}
+	return s1.Equal(s2)
+}
+
 func (a *Array) Equal(n2 Node) bool {
 	a2 := n2.(*Array)
 
@@ -1,14 +1,39 @@
 package d2ir_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"oss.terrastruct.com/util-go/assert"
 
 	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
 	"oss.terrastruct.com/d2/d2ir"
+	"oss.terrastruct.com/d2/d2parser"
 )
 
+// mustCompile compiles text without comparing against testdata. It's for tests of the
+// query and mutation API where the compiled tree itself is already covered by TestCompile.
+func mustCompile(t testing.TB, text string) *d2ir.Map {
+	t.Helper()
+	return mustCompileOpts(t, text, nil)
+}
+
+func mustCompileOpts(t testing.TB, text string, opts *d2ir.CompileOptions) *d2ir.Map {
+	t.Helper()
+
+	ast, err := d2parser.Parse(t.Name()+".d2", strings.NewReader(text), nil)
+	assert.Success(t, err)
+	m, err := d2ir.Compile(ast, opts)
+	assert.Success(t, err)
+	return m
+}
+
 func TestCopy(t *testing.T) {
 	t.Parallel()
 
@@ -67,3 +92,2074 @@ func TestCopy(t *testing.T) {
 	assert.Equal(t, m.Edges[0].Map_, m.Edges[0].Map_.Fields[0].Parent())
 	assert.Equal(t, m.Edges[0].Map_.Fields[0], m.Edges[0].Map_.Fields[0].Primary_.Parent())
 }
+
+func TestFormatCompact(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b: {
+    c: x
+  }
+}
+"quoted key": {
+  style: {
+    fill: red
+  }
+}
+d -> e: {
+  style: {
+    stroke: blue
+  }
+}
+layers: {
+  l: {
+    n: {
+      o
+    }
+  }
+}
+`)
+	s := m.FormatCompact()
+	assert.String(t, `a.b.c: x
+quoted key.style.fill: red
+d
+e
+d -> e: {
+  style.stroke: blue
+}
+layers: {
+  l: {
+    n.o
+  }
+}
+`, s)
+
+	m2 := mustCompile(t, s)
+	assert.True(t, m.Equal(m2))
+}
+
+func TestASTOrdered(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+a -> b
+c: {
+  x -> y
+  z
+  x.label: hi
+}
+b -> c
+d
+*.style.fill: red
+`)
+	assert.String(t, `a: {
+  style: {
+    fill: red
+  }
+}
+a -> b
+b: {
+  style: {
+    fill: red
+  }
+}
+c: {
+  x: {
+    label: hi
+  }
+  x -> y
+  y
+  z
+  style: {
+    fill: red
+  }
+}
+b -> c
+d: {
+  style: {
+    fill: red
+  }
+}
+`, d2format.Format(m.ASTOrdered()))
+
+	// AST lists every field before the edges.
+	s := d2format.Format(m.AST())
+	assert.True(t, strings.Index(s, "a -> b") > strings.Index(s, "\nd: {"))
+}
+
+func TestEdgeIndexRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+a -> b
+(a -> b)[0].style.stroke: red
+(a -> b)[1].style.stroke: green
+(a -> b)[2].style.stroke: blue
+c -> d
+`)
+	assert.String(t, `a
+b
+c
+d
+a -> b
+(a -> b)[0]: {
+  style: {
+    stroke: red
+  }
+}
+a -> b
+(a -> b)[1]: {
+  style: {
+    stroke: green
+  }
+}
+a -> b
+(a -> b)[2]: {
+  style: {
+    stroke: blue
+  }
+}
+c -> d
+`, m.String())
+
+	m2 := mustCompile(t, m.String())
+	for i, stroke := range []string{"red", "green", "blue"} {
+		n, err := m2.Query(fmt.Sprintf("(a -> b)[%d].style.stroke", i))
+		assert.Success(t, err)
+		assert.Equal(t, stroke, n.Primary().Value.ScalarString())
+	}
+	assert.True(t, m.Equal(m2))
+
+	// AST is edited as source by d2oracle so it keeps one unindexed key per edge.
+	assert.Equal(t, 8, len(m.AST().(*d2ast.Map).Nodes))
+	for _, n := range m.AST().(*d2ast.Map).Nodes {
+		assert.True(t, n.MapKey.EdgeIndex == nil)
+	}
+	assert.String(t, `(a -> b)[1]: {
+  style: {
+    stroke: green
+  }
+}`, d2format.Format(m.Edges[1].AST()))
+}
+
+func TestBidirectional(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a <-> b
+a <-> b: {
+  style.stroke: red
+}
+a -> b
+`)
+	assert.Equal(t, 3, len(m.Edges))
+	assert.True(t, m.Edges[0].ID.Bidirectional())
+	assert.False(t, m.Edges[2].ID.Bidirectional())
+	assert.String(t, `(a <-> b)[1]`, m.Edges[1].ID.String())
+	assert.String(t, `(a -> b)[0]`, m.Edges[2].ID.String())
+
+	eid := d2ir.NewBidirectionalEdgeID([]string{"a"}, []string{"b"})
+	assert.True(t, eid.Bidirectional())
+	assert.String(t, `a <-> b`, eid.String())
+	assert.Equal(t, 2, len(m.GetEdges(eid, nil)))
+
+	m2 := mustCompile(t, m.String())
+	assert.True(t, m2.Equal(m))
+	assert.True(t, m2.Edges[1].ID.Bidirectional())
+}
+
+func TestEdgeIDNormalize(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `b -- a
+a -- b
+B.c <-> a
+a <-> b.c
+b -> a
+a -> b
+`)
+	assert.String(t, `(a -- b)[0]`, m.Edges[0].ID.Normalize().String())
+	assert.String(t, `(b -- a)[0]`, m.Edges[0].ID.String())
+	assert.String(t, `(a <-> b.c)[0]`, m.Edges[2].ID.Normalize().String())
+	assert.String(t, `(b -> a)[0]`, m.Edges[4].ID.Normalize().String())
+
+	assert.True(t, m.Edges[0].ID.MatchUndirected(m.Edges[1].ID))
+	assert.True(t, m.Edges[2].ID.MatchUndirected(m.Edges[3].ID))
+	assert.False(t, m.Edges[0].ID.MatchUndirected(m.Edges[2].ID))
+	assert.False(t, m.Edges[4].ID.MatchUndirected(m.Edges[5].ID))
+	assert.False(t, m.Edges[0].ID.Match(m.Edges[1].ID))
+}
+
+func TestParseEdgeID(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b -> c
+a.b -> c
+"x.y" <-> z
+p -- q
+x: {
+  a -> b
+}
+`)
+	for _, e := range m.Edges {
+		eid, err := d2ir.ParseEdgeID(e.ID.String())
+		assert.Success(t, err)
+		assert.String(t, e.ID.String(), eid.String())
+		ea := m.GetEdges(eid, nil)
+		assert.Equal(t, 1, len(ea))
+		assert.True(t, ea[0] == e)
+	}
+
+	eid, err := d2ir.ParseEdgeID(`(a.b -> c)[*]`)
+	assert.Success(t, err)
+	assert.True(t, eid.Glob)
+	assert.Equal(t, 2, len(m.GetEdges(eid, nil)))
+
+	eid, err = d2ir.ParseEdgeID(`x.(a -> b)[0]`)
+	assert.Success(t, err)
+	assert.String(t, `(x.a -> x.b)[0]`, eid.String())
+	assert.Equal(t, 1, len(m.GetEdges(eid, nil)))
+
+	eid, err = d2ir.ParseEdgeID(`"x.y" <-> z`)
+	assert.Success(t, err)
+	assert.Equal(t, "x.y", eid.SrcPath[0])
+	assert.True(t, eid.Index == nil)
+
+	for _, s := range []string{
+		`a.b`,
+		`a -> b -> c`,
+		`(a -> b)[0]: hi`,
+		`(a -> b)[0].style.fill`,
+		`(a -> `,
+	} {
+		_, err := d2ir.ParseEdgeID(s)
+		assert.Error(t, err)
+	}
+}
+
+func TestScalarAccessors(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `vars: {
+  int: 42
+  neg: -7
+  float: 1.5
+  t: true
+  f: false
+  str: "42"
+  nil: null
+}
+`)
+	scalar := func(name string) *d2ir.Scalar {
+		t.Helper()
+		f := m.GetField("vars", name)
+		assert.True(t, f != nil)
+		return f.Primary()
+	}
+
+	i, ok := scalar("int").Int()
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), i)
+	i, ok = scalar("neg").Int()
+	assert.True(t, ok)
+	assert.Equal(t, int64(-7), i)
+	_, ok = scalar("float").Int()
+	assert.False(t, ok)
+	_, ok = scalar("str").Int()
+	assert.False(t, ok)
+
+	fl, ok := scalar("float").Float()
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, fl)
+	fl, ok = scalar("int").Float()
+	assert.True(t, ok)
+	assert.Equal(t, 42.0, fl)
+	_, ok = scalar("t").Float()
+	assert.False(t, ok)
+
+	b, ok := scalar("t").Bool()
+	assert.True(t, ok)
+	assert.True(t, b)
+	b, ok = scalar("f").Bool()
+	assert.True(t, ok)
+	assert.False(t, b)
+	_, ok = scalar("str").Bool()
+	assert.False(t, ok)
+
+	assert.True(t, scalar("nil").IsNull())
+	assert.False(t, scalar("int").IsNull())
+	assert.String(t, "42", scalar("str").Value.ScalarString())
+}
+
+func TestFieldKind(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `vars: {
+  style: red
+}
+classes: {
+  c: {
+    style.fill: red
+  }
+}
+a: {
+  b
+  shape: circle
+  style.fill: red
+  label: {
+    near: top-left
+  }
+}
+x.shape: square
+layers: {
+  l: {
+    y
+  }
+}
+`)
+	for _, tc := range []struct {
+		path []string
+		exp  d2ir.FieldKind
+	}{
+		{[]string{"vars"}, d2ir.FieldKeywordHolder},
+		{[]string{"vars", "style"}, d2ir.FieldVar},
+		{[]string{"classes"}, d2ir.FieldKeywordHolder},
+		{[]string{"classes", "c"}, d2ir.FieldClassDef},
+		{[]string{"classes", "c", "style"}, d2ir.FieldKeywordHolder},
+		{[]string{"a"}, d2ir.FieldContainer},
+		{[]string{"a", "b"}, d2ir.FieldLeaf},
+		{[]string{"a", "shape"}, d2ir.FieldReservedKeyword},
+		{[]string{"a", "style"}, d2ir.FieldKeywordHolder},
+		{[]string{"a", "style", "fill"}, d2ir.FieldReservedKeyword},
+		{[]string{"a", "label"}, d2ir.FieldKeywordHolder},
+		{[]string{"x"}, d2ir.FieldLeaf},
+		{[]string{"layers"}, d2ir.FieldKeywordHolder},
+		{[]string{"layers", "l"}, d2ir.FieldBoard},
+		{[]string{"layers", "l", "y"}, d2ir.FieldLeaf},
+	} {
+		f := m.GetField(tc.path...)
+		assert.True(t, f != nil)
+		assert.Equal(t, tc.exp, f.Kind())
+	}
+}
+
+func TestCountByKind(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  big.style.font-size: 30
+}
+a: {
+  b -> c
+}
+d.class: big
+a.b -> d: {style.stroke: red}
+layers: {
+  l: {
+    x
+  }
+}
+`)
+	fields, edges := m.CountByKind()
+	assert.Equal(t, 2, edges)
+	assert.Equal(t, edges, m.EdgeCountRecursive())
+	// Layer l inherits the root classes so big is counted twice.
+	assert.JSON(t, map[d2ir.FieldKind]int{
+		d2ir.FieldBoard:           1,
+		d2ir.FieldClassDef:        2,
+		d2ir.FieldContainer:       1,
+		d2ir.FieldKeywordHolder:   6,
+		d2ir.FieldLeaf:            4,
+		d2ir.FieldReservedKeyword: 4,
+	}, fields)
+}
+
+func TestStyle(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.style.fill: red
+b
+c.style.stroke: blue
+*.style.stroke: green
+a -> b: {style.stroke-dash: 3}
+(* -> *)[*].style.opacity: 0.4
+`)
+	a := m.GetField("a")
+	assert.Equal(t, "red", a.StyleValue("fill").String())
+	assert.Equal(t, "green", a.StyleValue("stroke").String())
+	assert.Equal(t, "green", m.GetField("c").StyleValue("stroke").String())
+	assert.Equal(t, 2, len(a.Style().Fields))
+	assert.Equal(t, true, a.StyleValue("opacity") == nil)
+
+	b := m.GetField("b")
+	assert.Equal(t, "green", b.StyleValue("stroke").String())
+	assert.Equal(t, true, b.StyleValue("fill") == nil)
+
+	e := m.Edges[0]
+	assert.Equal(t, "3", e.StyleValue("stroke-dash").String())
+	assert.Equal(t, "0.4", e.StyleValue("opacity").String())
+	assert.Equal(t, true, e.StyleValue("fill") == nil)
+
+	m = mustCompile(t, `a
+a -> b`)
+	assert.Equal(t, true, m.GetField("a").Style() == nil)
+	assert.Equal(t, true, m.GetField("a").StyleValue("fill") == nil)
+	assert.Equal(t, true, m.Edges[0].Style() == nil)
+	assert.Equal(t, true, m.Edges[0].StyleValue("stroke") == nil)
+}
+
+func TestUserFields(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  style.fill: red
+  b
+  label: hi
+}
+"style": {
+  fill: blue
+}
+c
+`)
+	fa := m.UserFields()
+	assert.Equal(t, 2, len(fa))
+	assert.Equal(t, "a", fa[0].Name)
+	assert.Equal(t, "c", fa[1].Name)
+	assert.Equal(t, 1, len(m.GetField("a").Map().UserFields()))
+	assert.Equal(t, 0, len(m.GetField("c").Map().UserFields()))
+
+	assert.True(t, m.GetUserField("a", "b") == m.GetField("a", "b"))
+	assert.True(t, m.GetField("a", "style", "fill") != nil)
+	assert.True(t, m.GetUserField("a", "style", "fill") == nil)
+	assert.True(t, m.GetUserField("a", "label") == nil)
+	// A quoted style is still the keyword.
+	assert.True(t, m.GetField("style") != nil)
+	assert.True(t, m.GetUserField("style") == nil)
+	assert.True(t, m.GetUserField("Style") == nil)
+}
+
+func TestOrphanFields(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+c.style.fill: red
+d
+x: {
+  y -> z
+  w
+}
+x.y -> d
+layers: {
+  l: {
+    q
+  }
+}
+`)
+	fa := m.OrphanFields()
+	assert.Equal(t, 2, len(fa))
+	assert.True(t, fa[0] == m.GetField("c"))
+	assert.True(t, fa[1] == m.GetField("x", "w"))
+}
+
+func TestUsedReservedKeywords(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `vars: {
+  color: red
+}
+classes: {
+  c.style.fill: red
+}
+a.shape: circle
+a.style.fill: ${color}
+b.style: {
+  stroke: red
+  fill: blue
+}
+a -> b: {
+  style.stroke-width: 2
+}
+`)
+	assert.JSON(t, map[string]int{
+		"vars":         1,
+		"classes":      1,
+		"shape":        1,
+		"style":        4,
+		"fill":         3,
+		"stroke":       1,
+		"stroke-width": 1,
+	}, m.UsedReservedKeywords())
+}
+
+func TestFieldCount(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  style.fill: red
+  shape: circle
+  b
+  c: {
+    d
+  }
+  b -> c
+  c -> b
+}
+x.style.fill: red
+`)
+	assert.Equal(t, 2, m.FieldCount())
+	assert.Equal(t, 0, m.EdgeCount())
+	assert.Equal(t, 2, m.GetField("a").Map().FieldCount())
+	assert.Equal(t, 2, m.GetField("a").Map().EdgeCount())
+	assert.Equal(t, 0, m.GetField("x").Map().FieldCount())
+	assert.False(t, m.GetField("x").Map().IsContainer())
+	assert.Equal(t, 0, m.GetField("a", "b").Map().FieldCount())
+}
+
+func TestOwnFieldCount(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b: {
+  style.stroke: red
+}
+c: {
+  d
+}
+scenarios: {
+  s: {
+    e -> a
+  }
+}
+`)
+	assert.Equal(t, 6, m.OwnFieldCount())
+	assert.Equal(t, 1, m.OwnEdgeCount())
+	assert.Equal(t, 15, m.FieldCountRecursive())
+	assert.Equal(t, 3, m.EdgeCountRecursive())
+
+	s := m.GetField("scenarios", "s").Map()
+	assert.Equal(t, 7, s.OwnFieldCount())
+	assert.Equal(t, 2, s.OwnEdgeCount())
+}
+
+func TestTrimEmptyBoards(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+classes.c.style.fill: red
+scenarios: {
+  empty: {}
+  same: {
+    a
+  }
+  changed: {
+    a.style.fill: red
+  }
+  nested: {
+    steps: {
+      s1: {}
+    }
+  }
+}
+layers: {
+  l: {}
+  m: {
+    x
+  }
+}
+`)
+	assert.Equal(t, 5, m.TrimEmptyBoards())
+	assert.Equal(t, 0, m.TrimEmptyBoards())
+
+	var boards []string
+	for _, f := range m.GetField("scenarios").Map().Fields {
+		boards = append(boards, f.Name)
+	}
+	for _, f := range m.GetField("layers").Map().Fields {
+		boards = append(boards, f.Name)
+	}
+	assert.JSON(t, []string{"changed", "m"}, boards)
+	assert.Equal(t, 1, len(m.Edges))
+
+	m = mustCompile(t, `a
+scenarios.x: {}
+`)
+	assert.Equal(t, 1, m.TrimEmptyBoards())
+	assert.Equal(t, (*d2ir.Field)(nil), m.GetField("scenarios"))
+}
+
+func TestAncestors(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b.(c -> d)
+a.b.(c -> d)[0].style.fill: red
+layers: {
+  l: {
+    x.y.z
+  }
+}
+`)
+	names := func(fa []*d2ir.Field) []string {
+		var acc []string
+		for _, f := range fa {
+			acc = append(acc, f.Name)
+		}
+		return acc
+	}
+
+	c := m.GetField("a", "b", "c")
+	assert.JSON(t, []string{"b", "a"}, names(c.Ancestors()))
+	assert.JSON(t, []string{"a", "b"}, names(c.AncestorsReversed()))
+	assert.Equal(t, 0, len(m.GetField("a").Ancestors()))
+
+	e := m.GetField("a", "b").Map().Edges[0]
+	assert.JSON(t, []string{"b", "a"}, names(e.Ancestors()))
+	assert.JSON(t, []string{"style", "b", "a"}, names(e.Map().GetField("style", "fill").Ancestors()))
+
+	z := m.GetField("layers", "l", "x", "y", "z")
+	assert.JSON(t, []string{"y", "x"}, names(z.Ancestors()))
+	assert.JSON(t, d2ir.BoardIDA(z), append(names(z.AncestorsReversed()), "z"))
+}
+
+func TestScopePath(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b: {
+  x -> y
+}
+a.b.z -> a.b.x
+p -> a.q
+layers: {
+  l: {
+    m.n -> m.o
+  }
+}
+arr: [{s -> t}]
+`)
+	ab := m.GetField("a", "b").Map()
+	assert.Equal(t, 2, len(ab.Edges))
+	assert.JSON(t, []string{"a", "b"}, ab.Edges[0].ScopePath())
+	assert.JSON(t, []string{"a", "b"}, ab.Edges[1].ScopePath())
+	assert.Equal(t, 0, len(m.Edges[0].ScopePath()))
+	assert.JSON(t, []string{"layers", "l", "m"}, m.GetField("layers", "l", "m").Map().Edges[0].ScopePath())
+	arr := m.GetField("arr").Composite.(*d2ir.Array)
+	assert.JSON(t, []string{"arr"}, arr.Values[0].(*d2ir.Map).Edges[0].ScopePath())
+}
+
+func TestWalkPath(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b -> a.c: {
+  style.stroke: red
+}
+x: {
+  y
+}
+`)
+	var got []string
+	m.WalkPath(func(path []string, n d2ir.Node) bool {
+		s := strings.Join(path, ".")
+		if e, ok := n.(*d2ir.Edge); ok {
+			s += " " + e.ID.String()
+		} else {
+			assert.JSON(t, d2ir.IDA(n)[1:], path)
+		}
+		got = append(got, s)
+		return s != "x"
+	})
+	assert.JSON(t, []string{
+		"a",
+		"a.b",
+		"a.c",
+		"a (b -> c)[0]",
+		"a.style",
+		"a.style.stroke",
+		"x",
+	}, got)
+}
+
+func BenchmarkWalkPath(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&sb, "a%d.b.c.d.e.f.g.h -> a%d.b.c.d.e.f.g.i\n", i, i)
+	}
+	m := mustCompile(b, sb.String())
+
+	b.Run("WalkPath", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n := 0
+			m.WalkPath(func(path []string, _ d2ir.Node) bool {
+				n += len(path)
+				return true
+			})
+		}
+	})
+	b.Run("IDA", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n := 0
+			m.WalkPath(func(_ []string, node d2ir.Node) bool {
+				n += len(d2ir.IDA(node))
+				return true
+			})
+		}
+	})
+}
+
+func TestSteps(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+steps: {
+  one: {
+    b
+  }
+  two: {
+    c
+  }
+}
+steps.three: {
+  d
+}
+layers.l: {
+  x
+}
+`)
+	steps := m.Steps()
+	assert.Equal(t, 3, len(steps))
+	assert.Equal(t, "one", steps[0].Name)
+	assert.Equal(t, "two", steps[1].Name)
+	assert.Equal(t, "three", steps[2].Name)
+
+	assert.True(t, steps[0].PreviousStep() == nil)
+	assert.True(t, steps[1].PreviousStep() == steps[0])
+	assert.True(t, steps[2].PreviousStep() == steps[1])
+	// Each step has the content of the steps before it.
+	assert.True(t, steps[2].Map().GetField("b") != nil)
+	assert.True(t, steps[2].Map().GetField("c") != nil)
+
+	assert.True(t, m.GetField("a").PreviousStep() == nil)
+	assert.True(t, m.GetField("layers", "l").PreviousStep() == nil)
+	assert.Equal(t, 0, len(m.GetField("layers", "l").Map().Steps()))
+}
+
+func TestGetFieldInherited(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `scenarios: {
+  s: {
+    x: {
+      z
+    }
+  }
+}
+steps: {
+  1: {
+    c
+  }
+  2: {
+    d
+  }
+}
+layers: {
+  l: {
+    e
+  }
+}
+a
+x.y
+`)
+	s := m.GetField("scenarios", "s").Map()
+	assert.True(t, s.GetField("a") == nil)
+	assert.True(t, s.GetFieldInherited("a") == m.GetField("a"))
+	assert.True(t, s.GetFieldInherited("x", "z") == s.GetField("x", "z"))
+	assert.True(t, s.GetField("x").Map().GetFieldInherited("y") == m.GetField("x", "y"))
+	assert.True(t, s.GetFieldInherited("nope") == nil)
+
+	step2 := m.GetField("steps", "2").Map()
+	assert.True(t, step2.GetFieldInherited("c") == step2.GetField("c"))
+	assert.True(t, step2.GetFieldInherited("a") == m.GetField("a"))
+
+	l := m.GetField("layers", "l").Map()
+	assert.True(t, l.GetFieldInherited("a") == nil)
+	assert.True(t, l.GetFieldInherited("e") != nil)
+}
+
+func TestGetFieldUnderscore(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+x: {
+  y: {
+    z
+  }
+}
+`)
+	y := m.GetField("x", "y").Map()
+	assert.True(t, y.GetField("_", "y") == m.GetField("x", "y"))
+	assert.True(t, y.GetField("_", "_", "a") == m.GetField("a"))
+	assert.True(t, y.GetField("_", "_", "x", "y", "z") == m.GetField("x", "y", "z"))
+	assert.True(t, y.GetField("_", "a") == nil)
+	assert.True(t, y.GetField("_", "_", "_", "a") == nil)
+}
+
+func TestPath(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `shared: {
+  animate -> animal
+  animate -> animal: {
+    style.fill: red
+  }
+}
+"a.b": {
+  "c d"
+}
+x.class: [one; two]
+layers.l.y
+`)
+	for _, tc := range []struct {
+		n   d2ir.Node
+		exp string
+	}{
+		{m, ``},
+		{m.GetField("shared"), `shared`},
+		{m.GetField("shared").Map(), `shared`},
+		{m.GetField("shared").Map().Edges[1], `shared.(animate -> animal)[1]`},
+		{m.GetField("shared").Map().Edges[1].Map().GetField("style", "fill"), `shared.(animate -> animal)[1].style.fill`},
+		{m.GetField("shared").Map().Edges[1].Map().GetField("style", "fill").Primary(), `shared.(animate -> animal)[1].style.fill`},
+		{m.GetField("a.b", "c d"), `"a.b".c d`},
+		{m.GetField("layers", "l", "y"), `layers.l.y`},
+		{m.GetField("x", "class").Composite, `x.class`},
+		{m.GetField("x", "class").Composite.(*d2ir.Array).Values[1], `x.class[1]`},
+	} {
+		assert.String(t, tc.exp, d2ir.Path(tc.n))
+	}
+
+	for _, n := range []d2ir.Node{
+		m.GetField("shared").Map().Edges[1],
+		m.GetField("shared").Map().Edges[1].Map().GetField("style", "fill"),
+		m.GetField("a.b", "c d"),
+		m.GetField("layers", "l", "y"),
+	} {
+		n2, err := m.Query(d2ir.Path(n))
+		assert.Success(t, err)
+		assert.True(t, n == n2)
+	}
+}
+
+func TestQueryArrayIndex(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `x.class: [one; two; three]
+a -> b: {
+  class: [c; d]
+}
+y
+`)
+	arr := m.GetField("x", "class").Composite.(*d2ir.Array)
+	assert.True(t, arr.Get(1) == arr.Values[1])
+	assert.True(t, arr.Get(3) == nil)
+	assert.True(t, arr.Get(-1) == nil)
+
+	n, err := m.Query("x.class[2]")
+	assert.Success(t, err)
+	assert.String(t, "three", n.Primary().Value.ScalarString())
+	assert.String(t, "x.class[2]", d2ir.Path(n))
+
+	n, err = m.Query("(a -> b)[0].class[1]")
+	assert.Success(t, err)
+	assert.String(t, "d", n.Primary().Value.ScalarString())
+
+	_, err = m.Query("x.class[3]")
+	assert.ErrorString(t, err, "index 3 out of range for x.class of length 3")
+	_, err = m.Query("x.class[-1]")
+	assert.ErrorString(t, err, "index -1 out of range for x.class of length 3")
+	_, err = m.Query("y[0]")
+	assert.ErrorString(t, err, "y is not an array")
+	_, err = m.Query("x.class[one]")
+	assert.ErrorString(t, err, `invalid array index "[one]" after x.class`)
+	_, err = m.Query("x.class[1] extra")
+	assert.ErrorString(t, err, `unexpected "[1] extra" after x.class`)
+
+	n, err = m.Query("x.class[1]")
+	assert.Success(t, err)
+	n2, err := m.Resolve([]string{"x", "class", "1"})
+	assert.Success(t, err)
+	assert.True(t, n == n2)
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  x -> y
+  x -> y
+  x -> y: {style.fill: red}
+  p -> q: {class: [c; d]}
+}
+b.label: hi
+`)
+	n, err := m.Resolve([]string{"a", "(x -> y)", "2", "style", "fill"})
+	assert.Success(t, err)
+	assert.String(t, "red", n.Primary().Value.ScalarString())
+	assert.String(t, "a.(x -> y)[2].style.fill", d2ir.Path(n))
+
+	n2, err := m.Resolve([]string{"a", "(x -> y)[2]", "style", "fill"})
+	assert.Success(t, err)
+	assert.True(t, n == n2)
+
+	n, err = m.Resolve([]string{"a", "(p -> q)", "class", "1"})
+	assert.Success(t, err)
+	assert.String(t, "d", n.Primary().Value.ScalarString())
+
+	n, err = m.Resolve([]string{"b", "label"})
+	assert.Success(t, err)
+	assert.True(t, n == m.GetField("b", "label"))
+
+	n, err = m.Resolve(nil)
+	assert.Success(t, err)
+	assert.True(t, n == m)
+
+	_, err = m.Resolve([]string{"a", "(x -> y)", "style"})
+	assert.ErrorString(t, err, `failed to resolve segment 1 "(x -> y)": 3 edges match, an index is required`)
+	_, err = m.Resolve([]string{"a", "(x -> y)", "3"})
+	assert.ErrorString(t, err, `failed to resolve segment 1 "(x -> y)": edge not found`)
+	_, err = m.Resolve([]string{"a", "z"})
+	assert.ErrorString(t, err, `failed to resolve segment 1 "z": field not found`)
+	_, err = m.Resolve([]string{"b", "label", "x"})
+	assert.ErrorString(t, err, `failed to resolve segment 2 "x": field "label" has no map`)
+	_, err = m.Resolve([]string{"a", "(p -> q)", "class", "2"})
+	assert.ErrorString(t, err, `failed to resolve segment 3 "2": index out of range for array of length 2`)
+	_, err = m.Resolve([]string{"a", "(x -> y)[*]"})
+	assert.ErrorString(t, err, `failed to resolve segment 1 "(x -> y)[*]": must name a single edge`)
+}
+
+func TestArrayMutation(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `x.class: [one; two]
+`)
+	f := m.GetField("x", "class")
+	arr := f.Composite.(*d2ir.Array)
+
+	three := &d2ir.Scalar{Value: d2ast.FlatUnquotedString("three")}
+	arr.Append(three)
+	assert.True(t, three.Parent() == arr)
+	assert.Equal(t, "x.class[2]", d2ir.Path(three))
+
+	assert.Success(t, arr.RemoveAt(0))
+	uno := &d2ir.Scalar{Value: d2ast.FlatUnquotedString("uno")}
+	assert.Success(t, arr.Set(1, uno))
+	assert.True(t, uno.Parent() == arr)
+	assert.ErrorString(t, arr.Set(2, uno), "index 2 out of range for array of length 2")
+	assert.ErrorString(t, arr.RemoveAt(-1), "index -1 out of range for array of length 2")
+
+	assert.String(t, `[two; uno]`, arr.String())
+	assert.String(t, `x: {
+  class: [two; uno]
+}
+`, m.String())
+
+	m2 := m.Copy(nil).(*d2ir.Map)
+	assert.True(t, m2.Equal(m))
+	assert.True(t, m2.Equal(mustCompile(t, m.String())))
+	arr2 := m2.GetField("x", "class").Composite.(*d2ir.Array)
+	assert.True(t, arr2.Values[1].Parent() == arr2)
+}
+
+func TestSelfLoops(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> A
+b
+* -> b
+x: {
+  y -> y
+  y -> z
+}
+x.y -> x.z
+`)
+	ea := m.SelfLoops()
+	assert.Equal(t, 2, len(ea))
+	assert.String(t, `x.(y -> y)[0]`, d2ir.Path(ea[0]))
+	assert.String(t, `(a -> a)[0]`, d2ir.Path(ea[1]))
+	for _, e := range m.Edges {
+		if e != ea[1] {
+			assert.False(t, e.IsSelfLoop())
+		}
+	}
+}
+
+func TestFieldIsPattern(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `animal
+action
+a\*: escaped
+"b*": quoted
+action.style.stroke: red
+a*: globbed
+a*.style.fill: blue
+`)
+	var patterns []string
+	m.WalkPath(func(path []string, n d2ir.Node) bool {
+		if f, ok := n.(*d2ir.Field); ok && f.IsPattern() {
+			patterns = append(patterns, strings.Join(path, "."))
+		}
+		return true
+	})
+	// The style of action was created by a literal key and only its fill by the glob.
+	assert.JSON(t, []string{
+		"animal.style",
+		"animal.style.fill",
+		"action.style.fill",
+		"a*.style",
+		"a*.style.fill",
+	}, patterns)
+	assert.Equal(t, 4, len(m.Fields))
+	assert.String(t, "globbed", m.GetField("animal").Primary().String())
+	assert.False(t, d2ir.NewMap().Field("x*").IsPattern())
+}
+
+func TestGlobTrace(t *testing.T) {
+	t.Parallel()
+
+	var trace []string
+	mustCompileOpts(t, `a
+b: {
+  c
+}
+x -> y
+**.style.fill: red
+*.(c -> d)
+(x -> *)[*].style.stroke: blue
+x -> *
+`, &d2ir.CompileOptions{
+		GlobTrace: func(pattern, path string) {
+			trace = append(trace, pattern+" => "+path)
+		},
+	})
+	assert.JSON(t, []string{
+		"**.style.fill => a.style.fill",
+		"**.style.fill => b.style.fill",
+		"**.style.fill => b.c.style.fill",
+		"**.style.fill => x.style.fill",
+		"**.style.fill => y.style.fill",
+		"* => a",
+		"* => b",
+		"* => x",
+		"* => y",
+		"(x -> *)[*] => (x -> y)[0]",
+		"x -> * => (x -> a)[0]",
+		"x -> * => (x -> b)[0]",
+		"x -> * => (x -> y)[1]",
+	}, trace)
+}
+
+func TestRemoveEdge(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b: zero
+a -> b: one
+a -> b: two
+x: {
+  c -> d
+}
+`)
+	m2 := m.Copy(nil).(*d2ir.Map)
+	zero := m.Edges[0]
+	assert.True(t, m.RemoveEdge(zero))
+	assert.False(t, m.RemoveEdge(zero))
+	assert.Equal(t, 2, len(m.Edges))
+	assert.String(t, "(a -> b)[0]", m.Edges[0].ID.String())
+	assert.String(t, "one", m.Edges[0].Primary().String())
+	assert.String(t, "(a -> b)[1]", m.Edges[1].ID.String())
+	assert.String(t, "two", m.Edges[1].Primary().String())
+
+	k, err := d2parser.ParseMapKey("(a -> b)[0]")
+	assert.Success(t, err)
+	ea := m.GetEdges(d2ir.NewEdgeIDs(k)[0], nil)
+	assert.Equal(t, 1, len(ea))
+	assert.String(t, "one", ea[0].Primary().String())
+
+	// Copies share EdgeIDs but keep their indexes.
+	assert.String(t, "(a -> b)[1]", m2.Edges[1].ID.String())
+
+	cd := m.GetField("x").Map().Edges[0]
+	assert.True(t, m.RemoveEdge(cd))
+	assert.Equal(t, 0, len(m.GetField("x").Map().Edges))
+	assert.False(t, m.GetField("x").Map().RemoveEdge(m.Edges[0]))
+}
+
+func TestDeleteEdgeReindex(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b: zero
+a -> b: one
+a -> b: two
+(a -> b)[0]: null
+(a -> b)[0].style.stroke: red
+`)
+	assert.Equal(t, 2, len(m.Edges))
+	assert.String(t, "(a -> b)[0]", m.Edges[0].ID.String())
+	assert.String(t, "one", m.Edges[0].Primary().String())
+	assert.String(t, "red", m.Edges[0].Map().GetField("style", "stroke").Primary().String())
+	assert.String(t, "(a -> b)[1]", m.Edges[1].ID.String())
+
+	k, err := d2parser.ParseMapKey("(a -> b)[0]")
+	assert.Success(t, err)
+	e := m.DeleteEdge(d2ir.NewEdgeIDs(k)[0])
+	assert.String(t, "one", e.Primary().String())
+	assert.Equal(t, 1, len(m.Edges))
+	assert.String(t, "(a -> b)[0]", m.Edges[0].ID.String())
+	assert.String(t, "two", m.GetEdges(d2ir.NewEdgeIDs(k)[0], nil)[0].Primary().String())
+}
+
+func TestCompileContext(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "n%d\n", i)
+	}
+	sb.WriteString("** -> **\n")
+	ast, err := d2parser.Parse(t.Name()+".d2", strings.NewReader(sb.String()), nil)
+	assert.Success(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = d2ir.CompileContext(ctx, ast, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("compile returned %v after cancellation", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = d2ir.CompileContext(ctx, ast, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	ast, err = d2parser.Parse(t.Name()+".d2", strings.NewReader("a -> b"), nil)
+	assert.Success(t, err)
+	m, err := d2ir.CompileContext(context.Background(), ast, nil)
+	assert.Success(t, err)
+	assert.Equal(t, 1, len(m.Edges))
+}
+
+func TestCompileLimits(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&sb, "n%d\n", i)
+	}
+	sb.WriteString("a -> b\n** -> **\nlast\n")
+	ast, err := d2parser.Parse("limits.d2", strings.NewReader(sb.String()), nil)
+	assert.Success(t, err)
+
+	_, err = d2ir.Compile(ast, &d2ir.CompileOptions{
+		MaxEdges: 100,
+	})
+	assert.ErrorString(t, err, "limits.d2:52:1: edge limit of 100 exceeded")
+
+	_, err = d2ir.Compile(ast, &d2ir.CompileOptions{
+		MaxFields: 51,
+	})
+	// The error is on the field that exceeded the limit: b in a -> b.
+	assert.ErrorString(t, err, "limits.d2:51:6: field limit of 51 exceeded")
+
+	m, err := d2ir.Compile(ast, &d2ir.CompileOptions{
+		MaxFields: 53,
+		MaxEdges:  52*51 + 1,
+	})
+	assert.Success(t, err)
+	assert.Equal(t, 53, m.FieldCountRecursive())
+	assert.Equal(t, 52*51+1, m.EdgeCountRecursive())
+
+	// A single key is stopped as soon as it creates one field too many.
+	ast, err = d2parser.Parse("limits.d2", strings.NewReader("a.b.c.d.e\n"), nil)
+	assert.Success(t, err)
+	_, err = d2ir.Compile(ast, &d2ir.CompileOptions{
+		MaxFields: 3,
+	})
+	assert.ErrorString(t, err, "limits.d2:1:7: field limit of 3 exceeded")
+
+	// Boards count the fields and edges they inherit.
+	ast, err = d2parser.Parse("limits.d2", strings.NewReader(`a -> b
+scenarios: {
+  x: {}
+  y: {}
+}
+`), nil)
+	assert.Success(t, err)
+	_, err = d2ir.Compile(ast, &d2ir.CompileOptions{
+		MaxEdges: 2,
+	})
+	assert.ErrorString(t, err, "limits.d2:4:3: edge limit of 2 exceeded")
+}
+
+func TestRequireExistingEdgeEndpoints(t *testing.T) {
+	t.Parallel()
+
+	compile := func(text string) (*d2ir.Map, error) {
+		ast, err := d2parser.Parse("endpoints.d2", strings.NewReader(text), nil)
+		assert.Success(t, err)
+		return d2ir.Compile(ast, &d2ir.CompileOptions{
+			RequireExistingEdgeEndpoints: true,
+		})
+	}
+
+	m, err := compile(`a
+b
+x: {
+  c
+}
+a -> b
+x.c -> a
+x.(c -> c)
+x.(c -> _.b)
+nope.* -> a
+`)
+	assert.Success(t, err)
+	assert.Equal(t, 4, m.EdgeCountRecursive())
+	assert.Equal(t, 3, len(m.Fields))
+
+	_, err = compile(`a
+b
+a -> bb
+`)
+	assert.ErrorString(t, err, "endpoints.d2:3:6: edge destination bb does not exist")
+	_, err = compile(`b
+a -> b
+`)
+	assert.ErrorString(t, err, "endpoints.d2:2:1: edge source a does not exist")
+	_, err = compile(`x.(a -> b)
+`)
+	assert.ErrorString(t, err, "endpoints.d2:1:4: edge source a does not exist")
+
+	m = mustCompile(t, `a -> bb`)
+	assert.True(t, m.GetField("bb") != nil)
+}
+
+func TestDisallowUnderscoreCreate(t *testing.T) {
+	t.Parallel()
+
+	compile := func(text string) (*d2ir.Map, error) {
+		ast, err := d2parser.Parse("underscore.d2", strings.NewReader(text), nil)
+		assert.Success(t, err)
+		return d2ir.Compile(ast, &d2ir.CompileOptions{
+			DisallowUnderscoreCreate: true,
+		})
+	}
+
+	m, err := compile(`existing
+x: {
+  _.existing: x
+  _.existing -> y
+  _.existing.style.fill: red
+  _.gone: null
+}
+`)
+	assert.Success(t, err)
+	assert.Equal(t, "x", m.GetField("existing").Primary().Value.ScalarString())
+	assert.Equal(t, 1, m.EdgeCountRecursive())
+
+	_, err = compile(`x: {
+  _.newfield: x
+}
+`)
+	assert.ErrorString(t, err, `underscore.d2:2:3: cannot create _.newfield through "_"`)
+	_, err = compile(`existing
+x: {
+  _.existing.child
+}
+`)
+	assert.ErrorString(t, err, `underscore.d2:3:3: cannot create _.existing.child through "_"`)
+	_, err = compile(`x: {
+  y -> _.z
+}
+`)
+	assert.ErrorString(t, err, `underscore.d2:2:8: cannot create _.z through "_"`)
+
+	m = mustCompile(t, `x: {
+  _.newfield: x
+}
+`)
+	assert.True(t, m.GetField("newfield") != nil)
+}
+
+func TestOnProgress(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+	for i := 0; i < 2500; i++ {
+		fmt.Fprintf(&sb, "n%d -> n%d\n", i, i+1)
+	}
+	var calls [][2]int
+	m := mustCompileOpts(t, sb.String(), &d2ir.CompileOptions{
+		OnProgress: func(fieldsDone, edgesDone int) {
+			calls = append(calls, [2]int{fieldsDone, edgesDone})
+		},
+	})
+	// Only the edges count toward the interval as their endpoints aren't set by the keys.
+	assert.Equal(t, 3, len(calls))
+	assert.Equal(t, [2]int{1001, 1000}, calls[0])
+	for i := 1; i < len(calls); i++ {
+		assert.True(t, calls[i][0] >= calls[i-1][0])
+		assert.True(t, calls[i][1] > calls[i-1][1])
+	}
+	assert.Equal(t, m.FieldCountRecursive(), calls[2][0])
+	assert.Equal(t, m.EdgeCountRecursive(), calls[2][1])
+}
+
+func TestGlobEdgeThreshold(t *testing.T) {
+	t.Parallel()
+
+	const text = `a
+b
+c
+x: {
+  y
+  z
+}
+** -> x.y
+x.(* -> *)
+`
+	ast, err := d2parser.Parse("globs.d2", strings.NewReader(text), nil)
+	assert.Success(t, err)
+
+	var warnings []string
+	m, err := d2ir.Compile(ast, &d2ir.CompileOptions{
+		GlobEdgeThreshold: 2,
+		Warn: func(err d2ast.Error) {
+			warnings = append(warnings, err.Error())
+		},
+	})
+	assert.Success(t, err)
+	assert.JSON(t, []string{
+		"globs.d2:8:1: edge glob ** -> x.y would create up to 6 edges",
+		"globs.d2:9:4: edge glob * -> * would create up to 4 edges",
+	}, warnings)
+	assert.Equal(t, 6, m.EdgeCountRecursive())
+
+	_, err = d2ir.Compile(ast, &d2ir.CompileOptions{
+		GlobEdgeThreshold: 2,
+		StrictGlobEdges:   true,
+	})
+	assert.ErrorString(t, err, `globs.d2:8:1: edge glob ** -> x.y would create up to 6 edges
+globs.d2:9:4: edge glob * -> * would create up to 4 edges`)
+}
+
+func TestBoardOf(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b
+scenarios: {
+  s: {
+    c
+  }
+}
+layers: {
+  l: {
+    steps: {
+      one: {
+        d.e
+      }
+    }
+  }
+}
+`)
+	assertBoard := func(n d2ir.Node, kind d2ir.BoardKind, name string) {
+		t.Helper()
+		board, kind2, name2 := d2ir.BoardOf(n)
+		assert.True(t, board == d2ir.ParentBoard(n))
+		assert.Equal(t, kind, kind2)
+		assert.Equal(t, name, name2)
+	}
+	assertBoard(m.GetField("a", "b"), d2ir.BoardLayer, "root")
+	assertBoard(m.GetField("scenarios", "s", "c"), d2ir.BoardScenario, "s")
+	assertBoard(m.GetField("scenarios", "s", "a", "b"), d2ir.BoardScenario, "s")
+	assertBoard(m.GetField("layers", "l", "steps"), d2ir.BoardLayer, "l")
+	assertBoard(m.GetField("layers", "l", "steps", "one", "d", "e"), d2ir.BoardStep, "one")
+
+	board, kind, name := d2ir.BoardOf(m.Parent())
+	assert.Equal(t, nil, board)
+	assert.Equal(t, d2ir.BoardKind(""), kind)
+	assert.Equal(t, "", name)
+}
+
+func TestSameBoard(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.b
+c
+scenarios: {
+  s: {
+    x
+  }
+}
+layers: {
+  l: {
+    y
+    steps: {
+      one: {
+        z
+      }
+    }
+  }
+}
+`)
+	ab := m.GetField("a", "b")
+	x := m.GetField("scenarios", "s", "x")
+	y := m.GetField("layers", "l", "y")
+	z := m.GetField("layers", "l", "steps", "one", "z")
+
+	assert.True(t, d2ir.SameBoard(ab, m.GetField("c")))
+	assert.False(t, d2ir.SameBoard(ab, x))
+	assert.False(t, d2ir.SameBoard(y, z))
+
+	assert.True(t, d2ir.CommonBoard(ab, m.GetField("c")) == m)
+	assert.True(t, d2ir.CommonBoard(ab, x) == m)
+	assert.True(t, d2ir.CommonBoard(x, z) == m)
+	assert.True(t, d2ir.CommonBoard(y, z) == m.GetField("layers", "l").Map())
+	assert.True(t, d2ir.CommonBoard(z, z) == d2ir.ParentBoard(z))
+	assert.True(t, d2ir.CommonBoard(ab, mustCompile(t, "a.b").GetField("a", "b")) == nil)
+}
+
+func TestForEach(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+b: {
+  c
+}
+d
+a -> b: one
+a -> d: two
+b -> d: three
+`)
+	var names []string
+	m.ForEachField(func(f *d2ir.Field) bool {
+		names = append(names, f.Name)
+		return true
+	})
+	assert.JSON(t, []string{"a", "b", "d"}, names)
+
+	names = nil
+	m.ForEachField(func(f *d2ir.Field) bool {
+		names = append(names, f.Name)
+		return f.Name != "b"
+	})
+	assert.JSON(t, []string{"a", "b"}, names)
+
+	var labels []string
+	m.ForEachEdge(func(e *d2ir.Edge) bool {
+		labels = append(labels, e.Primary().String())
+		return len(labels) < 2
+	})
+	assert.JSON(t, []string{"one", "two"}, labels)
+
+	var nilMap *d2ir.Map
+	nilMap.ForEachField(func(*d2ir.Field) bool {
+		t.Fatal("unexpected field")
+		return true
+	})
+}
+
+func TestDistinctEdgePairs(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+b -> a
+a -- b
+b -- a
+a <-> b
+x: {
+  y -> z
+}
+x.y -> x.z
+x.(y -> z)[0].style.stroke: red
+layers: {
+  l: {
+    a -> b
+  }
+}
+`)
+	assert.Equal(t, 9, m.EdgeCountRecursive())
+	assert.Equal(t, 7, m.DistinctEdgePairs())
+	assert.Equal(t, 6, m.DistinctUndirectedPairs())
+}
+
+func TestEdgeGroups(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b: one
+a -> b: two
+b -> a
+a -> b: three
+x: {
+  a -> b
+}
+x.a -> x.b
+layers: {
+  l: {
+    a -> b
+  }
+}
+`)
+	groups := m.EdgeGroups()
+	assert.Equal(t, 3, len(groups))
+
+	var labels []string
+	for i, e := range groups["a -> b"] {
+		assert.Equal(t, i, *e.ID.Index)
+		labels = append(labels, e.Primary_.Value.ScalarString())
+	}
+	assert.JSON(t, []string{"one", "two", "three"}, labels)
+	assert.Equal(t, 1, len(groups["b -> a"]))
+	assert.Equal(t, 2, len(groups["x.a -> x.b"]))
+}
+
+func TestCompareEdgeIDs(t *testing.T) {
+	t.Parallel()
+
+	sorted := []string{
+		"a -> b",
+		"(a -> b)[0]",
+		"(a -> b)[1]",
+		"a <- b",
+		"a <-> b",
+		"a -> b.c",
+		"a.b -> a",
+		"b -- a",
+	}
+	var eids []*d2ir.EdgeID
+	for _, s := range sorted {
+		eid, err := d2ir.ParseEdgeID(s)
+		assert.Success(t, err)
+		eids = append(eids, eid)
+	}
+	for i := range eids {
+		for j := range eids {
+			c := d2ir.CompareEdgeIDs(eids[i], eids[j])
+			switch {
+			case i < j:
+				assert.True(t, c < 0)
+			case i > j:
+				assert.True(t, c > 0)
+			default:
+				assert.Equal(t, 0, c)
+			}
+		}
+	}
+
+	shuffled := []*d2ir.EdgeID{eids[5], eids[2], eids[7], eids[0], eids[4], eids[1], eids[6], eids[3]}
+	sort.Slice(shuffled, func(i, j int) bool {
+		return d2ir.CompareEdgeIDs(shuffled[i], shuffled[j]) < 0
+	})
+	for i, eid := range shuffled {
+		assert.True(t, eid == eids[i])
+	}
+
+	upper, err := d2ir.ParseEdgeID("(A -> B)[1]")
+	assert.Success(t, err)
+	assert.Equal(t, 0, d2ir.CompareEdgeIDs(upper, eids[2]))
+}
+
+func TestSetName(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+c.style.fill: red
+`)
+	a := m.GetField("a")
+	assert.ErrorString(t, a.SetName("B"), `cannot rename "a" to "B": a sibling is already named "b"`)
+	assert.ErrorString(t, a.SetName("shape"), `cannot rename "a" to reserved keyword "shape"`)
+	assert.ErrorString(t, m.GetField("c", "style").SetName("x"), `cannot rename reserved keyword "style"`)
+	assert.ErrorString(t, a.SetName(""), `invalid field name ""`)
+	assert.Equal(t, "a", a.Name)
+
+	assert.Success(t, a.SetName("A"))
+	assert.Success(t, a.SetName("d"))
+	assert.True(t, m.GetField("d") == a)
+	assert.JSON(t, []string{"a"}, m.Edges[0].ID.SrcPath)
+}
+
+func TestResolveUnderscores(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b: {
+    c: {
+      _._.x
+    }
+  }
+}
+`)
+	c := m.GetField("a", "b", "c").Map()
+	path, target, err := c.ResolveUnderscores([]string{"_", "_", "x"})
+	assert.Success(t, err)
+	assert.JSON(t, []string{"a", "x"}, path)
+	assert.True(t, target == m.GetField("a").Map())
+	assert.True(t, target.GetField("x") != nil)
+
+	path, target, err = c.ResolveUnderscores([]string{"_", "_", "_", "y", "z"})
+	assert.Success(t, err)
+	assert.JSON(t, []string{"y", "z"}, path)
+	assert.True(t, target == m)
+
+	path, target, err = c.ResolveUnderscores([]string{"d"})
+	assert.Success(t, err)
+	assert.JSON(t, []string{"a", "b", "c", "d"}, path)
+	assert.True(t, target == c)
+
+	_, _, err = c.ResolveUnderscores([]string{"_", "_", "_", "_", "x"})
+	assert.ErrorString(t, err, "invalid underscore: no parent")
+	assert.True(t, errors.Is(err, d2ir.ErrInvalidUnderscore))
+	_, _, err = c.ResolveUnderscores([]string{"_"})
+	assert.ErrorString(t, err, "invalid underscore: field key must contain more than underscores")
+	_, _, err = c.ResolveUnderscores([]string{"x", "_"})
+	assert.ErrorString(t, err, `invalid underscore: parent "_" can only be used in the beginning of paths, e.g. "_.x"`)
+}
+
+func TestMatchEdges(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+a -> b
+c -> b
+ab <- c
+x: {
+  y -> z
+}
+`)
+	before := m.Copy(nil).(*d2ir.Map)
+
+	ea := m.MatchEdges([]string{"*"}, []string{"b"})
+	assert.Equal(t, 4, len(ea))
+	assert.Equal(t, 2, *ea[2].ID.Index)
+	assert.JSON(t, []string{"c"}, ea[3].ID.SrcPath)
+
+	ea = m.MatchEdges([]string{"a*"}, []string{"*"})
+	assert.Equal(t, 4, len(ea))
+	assert.True(t, ea[3] == m.Edges[4])
+
+	ea = m.MatchEdges([]string{"x", "*"}, []string{"x.z"})
+	assert.Equal(t, 1, len(ea))
+	assert.True(t, ea[0] == m.GetField("x").Map().Edges[0])
+
+	assert.Equal(t, 0, len(m.MatchEdges([]string{"b"}, []string{"*"})))
+	assert.Equal(t, 0, len(m.MatchEdges([]string{"("}, []string{"*"})))
+	assert.Equal(t, 0, len(m.MatchEdges([]string{"*", "q"}, []string{"*"})))
+	assert.Equal(t, 0, len(m.MatchEdges([]string{"**", "q"}, []string{"*"})))
+	assert.True(t, m.GetField("a").Map() == nil)
+	assert.True(t, m.Equal(before))
+}
+
+func TestEdgeList(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+x: {
+  c <- d
+  c -- d
+  y.e <-> c
+}
+layers: {
+  l: {
+    p -> q
+  }
+}
+`)
+	el := m.EdgeList()
+	assert.Equal(t, 6, len(el))
+	assert.JSON(t, d2ir.EdgeTuple{Src: []string{"a"}, Dst: []string{"b"}, Index: 1, Directed: true}, el[1])
+	assert.JSON(t, d2ir.EdgeTuple{Src: []string{"x", "d"}, Dst: []string{"x", "c"}, Directed: true}, el[2])
+	assert.JSON(t, d2ir.EdgeTuple{Src: []string{"x", "c"}, Dst: []string{"x", "d"}}, el[3])
+	assert.JSON(t, d2ir.EdgeTuple{Src: []string{"x", "y", "e"}, Dst: []string{"x", "c"}}, el[4])
+	assert.JSON(t, d2ir.EdgeTuple{Src: []string{"layers", "l", "p"}, Dst: []string{"layers", "l", "q"}, Directed: true}, el[5])
+	for _, et := range el {
+		assert.True(t, m.GetField(et.Src...) != nil)
+		assert.True(t, m.GetField(et.Dst...) != nil)
+	}
+}
+
+func TestAdjacencyMatrix(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+b -> c
+c -- a
+a.style.fill: red
+`)
+	nodes, matrix := m.AdjacencyMatrix()
+	assert.Equal(t, 3, len(nodes))
+	assert.Equal(t, "c", nodes[2].Name)
+	assert.JSON(t, [][]int{
+		{0, 1, 1},
+		{0, 0, 1},
+		{1, 0, 0},
+	}, matrix)
+
+	m = mustCompile(t, `x: {
+  a -> b
+  b -> c
+}
+x.c -> y
+y <-> z
+y -> y
+layers: {
+  l: {
+    y -> z
+  }
+}
+`)
+	nodes, matrix = m.AdjacencyMatrix()
+	assert.Equal(t, 3, len(nodes))
+	assert.JSON(t, [][]int{
+		{2, 1, 0},
+		{0, 1, 1},
+		{0, 1, 0},
+	}, matrix)
+
+	nodes, matrix = m.AdjacencyMatrixLeaves()
+	assert.Equal(t, 5, len(nodes))
+	assert.True(t, nodes[0] == m.GetField("x", "a"))
+	assert.JSON(t, [][]int{
+		{0, 1, 0, 0, 0},
+		{0, 0, 1, 0, 0},
+		{0, 0, 0, 1, 0},
+		{0, 0, 0, 1, 1},
+		{0, 0, 0, 1, 0},
+	}, matrix)
+}
+
+func TestGrep(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `auth: {
+  login
+  AuthDB: postgres
+}
+api -> auth.login: calls auth
+api.label: Handles requests
+layers: {
+  l: {
+    oauth
+  }
+}
+`)
+	nodes := m.Grep("auth", d2ir.GrepOptions{})
+	assert.Equal(t, 3, len(nodes))
+	assert.True(t, nodes[0] == m.GetField("auth"))
+	assert.True(t, nodes[1] == m.Edges[0])
+	assert.True(t, nodes[2] == m.GetField("layers", "l", "oauth"))
+
+	nodes = m.Grep("auth", d2ir.GrepOptions{CaseInsensitive: true})
+	assert.Equal(t, 4, len(nodes))
+	assert.True(t, nodes[1] == m.GetField("auth", "authdb"))
+	assert.Equal(t, 0, len(m.Grep("requests", d2ir.GrepOptions{CaseInsensitive: true})))
+
+	nodes = m.Grep("requests", d2ir.GrepOptions{CaseInsensitive: true, Values: true})
+	assert.Equal(t, 1, len(nodes))
+	assert.True(t, nodes[0] == m.GetField("api", "label"))
+	nodes = m.Grep("postgres", d2ir.GrepOptions{Values: true})
+	assert.Equal(t, 1, len(nodes))
+	assert.True(t, nodes[0] == m.GetField("auth", "AuthDB"))
+
+	// Fields created by globs come last.
+	m = mustCompile(t, `x -> auth
+auth2
+*.auth3
+`)
+	nodes = m.Grep("auth", d2ir.GrepOptions{})
+	assert.Equal(t, 6, len(nodes))
+	assert.True(t, nodes[0] == m.Edges[0])
+	assert.True(t, nodes[1] == m.GetField("auth"))
+	assert.True(t, nodes[2] == m.GetField("auth2"))
+	assert.True(t, nodes[3] == m.GetField("x", "auth3"))
+	assert.True(t, nodes[5] == m.GetField("auth2", "auth3"))
+}
+
+func TestReplaceScalar(t *testing.T) {
+	t.Parallel()
+
+	ast, err := d2parser.Parse("TestReplaceScalar.d2", strings.NewReader(`a: prod server
+b: "prod db"
+c: 'prod cache'
+d.e: [prod; dev; "prod"]
+a -> b: prod link
+x: 1
+*.style.stroke: prod
+`), nil)
+	assert.Success(t, err)
+	m, err := d2ir.Compile(ast, nil)
+	assert.Success(t, err)
+
+	n := m.ReplaceScalar(func(s string) (string, bool) {
+		if !strings.Contains(s, "prod") {
+			return "", false
+		}
+		return strings.ReplaceAll(s, "prod", "production"), true
+	})
+	assert.Equal(t, 7, n)
+	assert.Equal(t, "production server", m.GetField("a").Primary().Value.ScalarString())
+	assert.Equal(t, "production", m.GetField("x", "style", "stroke").Primary().Value.ScalarString())
+	assert.String(t, `a: production server
+b: "production db"
+c: 'production cache'
+d.e: [production; dev; "production"]
+a -> b: production link
+x: 1
+*.style.stroke: production
+`, d2format.Format(ast))
+}
+
+func TestEditSetValue(t *testing.T) {
+	t.Parallel()
+
+	text := `a: old
+b: {
+  c: "quoted"
+}
+d
+*.style.fill: red
+arr: [1; 2]
+`
+	m := mustCompile(t, text)
+
+	edit := func(m *d2ir.Map, path []string, value string) string {
+		r, s, err := m.EditSetValue(path, value)
+		assert.Success(t, err)
+		return text[:r.Start.Byte] + s + text[r.End.Byte:]
+	}
+	value := func(text string, path ...string) string {
+		return mustCompile(t, text).GetField(path...).Primary().Value.ScalarString()
+	}
+
+	edited := edit(m, []string{"a"}, "new value")
+	assert.Equal(t, "new value", value(edited, "a"))
+	assert.True(t, strings.HasPrefix(edited, "a: new value\n"))
+
+	edited = edit(m, []string{"b", "c"}, "x;y")
+	assert.Equal(t, "x;y", value(edited, "b", "c"))
+	assert.True(t, strings.Contains(edited, `c: "x;y"`))
+
+	edited = edit(m, []string{"d"}, "v")
+	assert.Equal(t, "v", value(edited, "d"))
+	assert.True(t, strings.HasSuffix(edited, "\nd: v\n"))
+
+	edited = edit(m, []string{"a", "style", "fill"}, "blue")
+	assert.Equal(t, "blue", value(edited, "a", "style", "fill"))
+	assert.Equal(t, "red", value(edited, "b", "style", "fill"))
+
+	edited = edit(m.GetField("b").Map(), []string{"e"}, "1")
+	assert.True(t, strings.HasSuffix(edited, "\nb.e: 1\n"))
+
+	_, _, err := m.EditSetValue([]string{"arr"}, "x")
+	assert.ErrorString(t, err, "cannot set value of array arr")
+
+	// Without a trailing newline, the new key must not be appended to the last line.
+	text = "a: 1\nb: 2"
+	edited = edit(mustCompile(t, text), []string{"c"}, "3")
+	assert.Equal(t, "a: 1\nb: 2\nc: 3\n", edited)
+	assert.Equal(t, "2", value(edited, "b"))
+	assert.Equal(t, "3", value(edited, "c"))
+}
+
+func TestNullify(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		text string
+		path []string
+		key  string
+	}{
+		{
+			text: "a -> b\nc\n",
+			path: []string{"a"},
+			key:  "a",
+		},
+		{
+			text: "a: {\n  b -> c\n  d\n}\n",
+			path: []string{"a", "b"},
+			key:  "a.b",
+		},
+		{
+			text: "a.style.fill: red\n",
+			path: []string{"a", "style", "fill"},
+			key:  "a.style.fill",
+		},
+		{
+			text: "a.style: {\n  fill: red\n  stroke: blue\n}\n",
+			path: []string{"a", "style", "fill"},
+			key:  "a.style.fill",
+		},
+		{
+			text: "vars: {\n  x: 1\n}\na: {\n  vars: {\n    x: 2\n  }\n}\n",
+			path: []string{"a", "vars", "x"},
+			key:  "a: {vars: {x: null}}",
+		},
+	}
+	for _, tc := range testCases {
+		m := mustCompile(t, tc.text)
+		m.Nullify(tc.path)
+		key := tc.key
+		if !strings.Contains(key, ":") {
+			key += ": null"
+		}
+		exp := mustCompile(t, tc.text+key)
+		assert.String(t, exp.String(), m.String())
+	}
+
+	m := mustCompile(t, "a.b\n")
+	assert.True(t, m.Nullify([]string{"x"}) == nil)
+	f := m.Nullify([]string{"a", "b"})
+	assert.Equal(t, "b", f.Name)
+	assert.True(t, m.GetField("a", "b") == nil)
+}
+
+func TestDeleteWhere(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `classes: {
+  c: {
+    style.fill: red
+  }
+}
+a.class: c
+b.class: c
+a -> b
+x -> y
+x -> y
+x.class: d
+z: {
+  w.class: c
+  v
+}
+`)
+	hasClass := func(class string) func(*d2ir.Field) bool {
+		return func(f *d2ir.Field) bool {
+			if f.Map() == nil {
+				return false
+			}
+			cf := f.Map().GetField("class")
+			return cf != nil && cf.Primary() != nil && cf.Primary().Value.ScalarString() == class
+		}
+	}
+	assert.Equal(t, 3, m.DeleteWhere(hasClass("c")))
+	assert.Equal(t, 0, m.DeleteWhere(hasClass("c")))
+	assert.True(t, m.GetField("a") == nil)
+	assert.True(t, m.GetField("z", "w") == nil)
+	assert.True(t, m.GetField("z", "v") != nil)
+	assert.True(t, m.GetField("classes", "c") != nil)
+	assert.Equal(t, 2, len(m.Edges))
+	assert.Equal(t, 0, *m.Edges[0].ID.Index)
+	assert.Equal(t, 1, *m.Edges[1].ID.Index)
+
+	m = mustCompile(t, `x.style.fill: red
+y.style: {
+  fill: red
+  stroke: blue
+}
+x -> y: {style.fill: red}
+`)
+	assert.Equal(t, 3, m.DeleteWhere(func(f *d2ir.Field) bool {
+		return f.Name == "fill"
+	}))
+	assert.True(t, m.GetField("x", "style") == nil)
+	assert.True(t, m.GetField("y", "style", "stroke") != nil)
+	assert.True(t, m.Edges[0].Map().GetField("style") == nil)
+}
+
+func TestFieldInEdge(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a.style.fill: red
+a -> b
+(a -> b)[0].style.fill: blue
+`)
+	e, ok := m.GetField("a", "style", "fill").InEdge()
+	assert.False(t, ok)
+	assert.True(t, e == nil)
+
+	fill := m.Edges[0].Map().GetField("style", "fill")
+	e, ok = fill.InEdge()
+	assert.True(t, ok)
+	assert.True(t, e == m.Edges[0])
+	e, ok = d2ir.ParentField(fill).InEdge()
+	assert.True(t, ok)
+	assert.True(t, e == m.Edges[0])
+}
+
+func TestAllowInterBoardEdges(t *testing.T) {
+	t.Parallel()
+
+	text := `x
+layers: {
+  a: {
+    y
+  }
+  b
+}
+layers.a.y -> layers.b
+x -> layers.a
+`
+	ast, err := d2parser.Parse(t.Name()+".d2", strings.NewReader(text), nil)
+	assert.Success(t, err)
+	_, err = d2ir.Compile(ast, nil)
+	assert.ErrorString(t, err, `TestAllowInterBoardEdges.d2:8:15: cannot create edges between boards
+TestAllowInterBoardEdges.d2:9:6: cannot create edges between boards`)
+
+	m := mustCompileOpts(t, text, &d2ir.CompileOptions{
+		AllowInterBoardEdges: true,
+	})
+	assert.Equal(t, 1, len(m.Edges))
+	assert.String(t, `(x -> layers.a)[0]`, m.Edges[0].ID.String())
+	layers := m.GetField("layers").Map()
+	assert.Equal(t, 1, len(layers.Edges))
+	assert.String(t, `(a.y -> b)[0]`, layers.Edges[0].ID.String())
+	assert.Equal(t, 2, len(m.Validate()))
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `scenarios: {
+  s: {
+    x: 1
+  }
+}
+a: {
+  style.fill: red
+  b: {
+    vars: {
+      x: 1
+    }
+    c: 1
+  }
+}
+a -> b: {
+  style.stroke: red
+}
+`)
+	m.DeleteField("a", "style", "fill")
+	m.GetField("a", "b", "vars").Map().DeleteField("x")
+	m.GetField("a", "b").Map().DeleteField("c")
+	m.Edges[0].Map_.GetField("style").Map().DeleteField("stroke")
+	m.GetField("scenarios", "s").Map().DeleteField("x")
+
+	m.Prune()
+	assert.String(t, `
+a: {
+  b
+}
+b
+a -> b
+scenarios: {
+  s
+}
+`, m.String())
+}
@@ -0,0 +1,747 @@
+package d2ir
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+)
+
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+)
+
+// Change is a single difference reported by Diff.
+//
+// Like d2ast.Key, a Change addresses fields with Path, edges with Path and Edge and fields
+// within edges with Path, Edge and EdgeKey.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+
+	// Path is relative to the maps passed to Diff. For edges, it's the path of the map
+	// containing the edge.
+	Path    []string `json:"path,omitempty"`
+	Edge    *EdgeID  `json:"edge,omitempty"`
+	EdgeKey []string `json:"edge_key,omitempty"`
+
+	// Old and New are set on ChangeModified to the formatted old and new values. A missing
+	// value is the empty string.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// Diff returns the changes required to turn a into b.
+//
+// Fields are matched by name and edges by EdgeID so reordering alone produces no changes.
+func Diff(a, b *Map) []Change {
+	d := &differ{}
+	d.diffMap(nil, nil, nil, a, b)
+	return d.changes
+}
+
+type differ struct {
+	changes []Change
+}
+
+func (d *differ) change(kind ChangeKind, path []string, eid *EdgeID, edgeKey []string) *Change {
+	d.changes = append(d.changes, Change{
+		Kind:    kind,
+		Path:    path,
+		Edge:    eid,
+		EdgeKey: edgeKey,
+	})
+	return &d.changes[len(d.changes)-1]
+}
+
+func (d *differ) diffMap(path []string, eid *EdgeID, edgeKey []string, a, b *Map) {
+	if a == nil {
+		a = &Map{}
+	}
+	if b == nil {
+		b = &Map{}
+	}
+
+	childPath := func(name string) ([]string, []string) {
+		if eid != nil {
+			return path, appendIDA(edgeKey, name)
+		}
+		return appendIDA(path, name), nil
+	}
+
+	for _, af := range a.Fields {
+		fpath, fkey := childPath(af.Name)
+		bf := b.fieldByName(af.Name)
+		if bf == nil {
+			d.change(ChangeRemoved, fpath, eid, fkey)
+			continue
+		}
+		d.diffField(fpath, eid, fkey, af, bf)
+	}
+	for _, bf := range b.Fields {
+		if a.fieldByName(bf.Name) == nil {
+			fpath, fkey := childPath(bf.Name)
+			d.change(ChangeAdded, fpath, eid, fkey)
+		}
+	}
+
+	for _, ae := range a.Edges {
+		be := b.edgeByID(ae.ID)
+		if be == nil {
+			d.change(ChangeRemoved, path, ae.ID.Copy(), nil)
+			continue
+		}
+		if !scalarEqual(ae.Primary_, be.Primary_) {
+			c := d.change(ChangeModified, path, ae.ID.Copy(), nil)
+			c.Old = formatValue(ae.Primary_)
+			c.New = formatValue(be.Primary_)
+		}
+		d.diffMap(path, ae.ID.Copy(), nil, ae.Map_, be.Map_)
+	}
+	for _, be := range b.Edges {
+		if a.edgeByID(be.ID) == nil {
+			d.change(ChangeAdded, path, be.ID.Copy(), nil)
+		}
+	}
+}
+
+func (d *differ) diffField(path []string, eid *EdgeID, edgeKey []string, af, bf *Field) {
+	if !scalarEqual(af.Primary_, bf.Primary_) {
+		c := d.change(ChangeModified, path, eid, edgeKey)
+		c.Old = formatValue(af.Primary_)
+		c.New = formatValue(bf.Primary_)
+	}
+
+	aa, aIsArray := af.Composite.(*Array)
+	ba, bIsArray := bf.Composite.(*Array)
+	if !aIsArray && !bIsArray {
+		d.diffMap(path, eid, edgeKey, af.Map(), bf.Map())
+		return
+	}
+	if aIsArray && bIsArray && aa.Equal(ba) {
+		return
+	}
+	c := d.change(ChangeModified, path, eid, edgeKey)
+	c.Old = formatValue(af.Composite)
+	c.New = formatValue(bf.Composite)
+}
+
+func (m *Map) fieldByName(name string) *Field {
+	for _, f := range m.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *Map) edgeByID(eid *EdgeID) *Edge {
+	for _, e := range m.Edges {
+		if e.ID.Match(eid) {
+			return e
+		}
+	}
+	return nil
+}
+
+func formatValue(v Value) string {
+	switch v := v.(type) {
+	case *Scalar:
+		if v == nil {
+			return ""
+		}
+		return v.Value.ScalarString()
+	case *Array:
+		return v.String()
+	case *Map:
+		return v.String()
+	}
+	return ""
+}
+
+func appendIDA(ida []string, s ...string) []string {
+	return append(append([]string(nil), ida...), s...)
+}
+
+// PrimaryValue is a primary value returned by AllPrimaries, addressed like Change.
+type PrimaryValue struct {
+	// Path is relative to the map AllPrimaries was called on. For edges, it's the path of
+	// the map containing the edge.
+	Path    []string `json:"path,omitempty"`
+	Edge    *EdgeID  `json:"edge,omitempty"`
+	EdgeKey []string `json:"edge_key,omitempty"`
+
+	Value *Scalar `json:"value"`
+}
+
+// AllPrimaries returns the primary values of the fields and edges of m and its descendants,
+// reserved keywords and boards included, ordered by Path, then Edge as by CompareEdgeIDs and
+// then EdgeKey. Fields and edges without a primary value are skipped.
+func (m *Map) AllPrimaries() []PrimaryValue {
+	var pva []PrimaryValue
+	m.allPrimaries(&pva, nil, nil, nil)
+	sort.SliceStable(pva, func(i, j int) bool {
+		a, b := pva[i], pva[j]
+		if c := compareIDA(a.Path, b.Path); c != 0 {
+			return c < 0
+		}
+		if a.Edge == nil || b.Edge == nil {
+			return a.Edge == nil && b.Edge != nil
+		}
+		if c := CompareEdgeIDs(a.Edge, b.Edge); c != 0 {
+			return c < 0
+		}
+		return compareIDA(a.EdgeKey, b.EdgeKey) < 0
+	})
+	return pva
+}
+
+func (m *Map) allPrimaries(pva *[]PrimaryValue, path []string, eid *EdgeID, edgeKey []string) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		fpath, fkey := appendIDA(path, f.Name), edgeKey
+		if eid != nil {
+			fpath, fkey = path, appendIDA(edgeKey, f.Name)
+		}
+		if f.Primary_ != nil {
+			*pva = append(*pva, PrimaryValue{
+				Path:    fpath,
+				Edge:    eid,
+				EdgeKey: fkey,
+				Value:   f.Primary_,
+			})
+		}
+		f.Map().allPrimaries(pva, fpath, eid, fkey)
+	}
+	for _, e := range m.Edges {
+		if e.Primary_ != nil {
+			*pva = append(*pva, PrimaryValue{
+				Path:  path,
+				Edge:  e.ID.Copy(),
+				Value: e.Primary_,
+			})
+		}
+		e.Map_.allPrimaries(pva, path, e.ID.Copy(), nil)
+	}
+}
+
+// IntersectOptions configures IntersectWith.
+type IntersectOptions struct {
+	// ExcludeModified leaves out fields and edges present in both maps whose values differ,
+	// along with everything within them. By default they're kept without a value.
+	ExcludeModified bool
+}
+
+// Intersect returns a new root map with the fields of a also in b by path and the edges of
+// a also in b by EdgeID.Match: what Diff(a, b) reports no change for. Fields and edges
+// whose values differ are kept without a value. The references are those of a. Edges
+// are reindexed.
+func Intersect(a, b *Map) *Map {
+	return IntersectWith(a, b, IntersectOptions{})
+}
+
+// IntersectWith is like Intersect but configured by opts.
+func IntersectWith(a, b *Map, opts IntersectOptions) *Map {
+	m := intersectMap(nil, a, b, opts)
+	m.initRoot()
+	return m
+}
+
+func intersectMap(parent Node, a, b *Map, opts IntersectOptions) *Map {
+	m := &Map{
+		parent: parent,
+	}
+	if a == nil || b == nil {
+		return m
+	}
+
+	for _, af := range a.Fields {
+		bf := b.fieldByName(af.Name)
+		if bf == nil {
+			continue
+		}
+		f := &Field{
+			parent:     m,
+			Name:       af.Name,
+			References: append([]*FieldReference(nil), af.References...),
+		}
+		if !scalarEqual(af.Primary_, bf.Primary_) {
+			if opts.ExcludeModified {
+				continue
+			}
+		} else if af.Primary_ != nil {
+			f.Primary_ = af.Primary_.Copy(f).(*Scalar)
+		}
+
+		aa, aIsArray := af.Composite.(*Array)
+		ba, bIsArray := bf.Composite.(*Array)
+		switch {
+		case aIsArray && bIsArray && aa.Equal(ba):
+			f.Composite = aa.Copy(f).(*Array)
+		case aIsArray || bIsArray:
+			if opts.ExcludeModified && af.Composite != nil && bf.Composite != nil {
+				continue
+			}
+		case af.Map() != nil && bf.Map() != nil:
+			f.Composite = intersectMap(f, af.Map(), bf.Map(), opts)
+		}
+		m.Fields = append(m.Fields, f)
+	}
+
+	for _, ae := range a.Edges {
+		be := b.edgeByID(ae.ID)
+		if be == nil {
+			continue
+		}
+		e := &Edge{
+			parent:     m,
+			ID:         ae.ID.Copy(),
+			References: append([]*EdgeReference(nil), ae.References...),
+		}
+		if !scalarEqual(ae.Primary_, be.Primary_) {
+			if opts.ExcludeModified {
+				continue
+			}
+		} else if ae.Primary_ != nil {
+			e.Primary_ = ae.Primary_.Copy(e).(*Scalar)
+		}
+		if ae.Map_ != nil && be.Map_ != nil {
+			e.Map_ = intersectMap(e, ae.Map_, be.Map_, opts)
+		}
+		m.Edges = append(m.Edges, e)
+	}
+	m.reindexEdges()
+	return m
+}
+
+// EqualOptions relaxes the comparison of Map.EqualIgnoring.
+type EqualOptions struct {
+	// IgnoreFieldOrder matches fields by name rather than by position.
+	IgnoreFieldOrder bool
+	// IgnoreEdgeIndex matches edges by their endpoints rather than by position and index.
+	// Parallel edges are still matched to each other in order.
+	IgnoreEdgeIndex bool
+	// IgnorePrimaryWhitespace compares primary values with surrounding whitespace trimmed
+	// and runs of inner whitespace collapsed.
+	IgnorePrimaryWhitespace bool
+}
+
+// EqualIgnoring is like Equal but ignores the differences selected by opts. Nested maps,
+// including those of edges, are compared the same way.
+func (m *Map) EqualIgnoring(m2 *Map, opts EqualOptions) bool {
+	if m == nil || m2 == nil {
+		return m == nil && m2 == nil
+	}
+	if len(m.Fields) != len(m2.Fields) || len(m.Edges) != len(m2.Edges) {
+		return false
+	}
+
+	for i, f := range m.Fields {
+		f2 := m2.Fields[i]
+		if opts.IgnoreFieldOrder {
+			f2 = m2.fieldByName(f.Name)
+		}
+		if f2 == nil || !f.equalIgnoring(f2, opts) {
+			return false
+		}
+	}
+
+	matched := make(map[*Edge]struct{}, len(m2.Edges))
+	for i, e := range m.Edges {
+		var e2 *Edge
+		if opts.IgnoreEdgeIndex {
+			for _, e3 := range m2.Edges {
+				if _, ok := matched[e3]; !ok && e3.ID.matchEndpoints(e.ID) {
+					e2 = e3
+					break
+				}
+			}
+			if e2 == nil {
+				return false
+			}
+			matched[e2] = struct{}{}
+		} else {
+			e2 = m2.Edges[i]
+			if !e.ID.Match(e2.ID) {
+				return false
+			}
+		}
+		if !scalarEqualIgnoring(e.Primary_, e2.Primary_, opts) || !e.Map_.EqualIgnoring(e2.Map_, opts) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Field) equalIgnoring(f2 *Field, opts EqualOptions) bool {
+	if f.Name != f2.Name || !scalarEqualIgnoring(f.Primary_, f2.Primary_, opts) {
+		return false
+	}
+	if f.Composite == nil || f2.Composite == nil {
+		return f.Composite == nil && f2.Composite == nil
+	}
+	return valueEqualIgnoring(f.Composite, f2.Composite, opts)
+}
+
+func valueEqualIgnoring(v, v2 Value, opts EqualOptions) bool {
+	switch v := v.(type) {
+	case *Scalar:
+		v2, ok := v2.(*Scalar)
+		return ok && scalarEqualIgnoring(v, v2, opts)
+	case *Map:
+		v2, ok := v2.(*Map)
+		return ok && v.EqualIgnoring(v2, opts)
+	case *Array:
+		v2, ok := v2.(*Array)
+		if !ok || len(v.Values) != len(v2.Values) {
+			return false
+		}
+		for i := range v.Values {
+			if !valueEqualIgnoring(v.Values[i], v2.Values[i], opts) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func scalarEqualIgnoring(s, s2 *Scalar, opts EqualOptions) bool {
+	if !opts.IgnorePrimaryWhitespace || s == nil || s2 == nil {
+		return scalarEqual(s, s2)
+	}
+	_, isString := s.Value.(d2ast.String)
+	_, isString2 := s2.Value.(d2ast.String)
+	if !isString || !isString2 {
+		return scalarEqual(s, s2)
+	}
+	return strings.Join(strings.Fields(s.Value.ScalarString()), " ") == strings.Join(strings.Fields(s2.Value.ScalarString()), " ")
+}
+
+// Hash returns a hash of the content of m for caching: field names, primary values, edge
+// IDs and nested maps and arrays. Like Diff, it ignores the order of fields and edges and,
+// like Equal, references, so equal maps hash the same.
+func (m *Map) Hash() uint64 {
+	h := fnv.New64a()
+	m.hash(h)
+	return h.Sum64()
+}
+
+func (m *Map) hash(h hash.Hash64) {
+	if m == nil {
+		h.Write([]byte{'n'})
+		return
+	}
+	// Summing the hashes of the fields and edges makes them order independent.
+	var fields, edges uint64
+	for _, f := range m.Fields {
+		fh := fnv.New64a()
+		fh.Write([]byte(f.Name))
+		fh.Write([]byte{0})
+		hashValue(fh, f.Primary_)
+		hashValue(fh, f.Composite)
+		fields += fh.Sum64()
+	}
+	for _, e := range m.Edges {
+		eh := fnv.New64a()
+		eh.Write([]byte(e.ID.String()))
+		eh.Write([]byte{0})
+		hashValue(eh, e.Primary_)
+		e.Map_.hash(eh)
+		edges += eh.Sum64()
+	}
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], fields)
+	binary.LittleEndian.PutUint64(b[8:], edges)
+	h.Write([]byte{'m'})
+	h.Write(b[:])
+}
+
+func hashValue(h hash.Hash64, v Value) {
+	switch v := v.(type) {
+	case *Scalar:
+		if v == nil {
+			h.Write([]byte{'n'})
+			return
+		}
+		// As in Scalar.Equal, strings compare equal regardless of quoting.
+		if _, ok := v.Value.(d2ast.String); ok {
+			h.Write([]byte("string"))
+		} else {
+			h.Write([]byte(v.Value.Type()))
+		}
+		h.Write([]byte{0})
+		h.Write([]byte(v.Value.ScalarString()))
+		h.Write([]byte{0})
+	case *Map:
+		v.hash(h)
+	case *Array:
+		h.Write([]byte{'a'})
+		for _, v2 := range v.Values {
+			hashValue(h, v2)
+		}
+		h.Write([]byte{0})
+	default:
+		h.Write([]byte{'n'})
+	}
+}
+
+// Conflict is a pair of overlapping changes made by both sides of a Merge3 that disagree.
+type Conflict struct {
+	Local  Change `json:"local"`
+	Remote Change `json:"remote"`
+}
+
+// Merge3 applies the changes local and remote each made to base onto a copy of base.
+//
+// Changes made identically by both sides are applied once. Changes that disagree on the
+// same node, or where one side removes a node the other changed within, are left at their
+// base value and reported as conflicts. Parallel edges added by both sides are all kept and
+// reindexed after the existing ones.
+func Merge3(base, local, remote *Map) (*Map, []Conflict) {
+	localChanges := Diff(base, local)
+	remoteChanges := Diff(base, remote)
+
+	var conflicts []Conflict
+	localConflicted := make([]bool, len(localChanges))
+	remoteConflicted := make([]bool, len(remoteChanges))
+	remoteDup := make([]bool, len(remoteChanges))
+	for i, lc := range localChanges {
+		for j, rc := range remoteChanges {
+			if !lc.overlaps(rc) {
+				continue
+			}
+			if lc.equivalent(rc, local, remote) {
+				remoteDup[j] = true
+				continue
+			}
+			if lc.Kind == ChangeAdded && rc.Kind == ChangeAdded && lc.Edge != nil && len(lc.EdgeKey) == 0 {
+				// Both sides added a parallel edge.
+				continue
+			}
+			localConflicted[i] = true
+			remoteConflicted[j] = true
+			conflicts = append(conflicts, Conflict{
+				Local:  lc,
+				Remote: rc,
+			})
+		}
+	}
+
+	merged := base.Copy(nil).(*Map)
+	// Removals go last so that edge indexes still resolve while applying everything else.
+	for _, kind := range []ChangeKind{ChangeModified, ChangeAdded, ChangeRemoved} {
+		for i, lc := range localChanges {
+			if lc.Kind == kind && !localConflicted[i] {
+				lc.apply(merged, local)
+			}
+		}
+		for i, rc := range remoteChanges {
+			if rc.Kind == kind && !remoteConflicted[i] && !remoteDup[i] {
+				rc.apply(merged, remote)
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+// overlaps reports whether c and c2 change the same node or whether one removes an
+// ancestor of the node the other changes.
+func (c Change) overlaps(c2 Change) bool {
+	return c.sameTarget(c2) || c.removesAncestorOf(c2) || c2.removesAncestorOf(c)
+}
+
+// equivalent reports whether c made in m has the same effect as c2 made in m2.
+func (c Change) equivalent(c2 Change, m, m2 *Map) bool {
+	if c.Kind != c2.Kind || !c.sameTarget(c2) {
+		return false
+	}
+	switch c.Kind {
+	case ChangeAdded:
+		return c.node(m).Equal(c2.node(m2))
+	case ChangeModified:
+		return c.New == c2.New
+	default:
+		return true
+	}
+}
+
+func (c Change) sameTarget(c2 Change) bool {
+	if !equalIDA(c.Path, c2.Path) {
+		return false
+	}
+	if (c.Edge == nil) != (c2.Edge == nil) {
+		return false
+	}
+	if c.Edge != nil && !c.Edge.Match(c2.Edge) {
+		return false
+	}
+	return equalIDA(c.EdgeKey, c2.EdgeKey)
+}
+
+func (c Change) removesAncestorOf(c2 Change) bool {
+	if c.Kind != ChangeRemoved || c.sameTarget(c2) {
+		return false
+	}
+	if c.Edge == nil {
+		return hasPrefixIDA(c2.Path, c.Path)
+	}
+	if !equalIDA(c.Path, c2.Path) || c2.Edge == nil || !c.Edge.Match(c2.Edge) {
+		return false
+	}
+	return hasPrefixIDA(c2.EdgeKey, c.EdgeKey)
+}
+
+// node returns the node c refers to in m.
+func (c Change) node(m *Map) Node {
+	scope := m
+	if len(c.Path) > 0 {
+		f := m.GetField(c.Path...)
+		if f == nil {
+			return nil
+		}
+		if c.Edge == nil {
+			return f
+		}
+		scope = f.Map()
+		if scope == nil {
+			return nil
+		}
+	}
+	e := scope.edgeByID(c.Edge)
+	if e == nil {
+		return nil
+	}
+	if len(c.EdgeKey) == 0 {
+		return e
+	}
+	if e.Map_ == nil {
+		return nil
+	}
+	f := e.Map_.GetField(c.EdgeKey...)
+	if f == nil {
+		return nil
+	}
+	return f
+}
+
+// parentMap returns the map in m that holds the node c refers to, creating it if the
+// holding field or edge exists without one.
+func (c Change) parentMap(m *Map) *Map {
+	scopePath := c.Path
+	if c.Edge == nil {
+		scopePath = c.Path[:len(c.Path)-1]
+	}
+	scope := m
+	if len(scopePath) > 0 {
+		scope = ensureChildMap(m.GetField(scopePath...))
+		if scope == nil {
+			return nil
+		}
+	}
+	if c.Edge == nil || len(c.EdgeKey) == 0 {
+		return scope
+	}
+
+	e := scope.edgeByID(c.Edge)
+	if e == nil {
+		return nil
+	}
+	if len(c.EdgeKey) == 1 {
+		return e.EnsureMap()
+	}
+	return ensureChildMap(e.EnsureMap().GetField(c.EdgeKey[:len(c.EdgeKey)-1]...))
+}
+
+func ensureChildMap(f *Field) *Map {
+	if f == nil {
+		return nil
+	}
+	return f.EnsureMap()
+}
+
+// apply applies c to dst taking new values from src.
+func (c Change) apply(dst, src *Map) {
+	pm := c.parentMap(dst)
+	if pm == nil {
+		return
+	}
+
+	switch c.Kind {
+	case ChangeRemoved:
+		if c.Edge != nil && len(c.EdgeKey) == 0 {
+			pm.DeleteEdge(c.Edge)
+			return
+		}
+		pm.DeleteField(c.name())
+	case ChangeAdded:
+		switch n := c.node(src).(type) {
+		case *Field:
+			pm.Fields = append(pm.Fields, n.Copy(pm).(*Field))
+		case *Edge:
+			e := n.Copy(pm).(*Edge)
+			e.ID = e.ID.Copy()
+			pm.appendEdge(e)
+		}
+	case ChangeModified:
+		switch n := c.node(src).(type) {
+		case *Field:
+			f, ok := c.node(dst).(*Field)
+			if !ok {
+				return
+			}
+			f.Primary_ = nil
+			if n.Primary_ != nil {
+				f.Primary_ = n.Primary_.Copy(f).(*Scalar)
+			}
+			_, isArray := f.Composite.(*Array)
+			_, isArray2 := n.Composite.(*Array)
+			if isArray || isArray2 {
+				f.Composite = nil
+				if n.Composite != nil {
+					f.Composite = n.Composite.Copy(f).(Composite)
+				}
+			}
+		case *Edge:
+			e, ok := c.node(dst).(*Edge)
+			if !ok {
+				return
+			}
+			e.Primary_ = nil
+			if n.Primary_ != nil {
+				e.Primary_ = n.Primary_.Copy(e).(*Scalar)
+			}
+		}
+	}
+}
+
+func (c Change) name() string {
+	if len(c.EdgeKey) > 0 {
+		return c.EdgeKey[len(c.EdgeKey)-1]
+	}
+	return c.Path[len(c.Path)-1]
+}
+
+func equalIDA(ida, ida2 []string) bool {
+	return len(ida) == len(ida2) && hasPrefixIDA(ida, ida2)
+}
+
+func hasPrefixIDA(ida, prefix []string) bool {
+	if len(ida) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if !strings.EqualFold(ida[i], prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
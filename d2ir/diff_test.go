@@ -0,0 +1,324 @@
+package d2ir_test
+
+import (
+	"strings"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	a := mustCompile(t, `x: 1
+y: {
+  z: hi
+}
+w
+a -> b: old
+a -> b
+`)
+	b := mustCompile(t, `y: {
+  z: bye
+}
+x: 1
+v
+a -> b: new
+a -> b
+(a -> b)[1].style.stroke: red
+`)
+
+	changes := d2ir.Diff(a, b)
+	assert.Equal(t, 5, len(changes))
+
+	assert.Equal(t, d2ir.ChangeModified, changes[0].Kind)
+	assert.JSON(t, []string{"y", "z"}, changes[0].Path)
+	assert.Equal(t, "hi", changes[0].Old)
+	assert.Equal(t, "bye", changes[0].New)
+
+	assert.Equal(t, d2ir.ChangeRemoved, changes[1].Kind)
+	assert.JSON(t, []string{"w"}, changes[1].Path)
+
+	assert.Equal(t, d2ir.ChangeAdded, changes[2].Kind)
+	assert.JSON(t, []string{"v"}, changes[2].Path)
+
+	assert.Equal(t, d2ir.ChangeModified, changes[3].Kind)
+	assert.Equal(t, 0, *changes[3].Edge.Index)
+	assert.Equal(t, "old", changes[3].Old)
+	assert.Equal(t, "new", changes[3].New)
+
+	assert.Equal(t, d2ir.ChangeAdded, changes[4].Kind)
+	assert.Equal(t, 1, *changes[4].Edge.Index)
+	assert.JSON(t, []string{"style"}, changes[4].EdgeKey)
+
+	assert.Equal(t, 0, len(d2ir.Diff(b, b)))
+}
+
+func TestMerge3(t *testing.T) {
+	t.Parallel()
+
+	base := mustCompile(t, `x: 1
+y: {
+  z: 1
+}
+w: 1
+a -> b
+`)
+	local := mustCompile(t, `x: 2
+y: {
+  z: 1
+}
+w: 2
+a -> b
+a -> b: local
+l
+`)
+	remote := mustCompile(t, `x: 1
+y: {
+  z: 3
+}
+w: 3
+a -> b
+a -> b: remote
+r
+`)
+
+	merged, conflicts := d2ir.Merge3(base, local, remote)
+	assert.Equal(t, 1, len(conflicts))
+	assert.JSON(t, []string{"w"}, conflicts[0].Local.Path)
+	assert.Equal(t, "2", conflicts[0].Local.New)
+	assert.Equal(t, "3", conflicts[0].Remote.New)
+
+	assert.Equal(t, "2", merged.GetField("x").Primary().Value.ScalarString())
+	assert.Equal(t, "3", merged.GetField("y", "z").Primary().Value.ScalarString())
+	assert.Equal(t, "1", merged.GetField("w").Primary().Value.ScalarString())
+	assert.NotEqual(t, nil, merged.GetField("l"))
+	assert.NotEqual(t, nil, merged.GetField("r"))
+
+	ea := merged.GetEdges(&d2ir.EdgeID{SrcPath: []string{"a"}, DstPath: []string{"b"}, DstArrow: true}, nil)
+	assert.Equal(t, 3, len(ea))
+	assert.Equal(t, "local", ea[1].Primary().Value.ScalarString())
+	assert.Equal(t, "remote", ea[2].Primary().Value.ScalarString())
+	assert.Equal(t, 2, *ea[2].ID.Index)
+
+	// base is left untouched.
+	assert.Equal(t, 1, len(base.Edges))
+
+	_, conflicts = d2ir.Merge3(base, mustCompile(t, `x: 1
+w: 1
+a -> b
+`), remote)
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, d2ir.ChangeRemoved, conflicts[0].Local.Kind)
+	assert.JSON(t, []string{"y", "z"}, conflicts[0].Remote.Path)
+}
+
+func TestEqualIgnoring(t *testing.T) {
+	t.Parallel()
+
+	a := mustCompile(t, `x: "hello   world "
+y: {
+  z
+  w
+}
+a -> b
+c -> d
+`)
+	b := mustCompile(t, `y: {
+  w
+  z
+}
+x: hello world
+c -> d
+a -> b
+`)
+	idx := 5
+	b.Edges[1].ID.Index = &idx
+
+	assert.False(t, a.Equal(b))
+	assert.False(t, a.EqualIgnoring(b, d2ir.EqualOptions{}))
+	assert.False(t, a.EqualIgnoring(b, d2ir.EqualOptions{
+		IgnoreFieldOrder: true,
+		IgnoreEdgeIndex:  true,
+	}))
+	assert.False(t, a.EqualIgnoring(b, d2ir.EqualOptions{
+		IgnoreFieldOrder:        true,
+		IgnorePrimaryWhitespace: true,
+	}))
+	assert.True(t, a.EqualIgnoring(b, d2ir.EqualOptions{
+		IgnoreFieldOrder:        true,
+		IgnoreEdgeIndex:         true,
+		IgnorePrimaryWhitespace: true,
+	}))
+	assert.True(t, a.EqualIgnoring(a.Copy(nil).(*d2ir.Map), d2ir.EqualOptions{}))
+
+	c := mustCompile(t, `x: hello world
+y: {
+  w
+  z
+}
+c -> d
+a -> b: label
+`)
+	assert.False(t, a.EqualIgnoring(c, d2ir.EqualOptions{
+		IgnoreFieldOrder:        true,
+		IgnoreEdgeIndex:         true,
+		IgnorePrimaryWhitespace: true,
+	}))
+}
+
+func TestHash(t *testing.T) {
+	t.Parallel()
+
+	a := mustCompile(t, `x: hello
+y: {
+  z: [1; 2]
+  w.style.fill: red
+}
+a -> b: {style.stroke: blue}
+c -> d
+`)
+	b := mustCompile(t, `c -> d
+y: {
+  w.style.fill: red
+  z: [1; 2]
+}
+a -> b: {style.stroke: blue}
+x: "hello"
+`)
+	assert.Equal(t, a.Hash(), b.Hash())
+	assert.Equal(t, a.Hash(), a.Copy(nil).(*d2ir.Map).Hash())
+	assert.Equal(t, a.Hash(), mustCompile(t, a.String()).Hash())
+
+	for _, s := range []string{
+		`x: hello
+y: {
+  z: [2; 1]
+  w.style.fill: red
+}
+a -> b: {style.stroke: blue}
+c -> d
+`,
+		`x: hello
+y: {
+  z: [1; 2]
+  w.style.fill: blue
+}
+a -> b: {style.stroke: blue}
+c -> d
+`,
+		`x: hello
+y: {
+  z: [1; 2]
+  w.style.fill: red
+}
+a -> b: {style.stroke: blue}
+c <- d
+`,
+		`x: hello
+y: {
+  z: [1; 2]
+  w.style.fill: red
+}
+a -> b: {style.stroke: blue}
+c -> d
+c -> d
+`,
+	} {
+		assert.True(t, a.Hash() != mustCompile(t, s).Hash())
+	}
+	assert.True(t, mustCompile(t, `x: 1`).Hash() != mustCompile(t, `x: "1"`).Hash())
+}
+
+func TestIntersect(t *testing.T) {
+	t.Parallel()
+
+	a := mustCompile(t, `x: 1
+y: {
+  z: hi
+  q
+}
+w
+a -> b: old
+a -> b
+a -> b
+c -> d
+`)
+	b := mustCompile(t, `y: {
+  z: bye
+  q
+}
+x: 1
+v
+a -> b: new
+a -> b
+`)
+
+	m := d2ir.Intersect(a, b)
+	assert.String(t, `x: 1
+y: {
+  z
+  q
+}
+a
+b
+a -> b
+a -> b
+`, m.String())
+	assert.True(t, m.Root())
+	assert.True(t, m.GetField("y", "q").References[0] == a.GetField("y", "q").References[0])
+
+	m = d2ir.IntersectWith(a, b, d2ir.IntersectOptions{ExcludeModified: true})
+	assert.String(t, `x: 1
+y: {
+  q
+}
+a
+b
+a -> b
+`, m.String())
+	assert.Equal(t, 0, *m.Edges[0].ID.Index)
+	assert.Equal(t, 0, len(m.CheckEdgeIndices()))
+
+	assert.True(t, d2ir.Intersect(a, a).Equal(a))
+}
+
+func TestAllPrimaries(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `z: last
+b: {
+  shape: circle
+  c
+}
+a -> b: link
+(a -> b)[0].style.stroke: red
+a.label: first
+layers: {
+  l: {
+    x: 1
+  }
+}
+`)
+	var got []string
+	for _, pv := range m.AllPrimaries() {
+		s := strings.Join(pv.Path, ".")
+		if pv.Edge != nil {
+			s += " " + pv.Edge.String()
+		}
+		if len(pv.EdgeKey) > 0 {
+			s += " " + strings.Join(pv.EdgeKey, ".")
+		}
+		got = append(got, s+": "+pv.Value.Value.ScalarString())
+	}
+	assert.JSON(t, []string{
+		" (a -> b)[0]: link",
+		" (a -> b)[0] style.stroke: red",
+		"a.label: first",
+		"b.shape: circle",
+		"layers.l.x: 1",
+		"z: last",
+	}, got)
+}
@@ -0,0 +1,42 @@
+package d2ir
+
+import (
+	"errors"
+	"fmt"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2parser"
+)
+
+// Kinds of compile errors. The errors returned by Compile wrap them as a *NodeError so
+// callers can check for them with errors.Is and find the offending node with errors.As
+// rather than matching on messages.
+var (
+	ErrInvalidUnderscore = errors.New("invalid underscore")
+	ErrIndexIntoArray    = errors.New("cannot index into array")
+	ErrReservedInEdge    = errors.New("reserved keywords are prohibited in edges")
+)
+
+// NodeError is an error of kind Err caused by the AST node Node.
+type NodeError struct {
+	Node d2ast.Node
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Node.GetRange(), e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// kindErrorf is like d2parser.Errorf but the error also wraps a *NodeError of kind.
+func kindErrorf(kind error, n d2ast.Node, f string, v ...interface{}) error {
+	err := d2parser.Errorf(n, f, v...).(d2ast.Error)
+	err.Err = &NodeError{
+		Node: n,
+		Err:  kind,
+	}
+	return err
+}
@@ -0,0 +1,392 @@
+package d2ir
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
+	"oss.terrastruct.com/d2/d2graph"
+)
+
+// graph is the node graph of a single board: every non-keyword field in the board and the
+// edges between them. Nested boards are not included.
+type graph struct {
+	// nodes in declaration order.
+	nodes []*Field
+	order map[*Field]int
+	edges []graphEdge
+}
+
+type graphEdge struct {
+	e        *Edge
+	src, dst *Field
+}
+
+// directed reports whether ge has a single arrow and so a direction.
+func (ge graphEdge) directed() bool {
+	return ge.e.ID.SrcArrow != ge.e.ID.DstArrow
+}
+
+// from and to return the endpoints of ge in the direction of its arrow. a <- b goes from
+// b to a.
+func (ge graphEdge) from() *Field {
+	if ge.e.ID.SrcArrow && !ge.e.ID.DstArrow {
+		return ge.dst
+	}
+	return ge.src
+}
+
+func (ge graphEdge) to() *Field {
+	if ge.e.ID.SrcArrow && !ge.e.ID.DstArrow {
+		return ge.src
+	}
+	return ge.dst
+}
+
+func newGraph(m *Map) *graph {
+	g := &graph{
+		order: make(map[*Field]int),
+	}
+	g.addMap(m)
+	return g
+}
+
+func (g *graph) addMap(m *Map) {
+	for _, f := range m.Fields {
+		if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
+			continue
+		}
+		if NodeBoardKind(f) != "" {
+			continue
+		}
+		g.order[f] = len(g.nodes)
+		g.nodes = append(g.nodes, f)
+		if f.Map() != nil {
+			g.addMap(f.Map())
+		}
+	}
+	if len(m.Edges) == 0 {
+		return
+	}
+	// Index the fields by name as GetField scans them for every endpoint.
+	byName := make(map[string]*Field, len(m.Fields))
+	for _, f := range m.Fields {
+		name := strings.ToLower(f.Name)
+		if _, ok := byName[name]; !ok {
+			byName[name] = f
+		}
+	}
+	getField := func(ida []string) *Field {
+		f := byName[strings.ToLower(ida[0])]
+		if f == nil || len(ida) == 1 {
+			return f
+		}
+		if f.Map() == nil {
+			return nil
+		}
+		return f.Map().GetField(ida[1:]...)
+	}
+	for _, e := range m.Edges {
+		src := getField(e.ID.SrcPath)
+		dst := getField(e.ID.DstPath)
+		if src == nil || dst == nil {
+			continue
+		}
+		g.edges = append(g.edges, graphEdge{
+			e:   e,
+			src: src,
+			dst: dst,
+		})
+	}
+}
+
+// TopoSort returns the fields of the board m ordered so that every directed edge goes
+// forward. a -> b goes from a to b and a <- b from b to a. Undirected edges, i.e. a -- b
+// and a <-> b, don't constrain the order. Fields with edges come first, ties broken by
+// declaration order, followed by fields without edges in declaration order. Reserved
+// keywords and nested boards are skipped.
+//
+// An error describing a cycle is returned if there's no such order.
+func (m *Map) TopoSort() ([]*Field, error) {
+	g := newGraph(m)
+
+	// Kahn's algorithm with the ready fields kept in a heap by declaration order.
+	connected := make(map[*Field]bool)
+	out := make(map[*Field][]*Field)
+	in := make(map[*Field][]*Field)
+	indegree := make(map[*Field]int)
+	for _, ge := range g.edges {
+		connected[ge.src] = true
+		connected[ge.dst] = true
+		if ge.directed() {
+			out[ge.from()] = append(out[ge.from()], ge.to())
+			in[ge.to()] = append(in[ge.to()], ge.from())
+			indegree[ge.to()]++
+		}
+	}
+
+	ready := &fieldHeap{order: g.order}
+	for _, f := range g.nodes {
+		if connected[f] && indegree[f] == 0 {
+			ready.fa = append(ready.fa, f)
+		}
+	}
+	// g.nodes is in declaration order so ready is already a heap.
+
+	var sorted []*Field
+	done := make(map[*Field]bool)
+	for ready.Len() > 0 {
+		f := heap.Pop(ready).(*Field)
+		done[f] = true
+		sorted = append(sorted, f)
+		for _, to := range out[f] {
+			indegree[to]--
+			if indegree[to] == 0 {
+				heap.Push(ready, to)
+			}
+		}
+	}
+
+	for _, f := range g.nodes {
+		if !done[f] && connected[f] {
+			return nil, fmt.Errorf("cycle: %s", g.formatCycle(findCycle(f, in, done)))
+		}
+	}
+	for _, f := range g.nodes {
+		if !done[f] {
+			sorted = append(sorted, f)
+		}
+	}
+	return sorted, nil
+}
+
+// fieldHeap is a heap of fields by their declaration order.
+type fieldHeap struct {
+	fa    []*Field
+	order map[*Field]int
+}
+
+func (h *fieldHeap) Len() int           { return len(h.fa) }
+func (h *fieldHeap) Less(i, j int) bool { return h.order[h.fa[i]] < h.order[h.fa[j]] }
+func (h *fieldHeap) Swap(i, j int)      { h.fa[i], h.fa[j] = h.fa[j], h.fa[i] }
+func (h *fieldHeap) Push(x interface{}) { h.fa = append(h.fa, x.(*Field)) }
+func (h *fieldHeap) Pop() interface{} {
+	f := h.fa[len(h.fa)-1]
+	h.fa = h.fa[:len(h.fa)-1]
+	return f
+}
+
+// findCycle returns a cycle found by walking directed edges backwards from f, using in, the
+// fields with a directed edge to each field, through fields that are not done. Every such
+// field has an incoming directed edge from another so the walk must eventually revisit a
+// field.
+func findCycle(f *Field, in map[*Field][]*Field, done map[*Field]bool) []*Field {
+	var path []*Field
+	seen := make(map[*Field]int)
+	for {
+		if i, ok := seen[f]; ok {
+			// path was walked backwards from f.
+			cycle := []*Field{f}
+			for j := len(path) - 1; j >= i; j-- {
+				cycle = append(cycle, path[j])
+			}
+			return cycle
+		}
+		seen[f] = len(path)
+		path = append(path, f)
+		for _, from := range in[f] {
+			if !done[from] {
+				f = from
+				break
+			}
+		}
+	}
+}
+
+func (g *graph) formatCycle(cycle []*Field) string {
+	var sb strings.Builder
+	for i, f := range cycle {
+		if i > 0 {
+			sb.WriteString(" -> ")
+		}
+		sb.WriteString(d2format.Format(d2ast.MakeKeyPath(BoardIDA(f))))
+	}
+	return sb.String()
+}
+
+// ConnectedComponents returns the weakly connected components of the board m. Its top level
+// fields are the nodes and an edge to a field nested in a container connects the container.
+// Fields without edges are components on their own. Components are ordered by their first
+// field and fields by declaration order.
+func (m *Map) ConnectedComponents() [][]*Field {
+	g := newGraph(m)
+	var nodes []*Field
+	for _, f := range g.nodes {
+		if ParentMap(f) == m {
+			nodes = append(nodes, f)
+		}
+	}
+	topLevel := func(f *Field) []*Field {
+		for ParentMap(f) != m {
+			f = ParentField(f)
+		}
+		return []*Field{f}
+	}
+	return g.components(nodes, topLevel)
+}
+
+// ConnectedLeafComponents is like ConnectedComponents but containers are expanded to their
+// leaves: the nodes are the fields of m at any depth without children and an edge to a
+// container connects all of its leaves.
+func (m *Map) ConnectedLeafComponents() [][]*Field {
+	g := newGraph(m)
+	var nodes []*Field
+	for _, f := range g.nodes {
+		if !f.Map().IsContainer() {
+			nodes = append(nodes, f)
+		}
+	}
+	leaves := func(f *Field) []*Field {
+		if !f.Map().IsContainer() {
+			return []*Field{f}
+		}
+		var leaves []*Field
+		for _, n := range nodes {
+			for p := ParentField(n); p != nil; p = ParentField(p) {
+				if p == f {
+					leaves = append(leaves, n)
+					break
+				}
+			}
+		}
+		return leaves
+	}
+	return g.components(nodes, leaves)
+}
+
+// components returns the connected components of nodes where each edge connects all the
+// nodes its endpoints resolve to.
+func (g *graph) components(nodes []*Field, resolve func(*Field) []*Field) [][]*Field {
+	parent := make(map[*Field]*Field)
+	var find func(f *Field) *Field
+	find = func(f *Field) *Field {
+		if parent[f] == nil || parent[f] == f {
+			return f
+		}
+		parent[f] = find(parent[f])
+		return parent[f]
+	}
+	union := func(f, f2 *Field) {
+		r, r2 := find(f), find(f2)
+		if r != r2 {
+			parent[r2] = r
+		}
+	}
+
+	for _, ge := range g.edges {
+		fa := append(resolve(ge.src), resolve(ge.dst)...)
+		for _, f := range fa[1:] {
+			union(fa[0], f)
+		}
+	}
+
+	var components [][]*Field
+	index := make(map[*Field]int)
+	for _, f := range nodes {
+		r := find(f)
+		i, ok := index[r]
+		if !ok {
+			i = len(components)
+			index[r] = i
+			components = append(components, nil)
+		}
+		components[i] = append(components[i], f)
+	}
+	return components
+}
+
+// Neighbors returns the fields connected to the field at path by an edge going into it and
+// by an edge going out of it. Edges of the whole board containing the field are scanned.
+// Undirected edges, i.e. a -- b and a <-> b, go both ways so their other endpoint is in both
+// in and out. A self loop makes the field its own neighbor once in each. Each neighbor is
+// listed once in order of the edges.
+func (m *Map) Neighbors(path []string) (in, out []*Field) {
+	f, g := m.fieldGraph(path)
+	if f == nil {
+		return nil, nil
+	}
+	add := func(fa []*Field, f2 *Field) []*Field {
+		for _, f3 := range fa {
+			if f3 == f2 {
+				return fa
+			}
+		}
+		return append(fa, f2)
+	}
+	g.walkEdges(f, func(ge graphEdge, inbound bool) {
+		if inbound {
+			in = add(in, ge.from())
+		} else {
+			out = add(out, ge.to())
+		}
+	})
+	return in, out
+}
+
+// Degree returns the number of edges going into and out of the field at path, following the
+// same rules as Neighbors. Parallel edges are each counted.
+func (m *Map) Degree(path []string) (inDeg, outDeg int) {
+	f, g := m.fieldGraph(path)
+	if f == nil {
+		return 0, 0
+	}
+	g.walkEdges(f, func(ge graphEdge, inbound bool) {
+		if inbound {
+			inDeg++
+		} else {
+			outDeg++
+		}
+	})
+	return inDeg, outDeg
+}
+
+// fieldGraph returns the field at path and the graph of the board containing it.
+func (m *Map) fieldGraph(path []string) (*Field, *graph) {
+	f := m.GetField(path...)
+	if f == nil {
+		return nil, nil
+	}
+	board := ParentMap(f)
+	for NodeBoardKind(board) == "" {
+		board = ParentMap(board)
+	}
+	return f, newGraph(board)
+}
+
+// walkEdges calls fn for each edge of f, once with inbound set if the edge goes into f and
+// once with inbound unset if it goes out of f. Undirected edges go both ways, with from and
+// to oriented as if f were the destination or the source respectively.
+func (g *graph) walkEdges(f *Field, fn func(ge graphEdge, inbound bool)) {
+	for _, ge := range g.edges {
+		if ge.src != f && ge.dst != f {
+			continue
+		}
+		if !ge.directed() {
+			other := ge.dst
+			if other == f {
+				other = ge.src
+			}
+			fn(graphEdge{e: ge.e, src: other, dst: f}, true)
+			fn(graphEdge{e: ge.e, src: f, dst: other}, false)
+			continue
+		}
+		if ge.to() == f {
+			fn(ge, true)
+		}
+		if ge.from() == f {
+			fn(ge, false)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package d2ir_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func boardIDAs(fa []*d2ir.Field) string {
+	var paths []string
+	for _, f := range fa {
+		paths = append(paths, strings.Join(d2ir.BoardIDA(f), "."))
+	}
+	return strings.Join(paths, ", ")
+}
+
+func TestTopoSort(t *testing.T) {
+	t.Parallel()
+
+	t.Run("dag", func(t *testing.T) {
+		t.Parallel()
+
+		m := mustCompile(t, `lonely
+d
+c -> d
+b -> c
+a -> b
+a -> c
+e <- d
+x: {
+  y
+}
+x.y -- a
+style.fill: red
+layers: {
+  l: {
+    z -> a
+  }
+}
+`)
+		fa, err := m.TopoSort()
+		assert.Success(t, err)
+		assert.String(t, "a, b, c, d, e, x.y, lonely, x", boardIDAs(fa))
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		t.Parallel()
+
+		m := mustCompile(t, `start -> a
+a -> b
+b -> c
+c -> a
+`)
+		_, err := m.TopoSort()
+		assert.ErrorString(t, err, "cycle: a -> b -> c -> a")
+	})
+
+	t.Run("self-loop", func(t *testing.T) {
+		t.Parallel()
+
+		m := mustCompile(t, `a -> a`)
+		_, err := m.TopoSort()
+		assert.ErrorString(t, err, "cycle: a -> a")
+	})
+
+	t.Run("deleted-endpoint", func(t *testing.T) {
+		t.Parallel()
+
+		m := mustCompile(t, `a.b -> c`)
+		m.GetField("a").Map().DeleteField("b")
+		m.Prune()
+		assert.True(t, m.GetField("a").Map() == nil)
+
+		fa, err := m.TopoSort()
+		assert.Success(t, err)
+		assert.String(t, "a, c", boardIDAs(fa))
+		assert.Equal(t, 2, len(m.ConnectedComponents()))
+		in, out := m.Neighbors([]string{"c"})
+		assert.String(t, "", boardIDAs(in))
+		assert.String(t, "", boardIDAs(out))
+		inDeg, outDeg := m.Degree([]string{"c"})
+		assert.Equal(t, 0, inDeg)
+		assert.Equal(t, 0, outDeg)
+	})
+}
+
+func BenchmarkTopoSort(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "n%d -> n%d\n", i, i+1)
+	}
+	m := mustCompile(b, sb.String())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := m.TopoSort()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConnectedComponents(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `lonely
+a -> b
+c -- d
+b <- d
+x: {
+  y
+  z
+}
+x.y -> e
+f
+style.fill: red
+layers: {
+  l: {
+    f -> lonely
+  }
+}
+`)
+	var components []string
+	for _, fa := range m.ConnectedComponents() {
+		components = append(components, boardIDAs(fa))
+	}
+	assert.JSON(t, []string{
+		"lonely",
+		"a, b, c, d",
+		"x, e",
+		"f",
+	}, components)
+
+	components = nil
+	for _, fa := range m.ConnectedLeafComponents() {
+		components = append(components, boardIDAs(fa))
+	}
+	assert.JSON(t, []string{
+		"lonely",
+		"a, b, c, d",
+		"x.y, e",
+		"x.z",
+		"f",
+	}, components)
+
+	m = mustCompile(t, `x: {
+  y
+  z
+}
+x -> w
+`)
+	components = nil
+	for _, fa := range m.ConnectedLeafComponents() {
+		components = append(components, boardIDAs(fa))
+	}
+	assert.JSON(t, []string{
+		"x.y, x.z, w",
+	}, components)
+}
+
+func TestNeighbors(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+b
+c
+d
+* -> nexus
+`)
+	in, out := m.Neighbors([]string{"nexus"})
+	assert.String(t, "a, b, c, d", boardIDAs(in))
+	assert.String(t, "", boardIDAs(out))
+	inDeg, outDeg := m.Degree([]string{"nexus"})
+	assert.Equal(t, 4, inDeg)
+	assert.Equal(t, 0, outDeg)
+
+	in, out = m.Neighbors([]string{"a"})
+	assert.String(t, "", boardIDAs(in))
+	assert.String(t, "nexus", boardIDAs(out))
+	inDeg, outDeg = m.Degree([]string{"a"})
+	assert.Equal(t, 0, inDeg)
+	assert.Equal(t, 1, outDeg)
+
+	m = mustCompile(t, `a -> a
+a -> b
+a -> b
+a <- c
+a -- d
+x: {
+  y -> _.a
+}
+`)
+	in, out = m.Neighbors([]string{"a"})
+	assert.String(t, "a, c, d, x.y", boardIDAs(in))
+	assert.String(t, "a, b, d", boardIDAs(out))
+	inDeg, outDeg = m.Degree([]string{"a"})
+	assert.Equal(t, 4, inDeg)
+	assert.Equal(t, 4, outDeg)
+
+	in, out = m.GetField("x").Map().Neighbors([]string{"_", "b"})
+	assert.String(t, "a", boardIDAs(in))
+	assert.String(t, "", boardIDAs(out))
+
+	inDeg, outDeg = m.Degree([]string{"nope"})
+	assert.Equal(t, 0, inDeg)
+	assert.Equal(t, 0, outDeg)
+}
@@ -1,5 +1,70 @@
 package d2ir
 
+import "oss.terrastruct.com/d2/d2graph"
+
+// Spread merges copies of the fields and edges of src into m as if ...@src had been written
+// in m: fields and edges already in m are overlaid rather than replaced, the references of
+// src are carried over and the edge indices of m are recomputed.
+//
+// Globs in m were applied when it was compiled and aren't applied again to what Spread
+// adds, nor are globs of src applied to m. Spread before compiling the globs, e.g. by
+// spreading an import in source, if they should apply.
+func (m *Map) Spread(src *Map) {
+	OverlayMap(m, src)
+	m.reindexEdgesRecursive()
+}
+
+// Rebase moves the content of m under the field at prefix, creating it, as if every path
+// in m had prefix prepended, e.g. a -> b becomes sub.a -> sub.b for prefix sub. Edges are
+// kept in the map of the longest common path of their ends so that one moves as is into
+// the map at prefix: its path there is unchanged. No underscores need adjusting as they're
+// resolved away when edges are created. Boards of m stay boards of m. The fields of prefix
+// are created as by Map.Field.
+//
+// Spread a rebased map to embed it within another under prefix.
+func (m *Map) Rebase(prefix []string) {
+	if len(prefix) == 0 {
+		return
+	}
+	var fields []*Field
+	var boards []*Field
+	for _, f := range m.Fields {
+		if _, ok := d2graph.BoardKeywords[f.Name]; ok {
+			boards = append(boards, f)
+		} else {
+			fields = append(fields, f)
+		}
+	}
+
+	m.Fields = boards
+	inner := m
+	for _, name := range prefix {
+		inner = inner.Field(name).EnsureMap()
+	}
+	inner.Fields = fields
+	for _, f := range fields {
+		f.parent = inner
+	}
+	inner.Edges = m.Edges
+	m.Edges = nil
+	for _, e := range inner.Edges {
+		e.parent = inner
+	}
+}
+
+func (m *Map) reindexEdgesRecursive() {
+	if m == nil {
+		return
+	}
+	m.reindexEdges()
+	for _, f := range m.Fields {
+		f.Map().reindexEdgesRecursive()
+	}
+	for _, e := range m.Edges {
+		e.Map_.reindexEdgesRecursive()
+	}
+}
+
 func OverlayMap(base, overlay *Map) {
 	for _, of := range overlay.Fields {
 		bf := base.GetField(of.Name)
@@ -0,0 +1,93 @@
+package d2ir_test
+
+import (
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2ir"
+)
+
+func TestSpread(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+x: {
+  label: x
+  style.stroke: blue
+}
+*.style.fill: red
+`)
+	lib := mustCompile(t, `a -> b: lib
+a -> b
+b -> c
+x: {
+  shape: circle
+  y
+}
+`)
+	m.Spread(lib)
+
+	exp := mustCompile(t, `a -> b: lib
+a -> b
+b -> c
+a.style.fill: red
+b.style.fill: red
+x: {
+  label: x
+  style.stroke: blue
+  style.fill: red
+  shape: circle
+  y
+}
+c
+`)
+	assert.True(t, m.GetField("c") != nil)
+	assert.True(t, m.GetField("c", "style") == nil)
+	assert.Equal(t, 3, len(m.Edges))
+	assert.Equal(t, "lib", m.Edges[0].Primary_.Value.ScalarString())
+	assert.Equal(t, 2, len(m.Edges[0].References))
+	assert.Equal(t, 1, *m.Edges[1].ID.Index)
+	assert.True(t, m.EqualIgnoring(exp, d2ir.EqualOptions{IgnoreFieldOrder: true}))
+
+	// The copies belong to m.
+	assert.True(t, d2ir.ParentMap(m.GetField("x", "y")) == m.GetField("x").Map())
+	assert.True(t, lib.GetField("x", "y") != m.GetField("x", "y"))
+}
+
+func TestRebase(t *testing.T) {
+	t.Parallel()
+
+	lib := mustCompile(t, `a -> b
+b: {
+  c -> d
+}
+layers: {
+  l: {
+    x
+  }
+}
+`)
+	lib.Rebase([]string{"sub"})
+	assert.Equal(t, 2, len(lib.Fields))
+	assert.Equal(t, 0, len(lib.Edges))
+	assert.True(t, lib.GetField("sub", "b", "c") != nil)
+	assert.True(t, lib.GetField("layers", "l", "x") != nil)
+	assert.True(t, d2ir.ParentMap(lib.GetField("sub", "a")) == lib.GetField("sub").Map())
+	assert.Equal(t, "sub", lib.GetField("sub").LastRef().AST().(d2ast.String).ScalarString())
+
+	m := mustCompile(t, `sub
+x -> sub
+`)
+	m.Spread(lib)
+	eid, err := d2ir.ParseEdgeID(`sub.a -> sub.b`)
+	assert.Success(t, err)
+	ea := m.GetEdges(eid, nil)
+	assert.Equal(t, 1, len(ea))
+	em := d2ir.ParentMap(ea[0])
+	assert.True(t, em.GetField(ea[0].ID.SrcPath...) == m.GetField("sub", "a"))
+	assert.True(t, em.GetField(ea[0].ID.DstPath...) == m.GetField("sub", "b"))
+	assert.Equal(t, 1, len(m.GetField("sub", "b").Map().Edges))
+	assert.True(t, m.Equal(mustCompile(t, m.String())))
+}
@@ -3,19 +3,42 @@ package d2ir
 import (
 	"strings"
 
+	"oss.terrastruct.com/d2/d2ast"
 	"oss.terrastruct.com/d2/d2graph"
 )
 
-func (m *Map) doubleGlob(pattern []string) ([]*Field, bool) {
-	if !(len(pattern) == 3 && pattern[0] == "*" && pattern[1] == "" && pattern[2] == "*") {
+// doubleGlob returns the fields matched by the double glob **, i.e. all fields in m at any
+// depth. **(leaf) only matches fields without children and **(container) only those with.
+//
+// The fields are in pre-order: each field is followed by its descendants and siblings are in
+// declaration order. All matches are collected before the caller creates anything for the
+// rest of the key so fields created for **.x are neither matched nor affect the order.
+//
+// If c is non-nil, the walk stops early once c is stopped, e.g. by its context being done,
+// and the fields matched so far are returned.
+func (m *Map) doubleGlob(pattern []string, c *compiler) ([]*Field, bool) {
+	qualifier, ok := d2ast.ParseDoubleGlob(pattern)
+	if !ok {
 		return nil, false
 	}
 	var fa []*Field
-	m._doubleGlob(&fa)
+	m._doubleGlob(&fa, c)
+	if qualifier != "" {
+		fa2 := fa[:0]
+		for _, f := range fa {
+			if f.Map().IsContainer() == (qualifier == "container") {
+				fa2 = append(fa2, f)
+			}
+		}
+		fa = fa2
+	}
 	return fa, true
 }
 
-func (m *Map) _doubleGlob(fa *[]*Field) {
+func (m *Map) _doubleGlob(fa *[]*Field, c *compiler) {
+	if c != nil && c.stopped() {
+		return
+	}
 	for _, f := range m.Fields {
 		if _, ok := d2graph.ReservedKeywords[f.Name]; ok {
 			if _, ok := d2graph.BoardKeywords[f.Name]; !ok {
@@ -24,7 +47,7 @@ func (m *Map) _doubleGlob(fa *[]*Field) {
 		}
 		*fa = append(*fa, f)
 		if f.Map() != nil {
-			f.Map()._doubleGlob(fa)
+			f.Map()._doubleGlob(fa, c)
 		}
 	}
 }
@@ -170,6 +170,22 @@ a -> b
 				assertQuery(t, m, 0, 0, "red", "(a -> b)[0].style.fill")
 				assertQuery(t, m, 0, 0, "red", "(a -> b)[1].style.fill")
 				assertQuery(t, m, 0, 0, "red", "(a -> b)[2].style.fill")
+				assert.Equal(t, 1, m.DistinctEdgePairs())
+			},
+		},
+		{
+			name: "edge-index-range",
+			run: func(t testing.TB) {
+				m, err := compile(t, `a -> b
+a -> b
+a -> b
+(a -> b)[1..2].style.fill: red
+`)
+				assert.Success(t, err)
+				assertQuery(t, m, 6, 3, nil, "")
+				assertQuery(t, m, 0, 0, nil, "(a -> b)[0].style.fill")
+				assertQuery(t, m, 0, 0, "red", "(a -> b)[1].style.fill")
+				assertQuery(t, m, 0, 0, "red", "(a -> b)[2].style.fill")
 			},
 		},
 		{
@@ -222,6 +238,65 @@ shared.animal
 				assertQuery(t, m, 1, 0, nil, "shared.animal.style")
 			},
 		},
+		{
+			name: "double-glob/leaf",
+			run: func(t testing.TB) {
+				m, err := compile(t, `shared.animate
+shared.animal
+**(leaf).style.fill: red`)
+				assert.Success(t, err)
+				assertQuery(t, m, 7, 0, nil, "")
+				assertQuery(t, m, 6, 0, nil, "shared")
+				assert.True(t, m.GetField("shared", "style") == nil)
+				assertQuery(t, m, 2, 0, nil, "shared.animate")
+				assertQuery(t, m, 0, 0, "red", "shared.animate.style.fill")
+				assertQuery(t, m, 2, 0, nil, "shared.animal")
+				assertQuery(t, m, 0, 0, "red", "shared.animal.style.fill")
+			},
+		},
+		{
+			name: "double-glob/container",
+			run: func(t testing.TB) {
+				m, err := compile(t, `shared.animate
+shared.animal
+**(CONTAINER).style.fill: red`)
+				assert.Success(t, err)
+				assertQuery(t, m, 5, 0, nil, "")
+				assertQuery(t, m, 4, 0, nil, "shared")
+				assertQuery(t, m, 0, 0, "red", "shared.style.fill")
+				assertQuery(t, m, 0, 0, nil, "shared.animate")
+				assertQuery(t, m, 0, 0, nil, "shared.animal")
+			},
+		},
+		{
+			name: "double-glob/order",
+			run: func(t testing.TB) {
+				m, err := compile(t, `a: {
+  b.c
+  d
+}
+e
+**.x: 1
+a.** -> e
+`)
+				assert.Success(t, err)
+				var edges []string
+				for _, e := range m.Edges {
+					edges = append(edges, e.ID.String())
+				}
+				assert.JSON(t, []string{
+					"(a.b.c.x -> e)[0]",
+					"(a.b.x -> e)[0]",
+					"(a.d.x -> e)[0]",
+					"(a.x -> e)[0]",
+				}, edges)
+				var xs []string
+				for _, f := range m.GetField("a").Map().Fields {
+					xs = append(xs, f.Name)
+				}
+				assert.JSON(t, []string{"b", "d", "x"}, xs)
+			},
+		},
 		{
 			name: "double-glob/edge-no-container",
 			run: func(t testing.TB) {
@@ -328,6 +403,16 @@ task.** -> fast
 					assert.ErrorString(t, err, `TestCompile/patterns/errors/glob-edge-glob-index.d2:1:2: indexed edge does not exist`)
 				},
 			},
+			{
+				name: "edge-index-range",
+				run: func(t testing.TB) {
+					_, err := compile(t, `a -> b
+a -> b
+(a -> b)[1..2].style.fill: red
+`)
+					assert.ErrorString(t, err, `TestCompile/patterns/errors/edge-index-range.d2:3:2: indexed edge does not exist`)
+				},
+			},
 		}
 		runa(t, tca)
 	})
@@ -2,29 +2,50 @@ package d2ir
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
+	"oss.terrastruct.com/d2/d2ast"
 	"oss.terrastruct.com/d2/d2parser"
 )
 
 // QueryAll is only for tests and debugging.
+//
+// A trailing [n] after a field holding an array selects the nth value of the array, e.g.
+// x.class[1]. It's parsed from what follows the key the parser read. See also Resolve.
 func (m *Map) QueryAll(idStr string) (na []Node, _ error) {
 	k, err := d2parser.ParseMapKey(idStr)
 	if err != nil {
 		return nil, err
 	}
+	na = m.queryKey(k)
+	keyStr := idStr[:k.Range.End.Byte]
+	rest := strings.TrimSpace(idStr[k.Range.End.Byte:])
+	if rest == "" {
+		return na, nil
+	}
+	if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
+		return nil, fmt.Errorf("unexpected %q after %s", rest, keyStr)
+	}
+	index, err := strconv.Atoi(rest[1 : len(rest)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid array index %q after %s", rest, keyStr)
+	}
+	return queryArrayIndex(na, keyStr, index)
+}
 
+func (m *Map) queryKey(k *d2ast.Key) (na []Node) {
 	if k.Key != nil {
 		f := m.GetField(k.Key.IDA()...)
 		if f == nil {
-			return nil, nil
+			return nil
 		}
 		if len(k.Edges) == 0 {
-			na = append(na, f)
-			return na, nil
+			return []Node{f}
 		}
 		m = f.Map()
 		if m == nil {
-			return nil, nil
+			return nil
 		}
 	}
 
@@ -48,7 +69,7 @@ func (m *Map) QueryAll(idStr string) (na []Node, _ error) {
 			}
 		}
 	}
-	return na, nil
+	return na
 }
 
 // Query is only for tests and debugging.
@@ -66,3 +87,110 @@ func (m *Map) Query(idStr string) (Node, error) {
 	}
 	return na[0], nil
 }
+
+// queryArrayIndex returns the value at index of each array or field holding an array in na,
+// the nodes queried by idStr.
+func queryArrayIndex(na2 []Node, idStr string, index int) (na []Node, _ error) {
+	for _, n := range na2 {
+		a, ok := n.(*Array)
+		if f, isField := n.(*Field); isField {
+			a, ok = f.Composite.(*Array)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s is not an array", idStr)
+		}
+		v := a.Get(index)
+		if v == nil {
+			return nil, fmt.Errorf("index %d out of range for %s of length %d", index, idStr, len(a.Values))
+		}
+		na = append(na, v)
+	}
+	return na, nil
+}
+
+// Resolve returns the node at the path segments from m. Unlike Query, each segment is
+// already split out and only edge IDs are parsed. A segment is one of:
+//
+//   - a field name as passed to GetField, e.g. "a" or "style".
+//   - an edge ID in the map reached so far as parsed by ParseEdgeID, e.g. "(x -> y)[2]". The
+//     index may instead be the next segment as in "(x -> y)", "2". Without an index, the
+//     edge must be the only one between its endpoints.
+//   - an index into an array, e.g. "1" after the field of class: [a; b].
+//
+// The error names the first segment that couldn't be resolved and why.
+func (m *Map) Resolve(segments []string) (Node, error) {
+	var n Node = m
+	for i := 0; i < len(segments); i++ {
+		si, seg := i, segments[i]
+		segErr := func(f string, v ...interface{}) error {
+			return fmt.Errorf("failed to resolve segment %d %q: %s", si, seg, fmt.Sprintf(f, v...))
+		}
+
+		if f, ok := n.(*Field); ok {
+			if _, ok := f.Composite.(*Array); ok {
+				n = f.Composite
+			}
+		}
+		if a, ok := n.(*Array); ok {
+			index, err := strconv.Atoi(seg)
+			if err != nil {
+				return nil, segErr("not an index into array")
+			}
+			v := a.Get(index)
+			if v == nil {
+				return nil, segErr("index out of range for array of length %d", len(a.Values))
+			}
+			n = v
+			continue
+		}
+
+		cur := n.Map()
+		if cur == nil {
+			return nil, segErr("%s has no map", nodeDesc(n))
+		}
+		if len(seg) > 0 && seg[0] == '(' {
+			eid, err := ParseEdgeID(seg)
+			if err != nil {
+				return nil, segErr("%v", err)
+			}
+			if eid.Glob || eid.IndexEnd != nil {
+				return nil, segErr("must name a single edge")
+			}
+			if eid.Index == nil && i+1 < len(segments) {
+				if index, err := strconv.Atoi(segments[i+1]); err == nil {
+					eid.Index = &index
+					i++
+				}
+			}
+			ea := cur.GetEdges(eid, nil)
+			switch len(ea) {
+			case 0:
+				return nil, segErr("edge not found")
+			case 1:
+				n = ea[0]
+			default:
+				return nil, segErr("%d edges match, an index is required", len(ea))
+			}
+			continue
+		}
+		f := cur.GetField(seg)
+		if f == nil {
+			return nil, segErr("field not found")
+		}
+		n = f
+	}
+	return n, nil
+}
+
+// nodeDesc describes n for errors, e.g. field "a" or edge (a -> b)[0].
+func nodeDesc(n Node) string {
+	switch n := n.(type) {
+	case *Field:
+		return fmt.Sprintf("field %q", n.Name)
+	case *Edge:
+		return "edge " + n.ID.String()
+	case *Scalar:
+		return "scalar " + n.String()
+	}
+	return "node"
+}
@@ -0,0 +1,296 @@
+package d2ir
+
+import (
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
+)
+
+// Recompile compiles newAST, an edited version of oldAST, reusing the boards of m that
+// weren't affected by the edit. m must be the root map compiled from oldAST. The result is
+// equal to that of Compile(newAST, opts).
+//
+// The diff is conservative and done at the granularity of boards declared at the root as
+// layers: { x: { ... } } and so on. Everything else at the root must be unchanged and free
+// of globs, imports and boards declared any other way, or else newAST is compiled from
+// scratch. A board is then reused if its AST is unchanged and, for a step, so are the
+// steps before it. Compile resolves substitutions within strings in place in the AST so
+// boards with those always compare as changed.
+//
+// The references of reused boards point into oldAST and imports within them are not read
+// again. Boards are only reused if m was compiled with the same options as opts, save for
+// FS, MaxFields, MaxEdges and OnProgress, and opts has no GlobTrace or Warn to call for
+// what the boards compile.
+func (m *Map) Recompile(oldAST, newAST *d2ast.Map, opts *CompileOptions) (*Map, error) {
+	c := newCompiler(opts)
+	if m.compiledWith != nil && *m.compiledWith == *c.boardOptions() && c.globTrace == nil && c.warnf == nil {
+		c.reuse = m.reusableBoards(oldAST, newAST)
+	}
+	return c.compileRoot(newAST)
+}
+
+// boardOptions are the compile options that change what a board compiles to.
+type boardOptions struct {
+	utf16Pos                     bool
+	comments                     bool
+	interBoardEdges              bool
+	requireExistingEdgeEndpoints bool
+	disallowUnderscoreCreate     bool
+	bakeClasses                  bool
+	globEdgeThreshold            int
+	strictGlobEdges              bool
+}
+
+func (c *compiler) boardOptions() *boardOptions {
+	return &boardOptions{
+		utf16Pos:                     c.utf16Pos,
+		comments:                     c.comments,
+		interBoardEdges:              c.interBoardEdges,
+		requireExistingEdgeEndpoints: c.requireExistingEdgeEndpoints,
+		disallowUnderscoreCreate:     c.disallowUnderscoreCreate,
+		bakeClasses:                  c.bakeClasses,
+		globEdgeThreshold:            c.globEdgeThreshold,
+		strictGlobEdges:              c.strictGlobEdges,
+	}
+}
+
+type boardAST struct {
+	kind string
+	name string
+	ast  *d2ast.Map
+}
+
+func (m *Map) reusableBoards(oldAST, newAST *d2ast.Map) map[*d2ast.Map]*Map {
+	if !m.Root() {
+		return nil
+	}
+	oldSkel, oldBoards, ok := boardSkeleton(oldAST)
+	if !ok {
+		return nil
+	}
+	newSkel, newBoards, ok := boardSkeleton(newAST)
+	if !ok || oldSkel != newSkel {
+		return nil
+	}
+
+	reuse := make(map[*d2ast.Map]*Map)
+	stepChanged := false
+	// The skeletons being equal, the boards of both are declared in the same order.
+	for i, b := range newBoards {
+		if b.kind == "steps" && stepChanged {
+			continue
+		}
+		if d2format.Format(b.ast) != d2format.Format(oldBoards[i].ast) {
+			if b.kind == "steps" {
+				stepChanged = true
+			}
+			continue
+		}
+		f := m.GetField(b.kind, b.name)
+		if f == nil || f.Map() == nil {
+			return nil
+		}
+		reuse[b.ast] = f.Map()
+	}
+	return reuse
+}
+
+// boardSkeleton returns the root of ast formatted with the contents of its boards left out
+// and the boards in declaration order. ok is false if the boards can't be diffed
+// independently of the rest of ast.
+func boardSkeleton(ast *d2ast.Map) (skel string, boards []boardAST, ok bool) {
+	var sb strings.Builder
+	seen := make(map[string]struct{})
+	for _, n := range ast.Nodes {
+		if n.Import != nil {
+			return "", nil, false
+		}
+		k := n.MapKey
+		if k == nil {
+			sb.WriteString(d2format.Format(n.Unbox()))
+			sb.WriteByte('\n')
+			continue
+		}
+		if keyHasGlob(k) {
+			return "", nil, false
+		}
+		kind, ok := boardHolderKind(k)
+		if !ok {
+			if k.Key != nil && len(k.Key.Path) > 0 && findBoardKeyword(strings.ToLower(k.Key.Path[0].Unbox().ScalarString())) != -1 {
+				return "", nil, false
+			}
+			sb.WriteString(d2format.Format(k))
+			sb.WriteByte('\n')
+			continue
+		}
+
+		sb.WriteString(kind)
+		sb.WriteString(": {\n")
+		for _, n2 := range k.Value.Map.Nodes {
+			if n2.Comment != nil || n2.BlockComment != nil {
+				continue
+			}
+			k2 := n2.MapKey
+			if k2 == nil || keyHasGlob(k2) || len(k2.Edges) > 0 || k2.Key == nil || len(k2.Key.Path) != 1 ||
+				k2.Primary.Unbox() != nil || k2.Value.Map == nil {
+				return "", nil, false
+			}
+			name := k2.Key.Path[0].Unbox().ScalarString()
+			id := kind + "." + strings.ToLower(name)
+			if _, ok := seen[id]; ok {
+				return "", nil, false
+			}
+			seen[id] = struct{}{}
+			boards = append(boards, boardAST{
+				kind: kind,
+				name: name,
+				ast:  k2.Value.Map,
+			})
+			sb.WriteString(d2format.Format(k2.Key))
+			sb.WriteByte('\n')
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String(), boards, true
+}
+
+// boardHolderKind returns the board keyword of k if k is of the form layers: { ... }.
+func boardHolderKind(k *d2ast.Key) (string, bool) {
+	if len(k.Edges) > 0 || k.Key == nil || len(k.Key.Path) != 1 || k.Primary.Unbox() != nil || k.Value.Map == nil {
+		return "", false
+	}
+	kind := strings.ToLower(k.Key.Path[0].Unbox().ScalarString())
+	if findBoardKeyword(kind) == -1 {
+		return "", false
+	}
+	return kind, true
+}
+
+func keyHasGlob(k *d2ast.Key) bool {
+	if k.Key.HasGlob() || k.EdgeKey.HasGlob() || (k.EdgeIndex != nil && k.EdgeIndex.Glob) {
+		return true
+	}
+	for _, e := range k.Edges {
+		if e.Src.HasGlob() || e.Dst.HasGlob() {
+			return true
+		}
+	}
+	return false
+}
+
+// RecompileBoard replaces the AST of the board at path, e.g. layers x, with newAST, the
+// edited contents of its map, and recompiles m, the root map, in place with Recompile so
+// that the other boards are reused. The classes and variables the board inherits are
+// resolved again as are the boards based on it, e.g. the steps after an edited step.
+//
+// The board must be declared as layers: { x: { ... } } and so on at every level of path so
+// that the edit can't move it. The result is that of Compile with opts, e.g. with the FS
+// to read imports in newAST from.
+func (m *Map) RecompileBoard(path []string, newAST *d2ast.Map, opts *CompileOptions) error {
+	if !m.Root() {
+		return fmt.Errorf("RecompileBoard must be called on the root map")
+	}
+	if len(path) == 0 || len(path)%2 != 0 {
+		return fmt.Errorf("invalid board path %s", strings.Join(path, "."))
+	}
+	f := m.GetField(path...)
+	if f == nil || NodeBoardKind(f) == "" {
+		return fmt.Errorf("board %s not found", strings.Join(path, "."))
+	}
+	oldAST := m.parent.(*Field).References[0].Context.ScopeAST
+	if oldAST == nil {
+		return fmt.Errorf("map was not compiled from source")
+	}
+	rootAST, ok := replaceBoardAST(oldAST, path, newAST)
+	if !ok {
+		return fmt.Errorf("board %s is not declared as %s: { %s: { ... } }", strings.Join(path, "."), path[len(path)-2], path[len(path)-1])
+	}
+
+	m2, err := m.Recompile(oldAST, rootAST, opts)
+	if err != nil {
+		return err
+	}
+	m.parent, m.Fields, m.Edges, m.compiledWith = m2.parent, m2.Fields, m2.Edges, m2.compiledWith
+	m.parent.(*Field).References[0].Context.ScopeMap = m
+	for _, f := range m.Fields {
+		f.parent = m
+	}
+	for _, e := range m.Edges {
+		e.parent = m
+	}
+	m.rethreadScopeMap(m2, m)
+	return nil
+}
+
+// rethreadScopeMap points the references within m scoped to the map from at the map to.
+func (m *Map) rethreadScopeMap(from, to *Map) {
+	if m == nil {
+		return
+	}
+	for _, f := range m.Fields {
+		for _, fr := range f.References {
+			if fr.Context.ScopeMap == from {
+				fr.Context.ScopeMap = to
+			}
+		}
+		f.Map().rethreadScopeMap(from, to)
+	}
+	for _, e := range m.Edges {
+		for _, er := range e.References {
+			if er.Context.ScopeMap == from {
+				er.Context.ScopeMap = to
+			}
+		}
+		e.Map_.rethreadScopeMap(from, to)
+	}
+}
+
+// replaceBoardAST returns a copy of ast with the map of the board at path replaced by
+// boardAST. Only the nodes along path are copied so ast is unchanged.
+func replaceBoardAST(ast *d2ast.Map, path []string, boardAST *d2ast.Map) (*d2ast.Map, bool) {
+	for i, n := range ast.Nodes {
+		k := n.MapKey
+		if k == nil {
+			continue
+		}
+		kind, ok := boardHolderKind(k)
+		if !ok || kind != strings.ToLower(path[0]) {
+			continue
+		}
+		for j, n2 := range k.Value.Map.Nodes {
+			k2 := n2.MapKey
+			if k2 == nil || len(k2.Edges) > 0 || k2.Key == nil || len(k2.Key.Path) != 1 || k2.Value.Map == nil ||
+				!strings.EqualFold(k2.Key.Path[0].Unbox().ScalarString(), path[1]) {
+				continue
+			}
+			newBoardAST := boardAST
+			if len(path) > 2 {
+				newBoardAST, ok = replaceBoardAST(k2.Value.Map, path[2:], boardAST)
+				if !ok {
+					return nil, false
+				}
+			}
+			k2 = copyKeyWithMap(k2, newBoardAST)
+			holderAST := copyMapNodes(k.Value.Map)
+			holderAST.Nodes[j] = d2ast.MakeMapNodeBox(k2)
+			newAST := copyMapNodes(ast)
+			newAST.Nodes[i] = d2ast.MakeMapNodeBox(copyKeyWithMap(k, holderAST))
+			return newAST, true
+		}
+	}
+	return nil, false
+}
+
+func copyKeyWithMap(k *d2ast.Key, m *d2ast.Map) *d2ast.Key {
+	tmp := *k
+	tmp.Value = d2ast.MakeValueBox(m)
+	return &tmp
+}
+
+func copyMapNodes(m *d2ast.Map) *d2ast.Map {
+	tmp := *m
+	tmp.Nodes = append([]d2ast.MapNodeBox(nil), m.Nodes...)
+	return &tmp
+}
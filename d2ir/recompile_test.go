@@ -0,0 +1,384 @@
+package d2ir_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+	"oss.terrastruct.com/util-go/mapfs"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2ir"
+	"oss.terrastruct.com/d2/d2parser"
+)
+
+func TestRecompile(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		old     string
+		new     string
+		reused  [][]string
+		rebuilt [][]string
+	}{
+		{
+			name: "layers",
+			old: `x -> y
+classes: {
+  c: {
+    style.fill: red
+  }
+}
+layers: {
+  a: {
+    p.class: c
+  }
+  b: {
+    q -> r
+  }
+  c: {
+    s
+  }
+}
+`,
+			new: `x -> y
+classes: {
+  c: {
+    style.fill: red
+  }
+}
+layers: {
+  a: {
+    p.class: c
+  }
+  b: {
+    q -> r: edited
+    t
+  }
+  c: {
+    s
+  }
+}
+`,
+			reused:  [][]string{{"layers", "a", "p"}, {"layers", "c", "s"}},
+			rebuilt: [][]string{{"layers", "b", "q"}},
+		},
+		{
+			name: "root",
+			old: `x
+layers: {
+  a: {
+    p
+  }
+}
+`,
+			new: `x: edited
+layers: {
+  a: {
+    p
+  }
+}
+`,
+			rebuilt: [][]string{{"x"}, {"layers", "a", "p"}},
+		},
+		{
+			name: "steps",
+			old: `x
+scenarios: {
+  s: {
+    x.style.fill: red
+  }
+}
+steps: {
+  1: {
+    a
+  }
+  2: {
+    b
+  }
+  3: {
+    c
+  }
+}
+`,
+			new: `x
+scenarios: {
+  s: {
+    x.style.fill: red
+  }
+}
+steps: {
+  1: {
+    a
+  }
+  2: {
+    b -> a
+  }
+  3: {
+    c
+  }
+}
+`,
+			reused:  [][]string{{"scenarios", "s", "x"}, {"steps", "1", "a"}},
+			rebuilt: [][]string{{"steps", "2", "b"}, {"steps", "3", "c"}},
+		},
+		{
+			name: "vars",
+			old: `vars: {
+  v: hello
+}
+layers: {
+  a: {
+    p: ${v}
+  }
+  b: {
+    p: say ${v}
+  }
+}
+`,
+			new: `vars: {
+  v: hello
+}
+layers: {
+  a: {
+    p: ${v}
+  }
+  b: {
+    p: say ${v}
+  }
+}
+`,
+			reused:  [][]string{{"layers", "a", "p"}},
+			rebuilt: [][]string{{"layers", "b", "p"}},
+		},
+		{
+			name: "non-canonical",
+			old: `layers: {
+  a: {
+    p
+  }
+}
+layers.a.q
+`,
+			new: `layers: {
+  a: {
+    p
+  }
+}
+layers.a.q
+`,
+			rebuilt: [][]string{{"layers", "a", "p"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			oldAST, err := d2parser.Parse("old.d2", strings.NewReader(tc.old), nil)
+			assert.Success(t, err)
+			m, err := d2ir.Compile(oldAST, nil)
+			assert.Success(t, err)
+			newAST, err := d2parser.Parse("new.d2", strings.NewReader(tc.new), nil)
+			assert.Success(t, err)
+			m2, err := m.Recompile(oldAST, newAST, nil)
+			assert.Success(t, err)
+
+			exp := mustCompile(t, tc.new)
+			assert.True(t, m2.Equal(exp))
+			assert.String(t, exp.String(), m2.String())
+
+			for _, ida := range tc.reused {
+				assert.True(t, firstRefKey(m2, ida) == firstRefKey(m, ida))
+			}
+			for _, ida := range tc.rebuilt {
+				assert.True(t, firstRefKey(m2, ida) != firstRefKey(m, ida))
+			}
+		})
+	}
+}
+
+func TestRecompileOptions(t *testing.T) {
+	t.Parallel()
+
+	const text = `classes: {
+  c.style.fill: red
+}
+layers: {
+  a: {
+    p.class: c
+    # note
+    q: hi
+  }
+}
+`
+	ast, err := d2parser.Parse("old.d2", strings.NewReader(text), nil)
+	assert.Success(t, err)
+	m, err := d2ir.Compile(ast, nil)
+	assert.Success(t, err)
+
+	opts := &d2ir.CompileOptions{
+		BakeClasses:     true,
+		CaptureComments: true,
+	}
+	m2, err := m.Recompile(ast, ast, opts)
+	assert.Success(t, err)
+	exp, err := d2ir.Compile(ast, opts)
+	assert.Success(t, err)
+	assert.True(t, m2.Equal(exp))
+	p := m2.GetField("layers", "a", "p")
+	assert.True(t, p.Map().GetField("class") == nil)
+	assert.JSON(t, []string{"note"}, m2.GetField("layers", "a", "q").LeadingComments())
+
+	// Compiled again with the same options, the board is reused.
+	m3, err := m2.Recompile(ast, ast, opts)
+	assert.Success(t, err)
+	assert.True(t, m3.Equal(exp))
+	ida := []string{"layers", "a", "p"}
+	assert.True(t, m3.GetField(ida...).References[0] == m2.GetField(ida...).References[0])
+	assert.True(t, m2.GetField(ida...).References[0] != m.GetField(ida...).References[0])
+}
+
+func TestRecompileBoard(t *testing.T) {
+	t.Parallel()
+
+	text := `vars: {
+  v: hello
+}
+classes: {
+  c.style.fill: red
+}
+layers: {
+  a: {
+    p.class: c
+  }
+  b: {
+    layers: {
+      x: {
+        q
+      }
+    }
+  }
+}
+`
+	m := mustCompile(t, text)
+	before := m.GetField("layers", "a").Map()
+
+	newAST, err := d2parser.Parse("new.d2", strings.NewReader(`r: ${v}
+r.class: c
+`), nil)
+	assert.Success(t, err)
+	assert.Success(t, m.RecompileBoard([]string{"layers", "b", "layers", "x"}, newAST, nil))
+
+	exp := mustCompile(t, `vars: {
+  v: hello
+}
+classes: {
+  c.style.fill: red
+}
+layers: {
+  a: {
+    p.class: c
+  }
+  b: {
+    layers: {
+      x: {
+        r: hello
+        r.class: c
+      }
+    }
+  }
+}
+`)
+	assert.True(t, m.Equal(exp))
+	assert.String(t, exp.String(), m.String())
+	assert.True(t, m.Root())
+	assert.True(t, m.GetField("layers").Map().Parent().(*d2ir.Field).Parent() == m)
+	assert.True(t, firstRefKey(m, []string{"layers", "a", "p"}) == before.GetField("p").References[0].Context.Key)
+
+	err = m.RecompileBoard([]string{"layers", "nope"}, newAST, nil)
+	assert.ErrorString(t, err, "board layers.nope not found")
+}
+
+func TestRecompileBoardImport(t *testing.T) {
+	t.Parallel()
+
+	fs, err := mapfs.New(map[string]string{
+		"x.d2": "shape: circle\n",
+		"y.d2": "label: meow\n",
+	})
+	assert.Success(t, err)
+	t.Cleanup(func() {
+		assert.Success(t, fs.Close())
+	})
+	opts := &d2ir.CompileOptions{
+		FS: fs,
+	}
+
+	ast, err := d2parser.Parse("index.d2", strings.NewReader(`layers: {
+  l: {
+    a: @x
+  }
+}
+`), nil)
+	assert.Success(t, err)
+	m, err := d2ir.Compile(ast, opts)
+	assert.Success(t, err)
+
+	newAST, err := d2parser.Parse("index.d2", strings.NewReader(`a: @x
+b: @y
+`), nil)
+	assert.Success(t, err)
+	assert.Success(t, m.RecompileBoard([]string{"layers", "l"}, newAST, opts))
+	assert.String(t, "circle", m.GetField("layers", "l", "a", "shape").Primary().Value.ScalarString())
+	assert.String(t, "meow", m.GetField("layers", "l", "b", "label").Primary().Value.ScalarString())
+}
+
+func firstRefKey(m *d2ir.Map, ida []string) *d2ast.Key {
+	f := m.GetField(ida...)
+	if f == nil {
+		return nil
+	}
+	return f.References[0].Context.Key
+}
+
+func BenchmarkRecompile(b *testing.B) {
+	const layers = 50
+	const fields = 100
+	var sb strings.Builder
+	sb.WriteString("layers: {\n")
+	for i := 0; i < layers; i++ {
+		fmt.Fprintf(&sb, "  l%d: {\n", i)
+		for j := 0; j < fields; j++ {
+			fmt.Fprintf(&sb, "    n%d -> n%d: {style.stroke: red}\n", j, j+1)
+		}
+		sb.WriteString("  }\n")
+	}
+	sb.WriteString("}\n")
+	oldText := sb.String()
+	newText := strings.Replace(oldText, "n7 -> n8: {style.stroke: red}", "n7 -> n8: {style.stroke: blue}", 1)
+
+	oldAST, err := d2parser.Parse("old.d2", strings.NewReader(oldText), nil)
+	assert.Success(b, err)
+	m, err := d2ir.Compile(oldAST, nil)
+	assert.Success(b, err)
+	// Without substitutions, compiling doesn't modify the AST.
+	newAST, err := d2parser.Parse("new.d2", strings.NewReader(newText), nil)
+	assert.Success(b, err)
+
+	b.Run("compile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := d2ir.Compile(newAST, nil)
+			assert.Success(b, err)
+		}
+	})
+	b.Run("recompile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := m.Recompile(oldAST, newAST, nil)
+			assert.Success(b, err)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package d2ir
+
+import (
+	"fmt"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+)
+
+// NodeAtPosition returns the *Field or *Edge whose reference most tightly encloses pos
+// along with that reference. Only references in the same file as m's root AST are
+// considered. It returns nil if pos is outside every reference.
+func (m *Map) NodeAtPosition(pos d2ast.Position) (Node, Reference) {
+	var path string
+	if scope := RootMap(m).parent.(*Field).References[0].Context.Scope; scope != nil {
+		path = scope.Range.Path
+	}
+
+	var n Node
+	var ref Reference
+	var r d2ast.Range
+	m.nodeAtPosition(pos, path, &n, &ref, &r)
+	return n, ref
+}
+
+func (m *Map) nodeAtPosition(pos d2ast.Position, path string, n *Node, ref *Reference, r *d2ast.Range) {
+	visit := func(n2 Node, ref2 Reference) {
+		r2 := ref2.AST().GetRange()
+		if r2.Path != path || !rangeContains(r2, pos) {
+			return
+		}
+		// Children are visited after their parents so <= breaks ties toward the innermost node.
+		if *ref == nil || rangeLen(r2) <= rangeLen(*r) {
+			*n = n2
+			*ref = ref2
+			*r = r2
+		}
+	}
+
+	for _, f := range m.Fields {
+		for _, fr := range f.References {
+			if fr.String == nil {
+				continue
+			}
+			visit(f, fr)
+		}
+		if f.Map() != nil {
+			f.Map().nodeAtPosition(pos, path, n, ref, r)
+		}
+	}
+	for _, e := range m.Edges {
+		for _, er := range e.References {
+			if er.Context.Edge == nil {
+				continue
+			}
+			visit(e, er)
+		}
+		if e.Map_ != nil {
+			e.Map_.nodeAtPosition(pos, path, n, ref, r)
+		}
+	}
+}
+
+func rangeContains(r d2ast.Range, pos d2ast.Position) bool {
+	return !pos.Before(r.Start) && pos.Before(r.End)
+}
+
+func rangeLen(r d2ast.Range) int {
+	return r.End.Byte - r.Start.Byte
+}
+
+// NodeForAST returns the *Field or *Edge that n produced. n may be a key, an edge, a key
+// path or a string within a key path. A key resolves to the field or edge it sets, e.g. the
+// field fill for (a -> b)[0].style.fill, and a key path or a string to the field it names.
+// The first match in m is returned for globs that produce several nodes. It returns nil if
+// n produced no IR, e.g. a comment.
+func (m *Map) NodeForAST(n d2ast.Node) Node {
+	if n == nil {
+		return nil
+	}
+	var fieldMatch func(fr *FieldReference) bool
+	var edgeMatch func(er *EdgeReference) bool
+	switch n := n.(type) {
+	case *d2ast.Key:
+		if len(n.Edges) > 0 && n.EdgeKey == nil {
+			edgeMatch = func(er *EdgeReference) bool {
+				return er.Context.Key == n
+			}
+		} else {
+			fieldMatch = func(fr *FieldReference) bool {
+				return fr.Context.Key == n && fr.Primary()
+			}
+		}
+	case *d2ast.Edge:
+		edgeMatch = func(er *EdgeReference) bool {
+			return er.Context.Edge == n
+		}
+	case *d2ast.KeyPath:
+		fieldMatch = func(fr *FieldReference) bool {
+			return fr.KeyPath == n && fr.KeyPathIndex() == len(n.Path)-1
+		}
+	case d2ast.String:
+		fieldMatch = func(fr *FieldReference) bool {
+			return fr.String == n
+		}
+	default:
+		return nil
+	}
+	return m.nodeForAST(fieldMatch, edgeMatch)
+}
+
+func (m *Map) nodeForAST(fieldMatch func(*FieldReference) bool, edgeMatch func(*EdgeReference) bool) Node {
+	for _, f := range m.Fields {
+		if fieldMatch != nil {
+			for _, fr := range f.References {
+				if fr.String != nil && fieldMatch(fr) {
+					return f
+				}
+			}
+		}
+		if f.Map() != nil {
+			if n := f.Map().nodeForAST(fieldMatch, edgeMatch); n != nil {
+				return n
+			}
+		}
+	}
+	for _, e := range m.Edges {
+		if edgeMatch != nil {
+			for _, er := range e.References {
+				if edgeMatch(er) {
+					return e
+				}
+			}
+		}
+		if e.Map_ != nil {
+			if n := e.Map_.nodeForAST(fieldMatch, edgeMatch); n != nil {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// ReferencesAt returns every reference to the field at path followed by the references of
+// every edge that has the field as an endpoint.
+func (m *Map) ReferencesAt(path []string) ([]Reference, error) {
+	f := m.GetField(path...)
+	if f == nil {
+		return nil, fmt.Errorf("field %q not found", strings.Join(path, "."))
+	}
+
+	var refs []Reference
+	edgeCtxs := make(map[*RefContext]struct{})
+	for _, fr := range f.References {
+		refs = append(refs, fr)
+		if fr.InEdge() {
+			edgeCtxs[fr.Context] = struct{}{}
+		}
+	}
+	if len(edgeCtxs) == 0 {
+		return refs, nil
+	}
+
+	seen := make(map[*EdgeReference]struct{})
+	RootMap(m).edgeReferences(edgeCtxs, seen, &refs)
+	return refs, nil
+}
+
+func (m *Map) edgeReferences(ctxs map[*RefContext]struct{}, seen map[*EdgeReference]struct{}, refs *[]Reference) {
+	for _, f := range m.Fields {
+		if f.Map() != nil {
+			f.Map().edgeReferences(ctxs, seen, refs)
+		}
+	}
+	for _, e := range m.Edges {
+		for _, er := range e.References {
+			if _, ok := ctxs[er.Context]; !ok {
+				continue
+			}
+			// Boards share references with the boards they were overlaid from.
+			if _, ok := seen[er]; ok {
+				continue
+			}
+			seen[er] = struct{}{}
+			*refs = append(*refs, er)
+		}
+		if e.Map_ != nil {
+			e.Map_.edgeReferences(ctxs, seen, refs)
+		}
+	}
+}
+
+// Definition returns the last reference that set the primary value or composite of the
+// field at path. It returns nil if the field was only ever referenced as part of a longer
+// path, e.g. a in a.b.
+func (m *Map) Definition(path []string) (Reference, error) {
+	f := m.GetField(path...)
+	if f == nil {
+		return nil, fmt.Errorf("field %q not found", strings.Join(path, "."))
+	}
+	fr := f.lastPrimaryRef()
+	if fr == nil {
+		return nil, nil
+	}
+	return fr, nil
+}
+
+// PrimarySource returns the reference that set the primary value of f. Globs, overlays and
+// explicit keys all assign with the last write winning so this is the last reference whose
+// key assigned f a value. Its AST points back to the assignment in the source. It returns
+// nil if f has no primary value.
+func (f *Field) PrimarySource() Reference {
+	if f.Primary_ == nil {
+		return nil
+	}
+	for i := len(f.References) - 1; i >= 0; i-- {
+		fr := f.References[i]
+		if !fr.Primary() {
+			continue
+		}
+		k := fr.Context.Key
+		if k.Primary.Unbox() != nil || k.Value.ScalarBox().Unbox() != nil || k.Value.Import != nil {
+			return fr
+		}
+	}
+	return nil
+}
+
+// KeywordSource is like PrimarySource for the reserved keyword at path under f, e.g.
+// style.fill. It returns nil if the keyword isn't set.
+func (f *Field) KeywordSource(path ...string) Reference {
+	if f.Map() == nil {
+		return nil
+	}
+	kf := f.Map().GetField(path...)
+	if kf == nil {
+		return nil
+	}
+	return kf.PrimarySource()
+}
+
+// PrimarySource returns the reference that set the primary value of e, i.e. the last
+// reference whose key assigned e a value as with fields. It returns nil if e has no primary
+// value.
+func (e *Edge) PrimarySource() Reference {
+	if e.Primary_ == nil {
+		return nil
+	}
+	for i := len(e.References) - 1; i >= 0; i-- {
+		er := e.References[i]
+		if er.Context.Key.EdgeKey != nil {
+			continue
+		}
+		k := er.Context.Key
+		if k.Primary.Unbox() != nil || k.Value.ScalarBox().Unbox() != nil {
+			return er
+		}
+	}
+	return nil
+}
+
+// KeywordSource is like Field.KeywordSource for the reserved keyword at path in the map of
+// e, e.g. style.stroke. The reference may be from a key like (* -> b)[*].style.stroke.
+func (e *Edge) KeywordSource(path ...string) Reference {
+	if e.Map_ == nil {
+		return nil
+	}
+	kf := e.Map_.GetField(path...)
+	if kf == nil {
+		return nil
+	}
+	return kf.PrimarySource()
+}
+
+// LeadingComments returns the comments directly above each key that set f. They are only
+// recorded with CompileOptions.CaptureComments.
+func (f *Field) LeadingComments() []string {
+	var comments []string
+	for _, fr := range f.References {
+		if fr.Primary() {
+			comments = appendCommentValues(comments, fr.Context.Comments)
+		}
+	}
+	return comments
+}
+
+// LeadingComments returns the comments directly above each key that set e. They are only
+// recorded with CompileOptions.CaptureComments.
+func (e *Edge) LeadingComments() []string {
+	var comments []string
+	for _, er := range e.References {
+		if er.Primary() {
+			comments = appendCommentValues(comments, er.Context.Comments)
+		}
+	}
+	return comments
+}
+
+func appendCommentValues(values []string, comments []d2ast.Node) []string {
+	for _, n := range comments {
+		switch n := n.(type) {
+		case *d2ast.Comment:
+			values = append(values, n.Value)
+		case *d2ast.BlockComment:
+			values = append(values, n.Value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,318 @@
+package d2ir_test
+
+import (
+	"strings"
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2format"
+	"oss.terrastruct.com/d2/d2ir"
+	"oss.terrastruct.com/d2/d2parser"
+)
+
+func TestNodeAtPosition(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b -> c
+}
+`)
+	pos := func(line, col, byt int) d2ast.Position {
+		return d2ast.Position{Line: line, Column: col, Byte: byt}
+	}
+
+	n, ref := m.NodeAtPosition(pos(0, 0, 0))
+	assert.Equal(t, "a", n.(*d2ir.Field).Name)
+	assert.Equal(t, "a", ref.AST().(d2ast.String).ScalarString())
+
+	n, _ = m.NodeAtPosition(pos(1, 2, 7))
+	assert.Equal(t, "b", n.(*d2ir.Field).Name)
+
+	n, ref = m.NodeAtPosition(pos(1, 5, 10))
+	_, ok := n.(*d2ir.Edge)
+	assert.True(t, ok)
+	_, ok = ref.(*d2ir.EdgeReference)
+	assert.True(t, ok)
+
+	n, ref = m.NodeAtPosition(pos(3, 0, 15))
+	assert.Equal(t, nil, n)
+	assert.Equal(t, nil, ref)
+}
+
+func TestCopyKeepRefs(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b -> c
+}
+`)
+	pos := d2ast.Position{Line: 1, Column: 2, Byte: 7}
+
+	m2 := m.CopyKeepRefs(nil)
+	assert.True(t, m2.Equal(m))
+	assert.True(t, m2.GetField("a") != m.GetField("a"))
+	assert.True(t, m2.GetField("a").References[0] == m.GetField("a").References[0])
+	n, _ := m2.NodeAtPosition(pos)
+	assert.True(t, n == m2.GetField("a", "b"))
+
+	n, _ = m.Copy(nil).(*d2ir.Map).NodeAtPosition(pos)
+	assert.Equal(t, nil, n)
+
+	m2.GetField("a").Map().DeleteField("b")
+	assert.True(t, m.GetField("a", "b") != nil)
+}
+
+func TestReferencesAt(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b: 1
+}
+a.b: 2
+a.b -> c
+x -> a.b
+`)
+	refs, err := m.ReferencesAt([]string{"a", "b"})
+	assert.Success(t, err)
+	var nfield, nedge int
+	for _, ref := range refs {
+		switch ref.(type) {
+		case *d2ir.FieldReference:
+			nfield++
+		case *d2ir.EdgeReference:
+			nedge++
+		}
+	}
+	assert.Equal(t, 4, nfield)
+	assert.Equal(t, 2, nedge)
+
+	def, err := m.Definition([]string{"a", "b"})
+	assert.Success(t, err)
+	assert.Equal(t, "a.b: 2", d2format.Format(def.(*d2ir.FieldReference).Context.Key))
+
+	def, err = m.Definition([]string{"x"})
+	assert.Success(t, err)
+	assert.Equal(t, nil, def)
+
+	_, err = m.ReferencesAt([]string{"nope"})
+	assert.ErrorString(t, err, `field "nope" not found`)
+}
+
+func TestLeadingComments(t *testing.T) {
+	t.Parallel()
+
+	const text = `# note
+a: x
+
+# detached
+
+b: y
+# about the edge
+a -> b
+`
+	m := mustCompileOpts(t, text, &d2ir.CompileOptions{
+		CaptureComments: true,
+	})
+	assert.JSON(t, []string{"note"}, m.GetField("a").LeadingComments())
+	assert.Equal(t, 0, len(m.GetField("b").LeadingComments()))
+	assert.JSON(t, []string{"about the edge"}, m.Edges[0].LeadingComments())
+
+	m = mustCompile(t, text)
+	assert.Equal(t, 0, len(m.GetField("a").LeadingComments()))
+
+	m = mustCompileOpts(t, `a: x # about a
+b: y
+# about c
+c
+`, &d2ir.CompileOptions{
+		CaptureComments: true,
+	})
+	assert.Equal(t, 0, len(m.GetField("b").LeadingComments()))
+	assert.JSON(t, []string{"about c"}, m.GetField("c").LeadingComments())
+}
+
+func TestFirstRef(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+x: {
+  _.a: hi
+  y
+}
+x.y: bye
+`)
+	a := m.GetField("a")
+	assert.Equal(t, 2, len(a.References))
+	assert.True(t, a.FirstRef() == a.References[0])
+	assert.True(t, a.LastRef() == a.References[1])
+	assert.Equal(t, 0, a.DeclaredRange().Start.Line)
+	assert.Equal(t, 0, a.DeclaredRange().Start.Column)
+	assert.True(t, a.PrimarySource() == a.LastRef())
+
+	y := m.GetField("x", "y")
+	assert.Equal(t, 3, y.DeclaredRange().Start.Line)
+	assert.Equal(t, 2, y.DeclaredRange().Start.Column)
+	assert.Equal(t, 5, y.LastRef().AST().GetRange().Start.Line)
+
+	assert.Equal(t, nil, (&d2ir.Field{}).FirstRef())
+}
+
+func TestRange(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: {
+  b
+}
+x -> a: hi
+a.style.fill: red
+*.style.stroke: blue
+p -> q -> r
+`)
+	r, ok := m.GetField("a").Range()
+	assert.True(t, ok)
+	// Later keys setting a aren't spanned.
+	assert.Equal(t, "0:0:0-2:1:10", r.Start.Debug()+"-"+r.End.Debug())
+
+	r, ok = m.GetField("a", "b").Range()
+	assert.True(t, ok)
+	assert.Equal(t, "1:2:7-1:3:8", r.Start.Debug()+"-"+r.End.Debug())
+
+	r, ok = m.GetField("x").Range()
+	assert.True(t, ok)
+	assert.Equal(t, "3:0:11-3:1:12", r.Start.Debug()+"-"+r.End.Debug())
+
+	r, ok = m.Edges[0].Range()
+	assert.True(t, ok)
+	assert.Equal(t, "3:0:11-3:10:21", r.Start.Debug()+"-"+r.End.Debug())
+
+	r, ok = m.Edges[2].Range()
+	assert.True(t, ok)
+	assert.Equal(t, "6:5:66-6:11:72", r.Start.Debug()+"-"+r.End.Debug())
+
+	_, ok = (&d2ir.Field{}).Range()
+	assert.False(t, ok)
+	_, ok = (&d2ir.Edge{}).Range()
+	assert.False(t, ok)
+}
+
+func TestFieldReferenceFromGlob(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a
+b.style.fill: blue
+*.style.fill: red
+**.shape: circle
+`)
+	fill := m.GetField("a", "style", "fill")
+	assert.Equal(t, 1, len(fill.References))
+	fr := fill.References[0]
+	assert.True(t, fr.FromGlob)
+	assert.Equal(t, "*.style.fill", fr.Pattern)
+	assert.Equal(t, 2, fr.Context.Key.GetRange().Start.Line)
+
+	fill = m.GetField("b", "style", "fill")
+	assert.Equal(t, 2, len(fill.References))
+	assert.False(t, fill.References[0].FromGlob)
+	assert.Equal(t, "", fill.References[0].Pattern)
+	assert.True(t, fill.References[1].FromGlob)
+
+	fr = m.GetField("a", "shape").References[0]
+	assert.True(t, fr.FromGlob)
+	assert.Equal(t, "**.shape", fr.Pattern)
+
+	// The glob segment itself doesn't reference the fields it matches.
+	for _, fr := range m.GetField("a").References {
+		assert.False(t, fr.FromGlob)
+	}
+}
+
+func TestPrimarySource(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a: first
+b
+*.style.fill: red
+a.style.fill: blue
+a: {
+  label: ignored
+}
+a: second
+`)
+	src := func(ref d2ir.Reference) string {
+		if ref == nil {
+			return ""
+		}
+		return d2format.Format(ref.(*d2ir.FieldReference).Context.Key)
+	}
+	a := m.GetField("a")
+	assert.String(t, "a: second", src(a.PrimarySource()))
+	assert.String(t, "a.style.fill: blue", src(a.KeywordSource("style", "fill")))
+	assert.String(t, "*.style.fill: red", src(m.GetField("b").KeywordSource("style", "fill")))
+	assert.Equal(t, 2, m.GetField("b").KeywordSource("style", "fill").AST().GetRange().Start.Line)
+	assert.Equal(t, nil, m.GetField("b").PrimarySource())
+	assert.Equal(t, nil, a.KeywordSource("style", "stroke"))
+}
+
+func TestEdgePrimarySource(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b: first
+(a -> b)[0]: second
+c -> b
+(* -> b)[*].style.stroke: red
+(a -> b)[0]
+`)
+	src := func(ref d2ir.Reference) string {
+		if ref == nil {
+			return ""
+		}
+		switch ref := ref.(type) {
+		case *d2ir.FieldReference:
+			return d2format.Format(ref.Context.Key)
+		case *d2ir.EdgeReference:
+			return d2format.Format(ref.Context.Key)
+		}
+		return ""
+	}
+	ab := m.Edges[0]
+	assert.String(t, "(a -> b)[0]: second", src(ab.PrimarySource()))
+	assert.String(t, "(* -> b)[*].style.stroke: red", src(ab.KeywordSource("style", "stroke")))
+	assert.Equal(t, nil, m.Edges[1].PrimarySource())
+	assert.String(t, "(* -> b)[*].style.stroke: red", src(m.Edges[1].KeywordSource("style", "stroke")))
+	assert.Equal(t, nil, ab.KeywordSource("style", "fill"))
+}
+
+func TestNodeForAST(t *testing.T) {
+	t.Parallel()
+
+	ast, err := d2parser.Parse(t.Name()+".d2", strings.NewReader(`# comment
+a.b: hi
+a -> c: {
+  style.stroke: red
+}
+(a -> c)[0].style.fill: blue
+`), nil)
+	assert.Success(t, err)
+	m, err := d2ir.Compile(ast, nil)
+	assert.Success(t, err)
+
+	assert.Equal(t, nil, m.NodeForAST(ast.Nodes[0].Comment))
+	assert.Equal(t, nil, m.NodeForAST(nil))
+
+	ab := ast.Nodes[1].MapKey
+	assert.True(t, m.NodeForAST(ab) == m.GetField("a", "b"))
+	assert.True(t, m.NodeForAST(ab.Key) == m.GetField("a", "b"))
+	assert.True(t, m.NodeForAST(ab.Key.Path[0].Unbox()) == m.GetField("a"))
+
+	ac := ast.Nodes[2].MapKey
+	e := m.NodeForAST(ac)
+	assert.True(t, e == m.Edges[0])
+	assert.True(t, m.NodeForAST(ac.Edges[0]) == e)
+	stroke := ac.Value.Map.Nodes[0].MapKey
+	assert.True(t, m.NodeForAST(stroke) == m.Edges[0].Map().GetField("style", "stroke"))
+
+	fill := ast.Nodes[3].MapKey
+	assert.True(t, m.NodeForAST(fill) == m.Edges[0].Map().GetField("style", "fill"))
+}
@@ -0,0 +1,189 @@
+package d2ir
+
+import (
+	"strconv"
+	"strings"
+
+	"oss.terrastruct.com/d2/d2ast"
+	"oss.terrastruct.com/d2/d2graph"
+	"oss.terrastruct.com/d2/d2parser"
+)
+
+// Validate checks the invariants that EnsureField and CreateEdge enforce while compiling
+// against a finished tree and returns every violation. It's meant for trees that were
+// modified after compilation.
+func (m *Map) Validate() []error {
+	var errs []error
+	m.validate(&errs)
+	return errs
+}
+
+func (m *Map) validate(errs *[]error) {
+	for _, f := range m.Fields {
+		if f.Name == "classes" || findBoardKeyword(f.Name) != -1 {
+			if NodeBoardKind(m) == "" {
+				*errs = append(*errs, d2parser.Errorf(nodeAST(f), "%s is only allowed at a board root", f.Name))
+			}
+		}
+		if _, ok := f.Composite.(*Array); ok {
+			for _, fr := range f.References {
+				if fr.KeyPathIndex() < len(fr.KeyPath.Path)-1 {
+					*errs = append(*errs, kindErrorf(ErrIndexIntoArray, fr.String, "cannot index into array"))
+				}
+			}
+		}
+		if f.Map() != nil {
+			f.Map().validate(errs)
+		}
+	}
+
+	for _, e := range m.Edges {
+		if ParentEdge(m) != nil {
+			*errs = append(*errs, d2parser.Errorf(nodeAST(e), "cannot create edge inside edge"))
+		}
+		if findProhibitedEdgeKeyword(e.ID.SrcPath...) != -1 || findProhibitedEdgeKeyword(e.ID.DstPath...) != -1 {
+			*errs = append(*errs, kindErrorf(ErrReservedInEdge, nodeAST(e), "reserved keywords are prohibited in edges"))
+		}
+		src := m.GetField(e.ID.SrcPath...)
+		dst := m.GetField(e.ID.DstPath...)
+		if src != nil && dst != nil {
+			if NodeBoardKind(src) != "" || NodeBoardKind(dst) != "" || !SameBoard(src, dst) {
+				*errs = append(*errs, d2parser.Errorf(nodeAST(e), "cannot create edges between boards"))
+			}
+		}
+		if e.Map_ != nil {
+			e.Map_.validate(errs)
+		}
+	}
+	m.checkEdgeIndices(errs)
+}
+
+// CheckEdgeIndices checks that the indices of the edges of m and its descendants between the
+// same endpoints are 0 to n-1 without duplicates, as compiling and reindexing leave them, and
+// returns an error per group of edges that aren't. Validate includes these errors.
+func (m *Map) CheckEdgeIndices() []error {
+	var errs []error
+	m.checkEdgeIndicesRecursive(&errs)
+	return errs
+}
+
+func (m *Map) checkEdgeIndicesRecursive(errs *[]error) {
+	if m == nil {
+		return
+	}
+	m.checkEdgeIndices(errs)
+	for _, f := range m.Fields {
+		f.Map().checkEdgeIndicesRecursive(errs)
+	}
+	for _, e := range m.Edges {
+		e.Map_.checkEdgeIndicesRecursive(errs)
+	}
+}
+
+func (m *Map) checkEdgeIndices(errs *[]error) {
+	var groups [][]*Edge
+	for _, e := range m.Edges {
+		i := 0
+		for ; i < len(groups); i++ {
+			if groups[i][0].ID.matchEndpoints(e.ID) {
+				break
+			}
+		}
+		if i == len(groups) {
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], e)
+	}
+
+	for _, ea := range groups {
+		seen := make([]bool, len(ea))
+		ok := true
+		indices := make([]string, len(ea))
+		for i, e := range ea {
+			if e.ID.Index == nil {
+				indices[i] = "none"
+				ok = false
+				continue
+			}
+			index := *e.ID.Index
+			indices[i] = strconv.Itoa(index)
+			if index < 0 || index >= len(ea) || seen[index] {
+				ok = false
+				continue
+			}
+			seen[index] = true
+		}
+		if ok {
+			continue
+		}
+		eid := ea[0].ID.Copy()
+		eid.Index = nil
+		*errs = append(*errs, d2parser.Errorf(nodeAST(ea[0]), "edges %s have indices %s but want 0 to %d",
+			eid, strings.Join(indices, ", "), len(ea)-1))
+	}
+}
+
+// CaseCollisions returns the fields of m and its descendants whose name was written with
+// differing case, which lookups fold together so that Foo: 1 and foo: 2 are silently the
+// same field. Each group holds either sibling fields whose names differ only by case, which
+// compiling doesn't create but which a modified tree may hold, or the single field that keys
+// spelled differently were merged into. The FieldReferences of the fields point at each
+// spelling. Reserved keywords are case insensitive by design and not reported.
+func (m *Map) CaseCollisions() [][]*Field {
+	var groups [][]*Field
+	m.caseCollisions(&groups)
+	return groups
+}
+
+func (m *Map) caseCollisions(groups *[][]*Field) {
+	if m == nil {
+		return
+	}
+	siblings := make(map[string][]*Field)
+	var names []string
+	for _, f := range m.Fields {
+		if _, ok := d2graph.ReservedKeywords[strings.ToLower(f.Name)]; ok {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		if _, ok := siblings[name]; !ok {
+			names = append(names, name)
+		}
+		siblings[name] = append(siblings[name], f)
+	}
+	for _, name := range names {
+		fa := siblings[name]
+		if len(fa) > 1 {
+			*groups = append(*groups, fa)
+			continue
+		}
+		for _, fr := range fa[0].References {
+			if fr.String != nil && fr.String.ScalarString() != fa[0].Name {
+				*groups = append(*groups, fa)
+				break
+			}
+		}
+	}
+
+	for _, f := range m.Fields {
+		f.Map().caseCollisions(groups)
+	}
+	for _, e := range m.Edges {
+		e.Map_.caseCollisions(groups)
+	}
+}
+
+// nodeAST returns the AST of the last reference to n or if n has none, its generated AST.
+func nodeAST(n Node) d2ast.Node {
+	switch n := n.(type) {
+	case *Field:
+		if len(n.References) > 0 {
+			return n.LastRef().AST()
+		}
+	case *Edge:
+		if len(n.References) > 0 {
+			return n.LastRef().AST()
+		}
+	}
+	return n.AST()
+}
@@ -0,0 +1,94 @@
+package d2ir_test
+
+import (
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+x: {
+  y
+}
+`)
+	assert.Equal(t, 0, len(m.Validate()))
+
+	m.GetField("x", "y").Name = "layers"
+	m.Edges[0].ID.DstPath = []string{"shape"}
+	errs := m.Validate()
+	assert.Equal(t, 2, len(errs))
+	assert.ErrorString(t, errs[0], `TestValidate.d2:3:3: layers is only allowed at a board root`)
+	assert.ErrorString(t, errs[1], `TestValidate.d2:1:1: reserved keywords are prohibited in edges`)
+
+	m = mustCompile(t, `a -> b: {
+  c
+}
+c -> a
+`)
+	e := m.Edges[1]
+	m.Edges = m.Edges[:1]
+	m.Edges[0].Map().Edges = append(m.Edges[0].Map().Edges, e)
+	errs = m.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.ErrorString(t, errs[0], `TestValidate.d2:4:1: cannot create edge inside edge`)
+}
+
+func TestCheckEdgeIndices(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+a -> b
+a <- b
+x: {
+  y -> z
+}
+`)
+	assert.Equal(t, 0, len(m.CheckEdgeIndices()))
+
+	m.Edges = m.Edges[1:]
+	errs := m.CheckEdgeIndices()
+	assert.Equal(t, 1, len(errs))
+	assert.ErrorString(t, errs[0], `TestCheckEdgeIndices.d2:2:1: edges a -> b have indices 1, 2 but want 0 to 1`)
+
+	*m.GetField("x").Map().Edges[0].ID.Index = 3
+	errs = m.Validate()
+	assert.Equal(t, 2, len(errs))
+	assert.ErrorString(t, errs[0], `TestCheckEdgeIndices.d2:6:3: edges y -> z have indices 3 but want 0 to 0`)
+
+}
+
+func TestCaseCollisions(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `Foo: 1
+bar
+foo: 2
+x: {
+  Y -> y
+}
+STYLE.fill: red
+Style.stroke: blue
+`)
+	groups := m.CaseCollisions()
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, 1, len(groups[0]))
+	foo := groups[0][0]
+	assert.True(t, foo == m.GetField("foo"))
+	assert.Equal(t, 2, len(foo.References))
+	assert.Equal(t, "foo", foo.References[1].String.ScalarString())
+	assert.Equal(t, 2, foo.References[1].String.GetRange().Start.Line)
+	assert.True(t, groups[1][0] == m.GetField("x", "y"))
+
+	bar := m.GetField("bar")
+	bar.Name = "FOO"
+	groups = m.CaseCollisions()
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, 2, len(groups[0]))
+	assert.True(t, groups[0][1] == bar)
+
+	assert.Equal(t, 0, len(mustCompile(t, "a -> b\na: hi\n").CaseCollisions()))
+}
@@ -0,0 +1,85 @@
+package d2ir
+
+import "fmt"
+
+// MapView is a read-only view of a Map. See Map.ReadOnly.
+type MapView interface {
+	GetField(ida ...string) *Field
+	GetEdges(eid *EdgeID) []*Edge
+	// View returns a view of the map of the field at ida or nil if there is none.
+	View(ida ...string) MapView
+
+	// Fields and Edges return copies of the fields and edges of the map.
+	Fields() []*Field
+	Edges() []*Edge
+
+	FieldCount() int
+	EdgeCount() int
+	FieldCountRecursive() int
+	EdgeCountRecursive() int
+
+	Equal(v2 MapView) bool
+	fmt.Stringer
+}
+
+// ReadOnly returns a view of m that only exposes methods to query it. It's meant for handing
+// the IR across an API boundary without handing out the mutating methods of *Map.
+//
+// It's a shallow guard, not a deep freeze: the fields and edges returned by the view are the
+// ones in m and can still be mutated, and mutations of m are visible through the view.
+func (m *Map) ReadOnly() MapView {
+	return mapView{m: m}
+}
+
+type mapView struct {
+	m *Map
+}
+
+func (v mapView) GetField(ida ...string) *Field {
+	return v.m.GetField(ida...)
+}
+
+func (v mapView) GetEdges(eid *EdgeID) []*Edge {
+	return v.m.GetEdges(eid, nil)
+}
+
+func (v mapView) View(ida ...string) MapView {
+	f := v.m.GetField(ida...)
+	if f == nil || f.Map() == nil {
+		return nil
+	}
+	return f.Map().ReadOnly()
+}
+
+func (v mapView) Fields() []*Field {
+	return append([]*Field(nil), v.m.Fields...)
+}
+
+func (v mapView) Edges() []*Edge {
+	return append([]*Edge(nil), v.m.Edges...)
+}
+
+func (v mapView) FieldCount() int {
+	return v.m.FieldCount()
+}
+
+func (v mapView) EdgeCount() int {
+	return v.m.EdgeCount()
+}
+
+func (v mapView) FieldCountRecursive() int {
+	return v.m.FieldCountRecursive()
+}
+
+func (v mapView) EdgeCountRecursive() int {
+	return v.m.EdgeCountRecursive()
+}
+
+func (v mapView) Equal(v2 MapView) bool {
+	mv2, ok := v2.(mapView)
+	return ok && v.m.Equal(mv2.m)
+}
+
+func (v mapView) String() string {
+	return v.m.String()
+}
@@ -0,0 +1,43 @@
+package d2ir_test
+
+import (
+	"testing"
+
+	"oss.terrastruct.com/util-go/assert"
+
+	"oss.terrastruct.com/d2/d2ir"
+	"oss.terrastruct.com/d2/d2parser"
+)
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+
+	m := mustCompile(t, `a -> b
+a -> b
+x: {
+  y -> z
+}
+`)
+	v := m.ReadOnly()
+	assert.Equal(t, 3, v.FieldCount())
+	assert.Equal(t, 2, v.EdgeCount())
+	assert.Equal(t, 5, v.FieldCountRecursive())
+	assert.Equal(t, 3, v.EdgeCountRecursive())
+	assert.True(t, v.GetField("x", "y") == m.GetField("x", "y"))
+	assert.String(t, m.String(), v.String())
+	assert.True(t, v.Equal(mustCompile(t, m.String()).ReadOnly()))
+
+	k, err := d2parser.ParseMapKey("(a -> b)[1]")
+	assert.Success(t, err)
+	ea := v.GetEdges(d2ir.NewEdgeIDs(k)[0])
+	assert.Equal(t, 1, len(ea))
+	assert.True(t, ea[0] == m.Edges[1])
+
+	xv := v.View("x")
+	assert.Equal(t, 1, xv.EdgeCount())
+	assert.Equal(t, nil, v.View("a"))
+
+	fa := v.Fields()
+	fa[0] = nil
+	assert.True(t, m.Fields[0] != nil)
+}
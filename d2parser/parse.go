@@ -180,6 +180,15 @@ func (pe *ParseError) Empty() bool {
 	return len(pe.Errors) == 0
 }
 
+// Unwrap returns the errors in pe for errors.Is and errors.As.
+func (pe *ParseError) Unwrap() []error {
+	errs := make([]error, len(pe.Errors))
+	for i, err := range pe.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
 func (pe *ParseError) Error() string {
 	var sb strings.Builder
 	for i, err := range pe.Errors {
@@ -828,7 +837,8 @@ func (p *parser) parseEdgeIndex() *d2ast.EdgeIndex {
 
 	if unicode.IsDigit(r) {
 		p.commit()
-		var sb strings.Builder
+		var sb, sbEnd strings.Builder
+		isRange := false
 		sb.WriteRune(r)
 		for {
 			r, newlines, eof = p.peekNotSpace()
@@ -842,14 +852,40 @@ func (p *parser) parseEdgeIndex() *d2ast.EdgeIndex {
 				break
 			}
 			p.commit()
+			if r == '.' && !isRange {
+				r, eof = p.peek()
+				if eof || r != '.' {
+					p.rewind()
+					p.errorf(p.pos.Subtract('.', p.utf16Pos), p.pos, "unexpected character in edge index")
+					continue
+				}
+				p.commit()
+				isRange = true
+				continue
+			}
 			if !unicode.IsDigit(r) {
 				p.errorf(p.pos.Subtract(r, p.utf16Pos), p.pos, "unexpected character in edge index")
 				continue
 			}
-			sb.WriteRune(r)
+			if isRange {
+				sbEnd.WriteRune(r)
+			} else {
+				sb.WriteRune(r)
+			}
 		}
 		i, _ := strconv.Atoi(sb.String())
 		ei.Int = &i
+		if isRange {
+			if sbEnd.Len() == 0 {
+				p.errorf(ei.Range.Start, p.pos, "edge index range missing end")
+			} else {
+				end, _ := strconv.Atoi(sbEnd.String())
+				if end < i {
+					p.errorf(ei.Range.Start, p.pos, "edge index range end %d is before start %d", end, i)
+				}
+				ei.IntEnd = &end
+			}
+		}
 	} else if r == '*' {
 		p.commit()
 		ei.Glob = true
@@ -155,6 +155,14 @@ is: 'It is very difficult to disprove certain kinds of pain.'"
 			text: `
 my_fn() -> wowa()
 meow.(x -> y -> z)[3].shape: "all hail corn"
+`,
+		},
+		{
+			name: "edge_index_range",
+			text: `
+(x -> y)[1..3].style.fill: red
+(x -> y)[2..1]
+(x -> y)[1..]
 `,
 		},
 		{